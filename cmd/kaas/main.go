@@ -1,81 +1,184 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"errors"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/contrib/static"
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
 	"github.com/jasonlvhit/gocron"
+	"github.com/sirupsen/logrus"
 
 	"github.com/vrutkovs/kaas/pkg/kaas"
 )
 
+const (
+	configReloadInterval = 30 * time.Second
+	loginRetryInterval   = 10 * time.Second
+)
+
 // health is k8s endpoint for liveness check
 func health(c *gin.Context) {
 	c.String(http.StatusOK, "")
 }
 
-func main() {
-	kubeConfigEnvVar := os.Getenv("KUBECONFIG")
+// connect logs in target clusters and starts background jobs which need k8s clients.
+// Clusters are connected independently, so that an unreachable cluster doesn't block the rest.
+// Leader election starts once the home cluster is connected
+func connect(ctx, trackerCtx context.Context, server *kaas.ServerSettings, cfg kaas.Config) {
+	for i, cluster := range server.Clusters {
+		go func(cluster *kaas.Cluster, home bool) {
+			if !connectCluster(ctx, trackerCtx, server.Log.WithField("cluster", cluster.Name), cluster) {
+				return
+			}
+			if home {
+				go server.RunWhileLeader(ctx, cfg.LeaseName, func(leaderCtx context.Context) {
+					runLeaderJobs(leaderCtx, server, cfg)
+				})
+			}
+		}(cluster, i == 0)
+	}
+}
 
-	k8sC, routeC, err := kaas.TryLogin(kubeConfigEnvVar)
-	if err != nil {
-		log.Println("Failed to login in cluster")
-		log.Println(err)
-		return
+// connectCluster logs in the cluster, retrying until ctx is done, and starts its instance tracker and quota watch.
+// Instance tracker uses trackerCtx, as it should outlive ctx until in-flight creations are finished
+func connectCluster(ctx, trackerCtx context.Context, log *logrus.Entry, cluster *kaas.Cluster) bool {
+	for {
+		k8sC, routeC, err := kaas.TryLogin(cluster.Kubeconfig)
+		if err == nil {
+			cluster.K8sClient = k8sC
+			cluster.RouteClient = routeC
+			if err = cluster.GetResourceQuota(); err == nil {
+				break
+			}
+		}
+		log.WithError(err).Error("failed to login in cluster, retrying")
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(loginRetryInterval):
+		}
+	}
+	if err := cluster.StartInstanceTracker(trackerCtx); err != nil {
+		log.WithError(err).Error("failed to start instance tracker")
+		return false
 	}
+	cluster.MarkClientsReady()
+	log.Info("connected to cluster")
 
-	namespace := "kaas"
-	envVarNamespace := os.Getenv("NAMESPACE")
-	if len(envVarNamespace) != 0 {
-		namespace = envVarNamespace
+	go cluster.WatchResourceQuota(ctx)
+	return true
+}
+
+// runLeaderJobs runs background jobs which must not run in several replicas at once until ctx is done
+func runLeaderJobs(ctx context.Context, server *kaas.ServerSettings, cfg kaas.Config) {
+	server.ResumeInterrupted(ctx)
+
+	interval := uint64(cfg.CleanupInterval.Minutes())
+	scheduler := gocron.NewScheduler()
+	scheduler.Every(interval).Minutes().Do(server.CleanupOldDeployements)
+	// Pick up creations interrupted by other replicas stopping
+	scheduler.Every(interval).Minutes().Do(server.ResumeInterrupted, ctx)
+	stopScheduler := scheduler.Start()
+
+	<-ctx.Done()
+	stopScheduler <- true
+	scheduler.Clear()
+}
+
+func main() {
+	cfg, configSource, err := kaas.ParseConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to load config")
 	}
 
-	rquotaName := "pod-quota"
-	envVarRquotaName := os.Getenv("QUOTA_NAME")
-	if len(envVarRquotaName) != 0 {
-		rquotaName = envVarRquotaName
+	logger, err := kaas.SetupLogger(cfg.LogLevel)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid log level")
 	}
+	log := logrus.NewEntry(logger)
 
-	rqStatus := kaas.RQuotaStatus{}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	shutdownTracing, err := kaas.SetupTracing(ctx)
+	if err != nil {
+		log.WithError(err).Error("failed to setup tracing, continuing without it")
+	}
+	defer shutdownTracing(context.Background())
 
 	server := &kaas.ServerSettings{
-		K8sClient:   k8sC,
-		RouteClient: routeC,
-		Namespace:   namespace,
-		RQuotaName:  rquotaName,
-		RQStatus:    &rqStatus,
-		Conns:       make(map[string]*websocket.Conn),
-		Datasources: make(map[string]int),
+		Log: log,
 	}
-	if server.GetResourceQuota() != nil {
-		fmt.Print("Failed to read initial resource quota")
+	if cfg.Runtime == kaas.RuntimeLocal {
+		local := kaas.NewLocalRuntime(cfg.Local)
+		defer local.Close()
+		server.AddLocalCluster(local)
 	} else {
-		go server.WatchResourceQuota()
+		for _, clusterCfg := range cfg.TargetClusters() {
+			server.AddCluster(clusterCfg)
+		}
+	}
+	if cfg.InstanceTemplate != "" {
+		server.Template, err = kaas.LoadInstanceTemplate(cfg.InstanceTemplate)
+		if err != nil {
+			log.WithError(err).Fatal("failed to load instance template")
+		}
+	}
+	server.SetConfig(cfg)
+	if configSource.Path != "" {
+		go server.WatchConfig(ctx, configSource, configReloadInterval)
 	}
 
 	r := gin.New()
 	r.SetTrustedProxies(nil)
 
 	// Server static HTML
-	r.Use(static.Serve("/", static.LocalFile("./html", true)))
+	r.Use(static.Serve("/", static.LocalFile(cfg.StaticDir, true)))
 
-	// Don't log k8s health endpoint
+	// Don't log k8s health endpoints
 	r.Use(
-		gin.LoggerWithWriter(gin.DefaultWriter, "/health"),
+		kaas.GinLogger(log, "/health", "/readyz"),
 		gin.Recovery(),
 	)
 	r.GET("/health", health)
+	r.GET("/readyz", server.HandleReadyz)
 	r.GET("/ws/status", server.HandleStatusViaWS)
+	r.GET("/api/instances", server.HandleListInstances)
 
+	srv := &http.Server{
+		Addr:    cfg.ListenAddress,
+		Handler: r,
+	}
 	go func() {
-		gocron.Every(2).Minutes().Do(server.CleanupOldDeployements)
-		<-gocron.Start()
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Fatal("failed to start server")
+		}
 	}()
 
-	r.Run(":8080")
+	trackerCtx, stopTracker := context.WithCancel(context.Background())
+	defer stopTracker()
+	if cfg.Runtime == kaas.RuntimeLocal {
+		// Local instances don't outlive this process, so there is nothing to share with other replicas
+		go runLeaderJobs(ctx, server, cfg)
+	} else {
+		connect(ctx, trackerCtx, server, cfg)
+	}
+
+	<-ctx.Done()
+	log.Info("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.WithError(err).Error("failed to finish in-flight creations")
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.WithError(err).Error("failed to stop http server")
+	}
 }
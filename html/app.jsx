@@ -47,6 +47,34 @@ class SearchBar extends React.Component {
             {btn}
             </ReactBootstrap.Col>
           </ReactBootstrap.Row>
+          <ReactBootstrap.Row>
+            <ReactBootstrap.Col xs={10}>
+              <ReactBootstrap.Form.Check
+                type="checkbox"
+                id="headless"
+                label="API only, without console"
+                checked={this.props.headless}
+                onChange={event => this.props.onHeadlessChange(event.target.checked)}
+              />
+            </ReactBootstrap.Col>
+          </ReactBootstrap.Row>
+          {this.props.regions.length > 0 &&
+            <ReactBootstrap.Row>
+              <ReactBootstrap.Col xs={4}>
+                <ReactBootstrap.FormControl
+                  as="select"
+                  size="sm"
+                  value={this.props.region}
+                  onChange={event => this.props.onRegionChange(event.target.value)}
+                >
+                  <option value="">Any region</option>
+                  {this.props.regions.map(region =>
+                    <option key={region} value={region}>{region}</option>
+                  )}
+                </ReactBootstrap.FormControl>
+              </ReactBootstrap.Col>
+            </ReactBootstrap.Row>
+          }
         </ReactBootstrap.FormGroup>
       </ReactBootstrap.Form>
     );
@@ -63,6 +91,51 @@ class DeleteAppButton extends React.Component {
   }
 }
 
+class DiagnosisReport extends React.Component {
+  render() {
+    let diagnosis = this.props.diagnosis;
+    if (diagnosis == null) {
+      return (
+        <span></span>
+      )
+    }
+    let pods = diagnosis.pods || [];
+    let events = diagnosis.events || [];
+    return (
+      <details>
+        <summary>Diagnosis: {diagnosis.category}</summary>
+        {pods.map(pod =>
+          <div>
+            <hr/>
+            <b>Pod {pod.name}</b>: {pod.phase} {pod.reason}
+            <ul>
+              {(pod.conditions || []).map(cond =>
+                <li>{cond.type}={cond.status} {cond.reason} {cond.message}</li>
+              )}
+            </ul>
+            {(pod.containers || []).map(container =>
+              <div>
+                <i>{container.init ? "Init container" : "Container"} {container.name}</i>: {container.state} {container.reason},
+                restarts: {container.restartCount}
+                {container.lastTerminationReason ? ", last termination: " + container.lastTerminationReason : ""}
+                {container.logs ? <pre>{container.logs}</pre> : null}
+                {container.previousLogs ? <div>Previous run:<pre>{container.previousLogs}</pre></div> : null}
+              </div>
+            )}
+          </div>
+        )}
+        {events.length > 0 ? <div><hr/><b>Events</b>
+          <ul>
+            {events.map(event =>
+              <li>{event.object}: {event.type} {event.reason} {event.message}</li>
+            )}
+          </ul></div> : null}
+        <div>Resource quota: {diagnosis.quota.used}/{diagnosis.quota.hard} pods</div>
+      </details>
+    )
+  }
+}
+
 class Message extends React.Component {
   render() {
     var variants = {
@@ -72,8 +145,15 @@ class Message extends React.Component {
       "done": "success"
     }
     switch (this.props.action) {
-      case 'done':
       case 'failure':
+        return (
+          <ReactBootstrap.Alert className="alert-small" variant={variants[this.props.action]}>
+            <div style={{whiteSpace: "pre-wrap"}}>{this.props.message}</div>
+            <DiagnosisReport diagnosis={this.props.diagnosis}/>
+          </ReactBootstrap.Alert>
+        )
+        break;
+      case 'done':
       case 'status':
         return (
           <ReactBootstrap.Alert className="alert-small" variant={variants[this.props.action]}>
@@ -89,19 +169,23 @@ class Message extends React.Component {
         )
         break;
       case 'choose':
-        const items = JSON.parse(this.props.message);
-
         return (
-            <ReactBootstrap.Alert className="alert-small" variant="primary">
-              <ReactBootstrap.Alert.Heading>Choose a Dump</ReactBootstrap.Alert.Heading>
-              <p>Multiple cluster dumps were found, please pick one:</p>
-              <hr/>
-              {items.map((item, index) => {
-                let url = new URL(window.location.href);
-                url.searchParams.set('search', item);
-                return (<p><a href={url.toString()}>{item}</a></p>)
-              })}
-            </ReactBootstrap.Alert>
+          <ChooseDumps
+            items={JSON.parse(this.props.message)}
+            onLoadDumps={this.props.onLoadDumps}
+          />
+        )
+      case 'existing':
+        return (
+          <ReactBootstrap.Alert className="alert-small" variant="primary">
+            <p>{this.props.message}</p>
+            <ReactBootstrap.Button size="sm" onClick={() => this.props.onShare(this.props.data.hash)}>
+              Use it
+            </ReactBootstrap.Button>{' '}
+            <ReactBootstrap.Button size="sm" variant="secondary" onClick={() => this.props.onForceNew(this.props.data.url, JSON.parse(this.props.data.dumps))}>
+              Create a new instance
+            </ReactBootstrap.Button>
+          </ReactBootstrap.Alert>
         )
       case 'kubeconfig':
         var encodedKubeconfig = "data:text/yaml;charset=utf-8;base64,"+ btoa(this.props.message);
@@ -121,6 +205,19 @@ class Message extends React.Component {
           </ReactBootstrap.Alert>
         )
         break;
+      case 'job':
+        return (
+          <JobInfo job={JSON.parse(this.props.message)} />
+        )
+      case 'links':
+        return (
+          <ReactBootstrap.Alert className="alert-small" variant="primary">
+            <ReactBootstrap.Alert.Heading>{this.props.message}</ReactBootstrap.Alert.Heading>
+            {Object.keys(this.props.data).map(name =>
+              <p>{name}: <ReactBootstrap.Alert.Link href={this.props.data[name]}>{this.props.data[name]}</ReactBootstrap.Alert.Link></p>
+            )}
+          </ReactBootstrap.Alert>
+        )
       default:
         return (
           <span></span>
@@ -129,6 +226,97 @@ class Message extends React.Component {
   }
 }
 
+class JobInfo extends React.Component {
+  render() {
+    let job = this.props.job;
+    let name = job.url ? <ReactBootstrap.Alert.Link href={job.url}>{job.job}</ReactBootstrap.Alert.Link> : job.job;
+    let pulls = (job.refs && job.refs.pulls) || [];
+    return (
+      <ReactBootstrap.Alert className="alert-small" variant="light">
+        <ReactBootstrap.Alert.Heading>{name} #{job.buildID}</ReactBootstrap.Alert.Heading>
+        {job.result && <p>Result: {job.result}</p>}
+        {job.version && <p>Version: {job.version}</p>}
+        {job.started && <p>Started: {new Date(job.started).toLocaleString()}</p>}
+        {job.finished && <p>Finished: {new Date(job.finished).toLocaleString()}</p>}
+        {job.refs && <p>Repo: {job.refs.org}/{job.refs.repo} {job.refs.base_ref}</p>}
+        {pulls.map(pull =>
+          <p>PR: <ReactBootstrap.Alert.Link href={pull.link}>#{pull.number}</ReactBootstrap.Alert.Link> by {pull.author}</p>
+        )}
+      </ReactBootstrap.Alert>
+    )
+  }
+}
+
+class ChooseDumps extends React.Component {
+  constructor(props) {
+    super(props);
+    this.state = {
+      selected: [],
+    };
+    this.toggle = this.toggle.bind(this);
+  }
+
+  toggle(item) {
+    this.setState(state => ({
+      selected: state.selected.includes(item) ?
+        state.selected.filter(selected => selected !== item) :
+        [...state.selected, item],
+    }))
+  }
+
+  render() {
+    return (
+      <ReactBootstrap.Alert className="alert-small" variant="primary">
+        <ReactBootstrap.Alert.Heading>Choose Dumps</ReactBootstrap.Alert.Heading>
+        <p>Multiple cluster dumps were found, pick one or several to load into one instance:</p>
+        <hr/>
+        {this.props.items.map(item =>
+          <ReactBootstrap.Form.Check
+            type="checkbox"
+            id={item}
+            label={item}
+            checked={this.state.selected.includes(item)}
+            onChange={() => this.toggle(item)}
+          />
+        )}
+        <hr/>
+        <ReactBootstrap.Button size="sm" disabled={this.state.selected.length == 0} onClick={() => this.props.onLoadDumps(this.state.selected)}>
+          Load selected
+        </ReactBootstrap.Button>{' '}
+        <ReactBootstrap.Button size="sm" variant="secondary" onClick={() => this.props.onLoadDumps(this.props.items)}>
+          Load all
+        </ReactBootstrap.Button>
+      </ReactBootstrap.Alert>
+    )
+  }
+}
+
+class QuotaUsageBar extends React.Component {
+  render() {
+    let usage = this.props.usage;
+    if (usage == null || !usage.hard) {
+      return (
+        <span></span>
+      )
+    }
+    return (
+      <div>
+        <small>{this.props.title}</small>
+        <ReactBootstrap.ProgressBar now={usage.used} max={usage.hard}
+          label={this.props.format(usage.used) + "/" + this.props.format(usage.hard)}/>
+      </div>
+    )
+  }
+}
+
+function formatCPU(millicores) {
+  return (millicores / 1000).toFixed(1)
+}
+
+function formatMemory(bytes) {
+  return (bytes / (1024 * 1024 * 1024)).toFixed(1) + "Gi"
+}
+
 class ResourceQuotaStatus extends React.Component {
   render() {
     if (this.props === null || this.props.resourceQuota === null) {
@@ -148,6 +336,8 @@ class ResourceQuotaStatus extends React.Component {
         <div>Current resource quota</div>
         <ReactBootstrap.ProgressBar now={used} max={hard}
           label={used + "/" +hard}/>
+        <QuotaUsageBar title="CPU" usage={this.props.resourceQuota.cpu} format={formatCPU}/>
+        <QuotaUsageBar title="Memory" usage={this.props.resourceQuota.memory} format={formatMemory}/>
       </div>
     )
   }
@@ -167,7 +357,12 @@ class Status extends React.Component {
               <Message
                 action={item.action}
                 message={item.message}
+                data={item.data}
+                diagnosis={item.diagnosis}
                 onDeleteApp={this.props.onDeleteApp}
+                onShare={this.props.onShare}
+                onForceNew={this.props.onForceNew}
+                onLoadDumps={this.props.onLoadDumps}
               />
             )
           }
@@ -217,6 +412,9 @@ class SearchForm extends React.Component {
       querySearch: '',
       searchInput: '',
       messages: [],
+      headless: false,
+      regions: [],
+      region: '',
       appName: null,
       apps: storage.getData(),
       ws: null,
@@ -236,6 +434,31 @@ class SearchForm extends React.Component {
     this.connect = this.connect.bind(this);
     this.check = this.check.bind(this);
     this.search = this.search.bind(this);
+    this.share = this.share.bind(this);
+    this.forceNew = this.forceNew.bind(this);
+    this.loadDumps = this.loadDumps.bind(this);
+    this.handleHeadlessChange = this.handleHeadlessChange.bind(this);
+    this.handleRegionChange = this.handleRegionChange.bind(this);
+  }
+
+  handleHeadlessChange(headless) {
+    this.setState({headless: headless});
+  }
+
+  handleRegionChange(region) {
+    this.setState({region: region});
+  }
+
+  // newInstanceData returns data of 'new' message with instance options
+  newInstanceData(data) {
+    data = data || {};
+    if (this.state.headless) {
+      data['console'] = 'false';
+    }
+    if (this.state.region) {
+      data['region'] = this.state.region;
+    }
+    return data;
   }
 
   handleSearchInput(searchInput) {
@@ -272,12 +495,39 @@ class SearchForm extends React.Component {
       this.sendWSMessage(JSON.stringify({
         'action': 'new',
         'message': input,
+        'data': this.newInstanceData(),
       }));
     } catch (error) {
       console.log(error);
     }
   }
 
+  share(appName) {
+    this.setState({messages: []});
+    this.sendWSMessage(JSON.stringify({
+      'action': 'share',
+      'message': appName,
+    }));
+  }
+
+  forceNew(input, dumps) {
+    this.setState({messages: []});
+    this.sendWSMessage(JSON.stringify({
+      'action': 'new',
+      'message': input,
+      'data': this.newInstanceData({'force': 'true', 'dumps': JSON.stringify(dumps)}),
+    }));
+  }
+
+  loadDumps(dumps) {
+    this.setState({messages: []});
+    this.sendWSMessage(JSON.stringify({
+      'action': 'new',
+      'message': this.state.searchInput,
+      'data': this.newInstanceData({'dumps': JSON.stringify(dumps)}),
+    }));
+  }
+
   handleDeleteApp(appName) {
     console.log(appName)
     if (this.state.appName === appName) {
@@ -328,12 +578,17 @@ class SearchForm extends React.Component {
       }
       this.setState(state => ({apps: storage.getData()}))
     }
+    if (message.action === "regions") {
+      this.setState(state => ({regions: JSON.parse(message.message)}))
+    }
     if (message.action === "rquota") {
       let rquotaStatus = JSON.parse(message.message)
       this.setState(state => ({
         resourceQuota: {
           used: rquotaStatus.used,
           hard: rquotaStatus.hard,
+          cpu: rquotaStatus.cpu,
+          memory: rquotaStatus.memory,
         }
       }))
     }
@@ -425,7 +680,12 @@ class SearchForm extends React.Component {
     let searchClass;
     if(this.state.appName != null) {
       messages =
-        <Status messages={this.state.messages} />
+        <Status
+          messages={this.state.messages}
+          onShare={this.share}
+          onForceNew={this.forceNew}
+          onLoadDumps={this.loadDumps}
+        />
       searchClass = null;
     } else {
       messages = [];
@@ -441,6 +701,11 @@ class SearchForm extends React.Component {
           onSearchSubmit={this.handleSearchSubmit}
           onDeleteApp={this.handleDeleteCurrentApp}
           appName={this.state.appName}
+          headless={this.state.headless}
+          onHeadlessChange={this.handleHeadlessChange}
+          regions={this.state.regions}
+          region={this.state.region}
+          onRegionChange={this.handleRegionChange}
         />
         <ReactBootstrap.Row>
           <ReactBootstrap.Col xs={4}/>
@@ -0,0 +1,108 @@
+package kaas
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// InstanceSummary describes an instance returned by the API
+type InstanceSummary struct {
+	Name       string            `json:"name"`
+	Cluster    string            `json:"cluster"`
+	State      string            `json:"state"`
+	Source     string            `json:"source,omitempty"`
+	Dumps      []string          `json:"dumps,omitempty"`
+	RefCount   int               `json:"refcount"`
+	APIs       map[string]string `json:"apis,omitempty"`
+	Consoles   map[string]string `json:"consoles,omitempty"`
+	Companions map[string]string `json:"companions,omitempty"`
+	Job        *JobInfo          `json:"job,omitempty"`
+	Created    time.Time         `json:"created"`
+}
+
+// HandleListInstances lists instances, optionally filtered by job, build, repo ("org/repo") and pull query params
+func (s *ServerSettings) HandleListInstances(c *gin.Context) {
+	if err := s.Ready(); err != nil {
+		c.String(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	filter := &JobInfo{
+		Job:     c.Query("job"),
+		BuildID: c.Query("build"),
+	}
+	if repo := c.Query("repo"); repo != "" {
+		orgRepo := strings.SplitN(repo, "/", 2)
+		if len(orgRepo) != 2 {
+			c.String(http.StatusBadRequest, "repo must be in org/repo format")
+			return
+		}
+		filter.Refs = &ProwRefs{Org: orgRepo[0], Repo: orgRepo[1]}
+	}
+	pull := c.Query("pull")
+	if pull != "" {
+		if _, err := strconv.Atoi(pull); err != nil {
+			c.String(http.StatusBadRequest, "pull must be a number")
+			return
+		}
+	}
+
+	selector := jobSelector(filter, pull).String()
+	instances := []InstanceSummary{}
+	for _, cluster := range s.connectedClusters() {
+		records, err := cluster.runtime.listRecords(c.Request.Context(), selector)
+		if err != nil {
+			cluster.logger().WithError(err).Warn("failed to list instance records")
+			c.String(http.StatusInternalServerError, fmt.Sprintf("failed to list instances in cluster %s", cluster.Name))
+			return
+		}
+		for _, cm := range records {
+			instance := InstanceSummary{
+				Name:    cm.Labels[appLabelKey],
+				Cluster: cluster.Name,
+				State:   cm.Data[recordState],
+				Source:  cm.Data[recordSource],
+				Created: cm.CreationTimestamp.Time,
+			}
+			if dumps := cm.Data[recordDump]; dumps != "" {
+				instance.Dumps = strings.Split(dumps, "\n")
+			}
+			instance.RefCount, _ = strconv.Atoi(cm.Data[recordRefCount])
+			if endpoints, err := unmarshalEndpoints(cm.Data[recordEndpoints]); err == nil {
+				instance.APIs = make(map[string]string, len(endpoints))
+				for _, endpoint := range endpoints {
+					instance.APIs[endpoint.Name] = endpoint.APIURL
+				}
+				instance.Consoles = consoleLinks(endpoints)
+			}
+			if companions, ok := cm.Data[recordCompanions]; ok {
+				_ = json.Unmarshal([]byte(companions), &instance.Companions)
+			}
+			if jobJSON, ok := cm.Data[recordJob]; ok {
+				job := &JobInfo{}
+				if err := json.Unmarshal([]byte(jobJSON), job); err == nil {
+					instance.Job = job
+				}
+			}
+			if instance.Job == nil {
+				if filter.Job != "" || filter.BuildID != "" || filter.Refs != nil {
+					continue
+				}
+			} else if !instance.Job.matches(filter) {
+				continue
+			}
+			instances = append(instances, instance)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Created.After(instances[j].Created)
+	})
+	c.JSON(http.StatusOK, instances)
+}
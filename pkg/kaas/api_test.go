@@ -0,0 +1,91 @@
+package kaas
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listInstances calls the instance API with query and returns the status code and names of listed instances
+func listInstances(t *testing.T, s *ServerSettings, query string) (int, []string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/instances?"+query, nil)
+	s.HandleListInstances(c)
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	var instances []InstanceSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &instances); err != nil {
+		t.Fatalf("failed to decode instances: %v", err)
+	}
+	names := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		names = append(names, instance.Name)
+	}
+	sort.Strings(names)
+	return w.Code, names
+}
+
+func TestHandleListInstancesFilters(t *testing.T) {
+	env := newTestEnv(t, testConfig(), true)
+	for appLabel, job := range map[string]*JobInfo{
+		"periodic": {Job: "periodic-e2e", BuildID: "1"},
+		"pull": {
+			Job:     "pull-ci-openshift-origin-master-e2e",
+			BuildID: "2",
+			Refs:    &ProwRefs{Org: "openshift", Repo: "origin", Pulls: []ProwPull{{Number: 42}}},
+		},
+		"manual": nil,
+	} {
+		data := map[string]string{recordState: stateReady}
+		if job != nil {
+			jobJSON, _ := json.Marshal(job)
+			data[recordJob] = string(jobJSON)
+		}
+		if err := env.cluster.updateInstanceRecord(context.TODO(), appLabel, data); err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		query    string
+		status   int
+		expected []string
+	}{
+		{name: "all", status: http.StatusOK, expected: []string{"manual", "periodic", "pull"}},
+		{name: "job", query: "job=periodic-e2e", status: http.StatusOK, expected: []string{"periodic"}},
+		{name: "build", query: "build=2", status: http.StatusOK, expected: []string{"pull"}},
+		{name: "repo", query: "repo=openshift/origin", status: http.StatusOK, expected: []string{"pull"}},
+		{name: "pull", query: "pull=42", status: http.StatusOK, expected: []string{"pull"}},
+		{name: "no match", query: "job=periodic-e2e&build=2", status: http.StatusOK, expected: []string{}},
+		{name: "invalid repo", query: "repo=origin", status: http.StatusBadRequest},
+		{name: "invalid pull", query: "pull=abc", status: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, names := listInstances(t, env.server, tc.query)
+			if status != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, status)
+			}
+			if tc.expected != nil && !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, names)
+			}
+		})
+	}
+}
+
+func TestHandleListInstancesNotReady(t *testing.T) {
+	env := newTestEnv(t, testConfig(), true)
+	env.cluster.clientsReady.Store(false)
+	if status, _ := listInstances(t, env.server, ""); status != http.StatusServiceUnavailable {
+		t.Errorf("expected API to be unavailable without clusters, got %d", status)
+	}
+}
@@ -0,0 +1,342 @@
+package kaas
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// cacheLabel marks persistent volume claims storing extracted dumps
+	cacheLabel = "kaas.openshift.io/dump-cache"
+
+	cacheURLAnnotation       = "kaas.openshift.io/dump-url"
+	cacheStateAnnotation     = "kaas.openshift.io/cache-state"
+	cacheSizeAnnotation      = "kaas.openshift.io/cache-size"
+	cacheLastUsedAnnotation  = "kaas.openshift.io/last-used"
+	cachePopulatorAnnotation = "kaas.openshift.io/populated-by"
+
+	cacheStatePopulating = "populating"
+	cacheStateReady      = "ready"
+
+	// cacheCompleteMarker is created in the volume once the dump is fully extracted
+	cacheCompleteMarker = ".kaas-complete"
+)
+
+// dumpVolume describes the volume instance reads the dump from
+type dumpVolume struct {
+	source corev1.VolumeSource
+	// populate is set when the init container has to download the dump
+	populate bool
+	// cached is set when the volume is a cache claim
+	cached bool
+}
+
+func emptyDumpVolume() dumpVolume {
+	return dumpVolume{
+		source: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+		populate: true,
+	}
+}
+
+func cachedDumpVolume(claimName string, populate bool) dumpVolume {
+	return dumpVolume{
+		source: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: claimName,
+				ReadOnly:  !populate,
+			},
+		},
+		populate: populate,
+		cached:   true,
+	}
+}
+
+func cacheClaimName(dumpURL string) string {
+	return fmt.Sprintf("dump-cache-%s", dumpHash(dumpURL))
+}
+
+// fetcherScript returns init container script downloading the dump into the working dir.
+// Cache volumes are wiped before the download unless the dump is complete, and the size of
+// the extracted dump is reported via termination message
+func fetcherScript(postProcess string, cached bool) string {
+	download := extractScript("DUMPTAR") + ` && ` + postProcess
+	if !cached {
+		return `set -uxo pipefail && \
+		umask 0000 && ` + download
+	}
+	return fmt.Sprintf(`set -uxo pipefail && \
+		umask 0000 && \
+		if [ ! -f %[1]s ]; then \
+		  find . -mindepth 1 -delete && %[2]s && touch %[1]s; \
+		fi && \
+		du -sb . | cut -f1 > /dev/termination-log`, cacheCompleteMarker, download)
+}
+
+// dumpVolume picks the volume for the dump. Cached dumps are mounted read-only, otherwise
+// a new cache claim sized by the tier of the dump is populated. emptyDir is used when caching
+// is disabled or the claim is busy
+func (c *Cluster) dumpVolume(ctx context.Context, logger *logrus.Entry, appLabel, dumpURL string, tier *SizeTier) dumpVolume {
+	cacheCfg := c.Config().DumpCache
+	if !cacheCfg.Enabled {
+		return emptyDumpVolume()
+	}
+	claimName := cacheClaimName(dumpURL)
+	logger = logger.WithField("claim", claimName)
+	pvcs := c.K8sClient.CoreV1().PersistentVolumeClaims(c.Namespace)
+
+	pvc, err := pvcs.Get(ctx, claimName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if err := c.createCacheClaim(ctx, logger, appLabel, dumpURL, tier); err != nil {
+			logger.WithError(err).Warn("failed to create dump cache, using emptyDir")
+			return emptyDumpVolume()
+		}
+		logger.Info("populating dump cache")
+		return cachedDumpVolume(claimName, true)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("failed to get dump cache, using emptyDir")
+		return emptyDumpVolume()
+	}
+	if pvc.Annotations[cacheURLAnnotation] != dumpURL || pvc.DeletionTimestamp != nil {
+		return emptyDumpVolume()
+	}
+
+	switch pvc.Annotations[cacheStateAnnotation] {
+	case cacheStateReady:
+		pvc.Annotations[cacheLastUsedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		if _, err := pvcs.Update(ctx, pvc, metav1.UpdateOptions{}); err != nil {
+			logger.WithError(err).Warn("failed to update dump cache usage time")
+		}
+		logger.Info("using cached dump")
+		return cachedDumpVolume(claimName, false)
+	case cacheStatePopulating:
+		if c.instanceExists(pvc.Annotations[cachePopulatorAnnotation]) {
+			logger.Debug("dump cache is being populated by another instance, using emptyDir")
+			return emptyDumpVolume()
+		}
+		// Population was interrupted, take it over
+		pvc.Annotations[cachePopulatorAnnotation] = appLabel
+		if _, err := pvcs.Update(ctx, pvc, metav1.UpdateOptions{}); err != nil {
+			logger.WithError(err).Warn("failed to take over dump cache, using emptyDir")
+			return emptyDumpVolume()
+		}
+		logger.Info("resuming dump cache population")
+		return cachedDumpVolume(claimName, true)
+	}
+	return emptyDumpVolume()
+}
+
+func (c *Cluster) createCacheClaim(ctx context.Context, logger *logrus.Entry, appLabel, dumpURL string, tier *SizeTier) error {
+	cacheCfg := c.Config().DumpCache
+	volumeSize := cacheCfg.VolumeSize
+	if tier != nil && tier.EphemeralStorage != "" {
+		volumeSize = tier.EphemeralStorage
+	}
+	size, err := resource.ParseQuantity(volumeSize)
+	if err != nil {
+		return fmt.Errorf("invalid dump cache volume size: %v", err)
+	}
+	c.evictCachedDumps(ctx, logger, size.Value())
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: cacheClaimName(dumpURL),
+			Labels: map[string]string{
+				cacheLabel:    "true",
+				dumpHashLabel: dumpHash(dumpURL),
+			},
+			Annotations: map[string]string{
+				cacheURLAnnotation:       dumpURL,
+				cacheStateAnnotation:     cacheStatePopulating,
+				cachePopulatorAnnotation: appLabel,
+				cacheLastUsedAnnotation:  time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{cacheCfg.AccessMode},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+	if cacheCfg.StorageClass != "" {
+		pvc.Spec.StorageClassName = &cacheCfg.StorageClass
+	}
+	spanCtx, span := startSpan(ctx, "create persistent volume claim", attrObject.String(pvc.Name))
+	_, err = c.K8sClient.CoreV1().PersistentVolumeClaims(c.Namespace).Create(spanCtx, pvc, metav1.CreateOptions{})
+	endSpan(span, err)
+	return err
+}
+
+// markDumpCached marks the cache populated by the instance as ready and records the size of the dump
+// reported by fetcher container
+func (c *Cluster) markDumpCached(ctx context.Context, logger *logrus.Entry, appLabel, dumpURL, fetcher string) {
+	if !c.Config().DumpCache.Enabled {
+		return
+	}
+	pvcs := c.K8sClient.CoreV1().PersistentVolumeClaims(c.Namespace)
+	pvc, err := pvcs.Get(ctx, cacheClaimName(dumpURL), metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			logger.WithError(err).Warn("failed to get dump cache")
+		}
+		return
+	}
+	if pvc.Annotations[cacheStateAnnotation] != cacheStatePopulating || pvc.Annotations[cachePopulatorAnnotation] != appLabel {
+		return
+	}
+
+	pvc.Annotations[cacheStateAnnotation] = cacheStateReady
+	delete(pvc.Annotations, cachePopulatorAnnotation)
+	if size, ok := c.extractedDumpSize(appLabel, fetcher); ok {
+		pvc.Annotations[cacheSizeAnnotation] = strconv.FormatInt(size, 10)
+	}
+	if _, err := pvcs.Update(ctx, pvc, metav1.UpdateOptions{}); err != nil {
+		logger.WithError(err).Warn("failed to mark dump cache as ready")
+		return
+	}
+	logger.WithField("claim", pvc.Name).Info("dump cached")
+}
+
+// extractedDumpSize reads the dump size reported by the fetcher init container
+func (c *Cluster) extractedDumpSize(appLabel, fetcher string) (int64, bool) {
+	if c.tracker == nil {
+		return 0, false
+	}
+	pods, err := c.tracker.pods.List(labels.SelectorFromSet(labels.Set{appLabelKey: appLabel}))
+	if err != nil {
+		return 0, false
+	}
+	for _, pod := range pods {
+		for _, status := range pod.Status.InitContainerStatuses {
+			if status.Name != fetcher || status.State.Terminated == nil {
+				continue
+			}
+			size, err := strconv.ParseInt(strings.TrimSpace(status.State.Terminated.Message), 10, 64)
+			if err == nil {
+				return size, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// instanceExists reports whether the instance deployment is present
+func (c *Cluster) instanceExists(appLabel string) bool {
+	if appLabel == "" {
+		return false
+	}
+	if c.tracker != nil {
+		_, err := c.tracker.deployments.Get(fmt.Sprintf("%s-kas", appLabel))
+		return err == nil
+	}
+	_, err := c.K8sClient.AppsV1().Deployments(c.Namespace).Get(context.TODO(), fmt.Sprintf("%s-kas", appLabel), metav1.GetOptions{})
+	return err == nil
+}
+
+// cachedDumpSize returns the size accounted for the cache claim
+func cachedDumpSize(pvc *corev1.PersistentVolumeClaim) int64 {
+	if size, err := strconv.ParseInt(pvc.Annotations[cacheSizeAnnotation], 10, 64); err == nil {
+		return size
+	}
+	requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	return requested.Value()
+}
+
+// evictCachedDumps removes least recently used cached dumps until incoming bytes fit into maximum cache size.
+// Claims mounted by instances are never removed, abandoned populations are removed first
+func (c *Cluster) evictCachedDumps(ctx context.Context, logger *logrus.Entry, incoming int64) {
+	cacheCfg := c.Config().DumpCache
+	if !cacheCfg.Enabled {
+		return
+	}
+	maxSize, err := resource.ParseQuantity(cacheCfg.MaxSize)
+	if err != nil {
+		logger.WithError(err).Warn("invalid dump cache maximum size")
+		return
+	}
+
+	pvcs := c.K8sClient.CoreV1().PersistentVolumeClaims(c.Namespace)
+	pvcList, err := pvcs.List(ctx, metav1.ListOptions{LabelSelector: cacheLabel})
+	if err != nil {
+		logger.WithError(err).Warn("failed to list dump caches")
+		return
+	}
+	podList, err := c.K8sClient.CoreV1().Pods(c.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		logger.WithError(err).Warn("failed to list pods using dump caches")
+		return
+	}
+	mounted := make(map[string]bool)
+	for _, pod := range podList.Items {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil {
+				mounted[volume.PersistentVolumeClaim.ClaimName] = true
+			}
+		}
+	}
+
+	var total int64
+	candidates := []corev1.PersistentVolumeClaim{}
+	for _, pvc := range pvcList.Items {
+		if pvc.DeletionTimestamp != nil {
+			continue
+		}
+		total += cachedDumpSize(&pvc)
+		if mounted[pvc.Name] {
+			continue
+		}
+		if pvc.Annotations[cacheStateAnnotation] == cacheStatePopulating && c.instanceExists(pvc.Annotations[cachePopulatorAnnotation]) {
+			continue
+		}
+		candidates = append(candidates, pvc)
+	}
+	if total+incoming <= maxSize.Value() {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		iAbandoned := candidates[i].Annotations[cacheStateAnnotation] != cacheStateReady
+		jAbandoned := candidates[j].Annotations[cacheStateAnnotation] != cacheStateReady
+		if iAbandoned != jAbandoned {
+			return iAbandoned
+		}
+		return candidates[i].Annotations[cacheLastUsedAnnotation] < candidates[j].Annotations[cacheLastUsedAnnotation]
+	})
+	for _, pvc := range candidates {
+		if total+incoming <= maxSize.Value() {
+			break
+		}
+		pvcLogger := logger.WithFields(logrus.Fields{
+			"claim": pvc.Name,
+			"dump":  pvc.Annotations[cacheURLAnnotation],
+		})
+		if err := pvcs.Delete(ctx, pvc.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			pvcLogger.WithError(err).Warn("failed to evict cached dump")
+			continue
+		}
+		total -= cachedDumpSize(&pvc)
+		pvcLogger.Info("evicted cached dump")
+	}
+	if total+incoming > maxSize.Value() {
+		logger.WithFields(logrus.Fields{
+			"total":    total,
+			"incoming": incoming,
+		}).Warn("dump cache exceeds maximum size, all remaining dumps are in use")
+	}
+}
@@ -0,0 +1,134 @@
+package kaas
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCacheClaimSizedByTier(t *testing.T) {
+	cfg := testConfig()
+	cfg.DumpCache.Enabled = true
+	env := newTestEnv(t, cfg, true)
+	tiers := cfg.Sizing.Tiers
+
+	for dumpURL, tier := range map[string]*SizeTier{
+		"https://example.com/small/must-gather.tar": &tiers[0],
+		"https://example.com/large/must-gather.tar": &tiers[len(tiers)-1],
+		"https://example.com/other/must-gather.tar": nil,
+	} {
+		expected := cfg.DumpCache.VolumeSize
+		if tier != nil {
+			expected = tier.EphemeralStorage
+		}
+		if volume := env.cluster.dumpVolume(context.TODO(), testLogger(), "app", dumpURL, tier); !volume.populate {
+			t.Fatalf("expected cache claim of %s to be populated", dumpURL)
+		}
+		pvc, err := env.kube.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), cacheClaimName(dumpURL), metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get cache claim of %s: %v", dumpURL, err)
+		}
+		if size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; size.String() != expected {
+			t.Errorf("expected cache claim of %s to request %s, got %s", dumpURL, expected, size.String())
+		}
+	}
+}
+
+// cacheClaim returns a dump cache claim in the given state
+func cacheClaim(dumpURL, state, populator, size string, lastUsed time.Time) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cacheClaimName(dumpURL),
+			Namespace: testNamespace,
+			Labels:    map[string]string{cacheLabel: "true"},
+			Annotations: map[string]string{
+				cacheURLAnnotation:       dumpURL,
+				cacheStateAnnotation:     state,
+				cachePopulatorAnnotation: populator,
+				cacheSizeAnnotation:      size,
+				cacheLastUsedAnnotation:  lastUsed.UTC().Format(time.RFC3339),
+			},
+		},
+	}
+}
+
+func TestDumpVolumeReusesCache(t *testing.T) {
+	cfg := testConfig()
+	cfg.DumpCache.Enabled = true
+	lastUsed := time.Now().Add(-time.Hour)
+	objects := append(testInstance("populator", time.Now(), time.Now()),
+		cacheClaim("https://example.com/ready.tar", cacheStateReady, "", "", lastUsed),
+		cacheClaim("https://example.com/busy.tar", cacheStatePopulating, "populator", "", lastUsed),
+		cacheClaim("https://example.com/abandoned.tar", cacheStatePopulating, "removed", "", lastUsed),
+	)
+	env := newTestEnv(t, cfg, true, objects...)
+	pvcs := env.kube.CoreV1().PersistentVolumeClaims(testNamespace)
+
+	ready := env.cluster.dumpVolume(context.TODO(), testLogger(), "app", "https://example.com/ready.tar", nil)
+	if ready.populate || ready.source.PersistentVolumeClaim == nil || !ready.source.PersistentVolumeClaim.ReadOnly {
+		t.Errorf("expected cached dump to be mounted read-only, got %+v", ready)
+	}
+	pvc, err := pvcs.Get(context.TODO(), cacheClaimName("https://example.com/ready.tar"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get cache claim: %v", err)
+	}
+	if pvc.Annotations[cacheLastUsedAnnotation] <= lastUsed.UTC().Format(time.RFC3339) {
+		t.Errorf("expected usage time of cached dump to be updated, got %s", pvc.Annotations[cacheLastUsedAnnotation])
+	}
+
+	if busy := env.cluster.dumpVolume(context.TODO(), testLogger(), "app", "https://example.com/busy.tar", nil); busy.cached {
+		t.Errorf("expected dump being cached by another instance to use emptyDir, got %+v", busy)
+	}
+
+	abandoned := env.cluster.dumpVolume(context.TODO(), testLogger(), "app", "https://example.com/abandoned.tar", nil)
+	if !abandoned.populate || !abandoned.cached {
+		t.Errorf("expected abandoned population to be taken over, got %+v", abandoned)
+	}
+	pvc, err = pvcs.Get(context.TODO(), cacheClaimName("https://example.com/abandoned.tar"), metav1.GetOptions{})
+	if err != nil || pvc.Annotations[cachePopulatorAnnotation] != "app" {
+		t.Errorf("expected the instance to populate the abandoned cache, got %v: %v", pvc, err)
+	}
+}
+
+func TestEvictCachedDumps(t *testing.T) {
+	cfg := testConfig()
+	cfg.DumpCache.Enabled = true
+	cfg.DumpCache.MaxSize = "10Gi"
+	now := time.Now()
+	gib := func(n int64) string { return strconv.FormatInt(n<<30, 10) }
+	mounting := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "mounting-kas-1", Namespace: testNamespace},
+		Spec: corev1.PodSpec{Volumes: []corev1.Volume{{
+			Name: "dump",
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: cacheClaimName("https://example.com/mounted.tar"),
+			}},
+		}}},
+	}
+	env := newTestEnv(t, cfg, true, mounting,
+		cacheClaim("https://example.com/mounted.tar", cacheStateReady, "", gib(4), now.Add(-3*time.Hour)),
+		cacheClaim("https://example.com/old.tar", cacheStateReady, "", gib(4), now.Add(-2*time.Hour)),
+		cacheClaim("https://example.com/recent.tar", cacheStateReady, "", gib(4), now.Add(-time.Hour)),
+		cacheClaim("https://example.com/abandoned.tar", cacheStatePopulating, "removed", gib(1), now),
+	)
+
+	env.cluster.evictCachedDumps(context.TODO(), testLogger(), 2<<30)
+	pvcList, err := env.kube.CoreV1().PersistentVolumeClaims(testNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list cache claims: %v", err)
+	}
+	kept := []string{}
+	for _, pvc := range pvcList.Items {
+		kept = append(kept, pvc.Annotations[cacheURLAnnotation])
+	}
+	sort.Strings(kept)
+	if strings.Join(kept, ",") != "https://example.com/mounted.tar,https://example.com/recent.tar" {
+		t.Errorf("expected abandoned and least recently used dumps to be evicted, kept %v", kept)
+	}
+}
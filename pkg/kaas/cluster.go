@@ -0,0 +1,163 @@
+package kaas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	routeClient "github.com/openshift/client-go/route/clientset/versioned/typed/route/v1"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+const (
+	logFieldCluster = "cluster"
+	// defaultClusterName names the cluster set by kubeconfig when no clusters are configured
+	defaultClusterName = "default"
+)
+
+// ErrNoCapacity is returned when no target cluster has room for a new instance
+var ErrNoCapacity = errors.New("all target clusters are out of quota, please retry later")
+
+// Cluster is a target cluster namespace hosting instances
+type Cluster struct {
+	Name   string
+	Region string
+	// Kubeconfig is the path to cluster kubeconfig, in-cluster config is used if empty
+	Kubeconfig  string
+	K8sClient   k8s.Interface
+	RouteClient routeClient.RouteV1Interface
+	Namespace   string
+	RQuotaName  string
+	RQStatus    *QuotaState
+	// RouteDomain sets hosts of instance routes to "<route name>.<RouteDomain>", router default is used if empty
+	RouteDomain string
+	// RouteLabels are added to instance routes, e.g. to select a router shard
+	RouteLabels map[string]string
+
+	server  *ServerSettings
+	runtime Runtime
+	tracker *InstanceTracker
+
+	clientsReady   atomic.Bool
+	quotaWatchLive atomic.Bool
+}
+
+// AddCluster registers a target cluster. The first cluster added is the home cluster, which holds the leader Lease
+func (s *ServerSettings) AddCluster(cfg ClusterConfig) *Cluster {
+	cluster := &Cluster{
+		Name:        cfg.Name,
+		Region:      cfg.Region,
+		Kubeconfig:  cfg.Kubeconfig,
+		Namespace:   cfg.Namespace,
+		RQuotaName:  cfg.QuotaName,
+		RQStatus:    &QuotaState{},
+		RouteDomain: cfg.RouteDomain,
+		RouteLabels: cfg.RouteLabels,
+		server:      s,
+	}
+	cluster.runtime = kubeRuntime{cluster}
+	s.Clusters = append(s.Clusters, cluster)
+	return cluster
+}
+
+// Config returns a snapshot of current server config
+func (c *Cluster) Config() Config {
+	return c.server.Config()
+}
+
+// logger returns server log entry with the cluster name
+func (c *Cluster) logger() *logrus.Entry {
+	return c.server.logger().WithField(logFieldCluster, c.Name)
+}
+
+// ready reports whether the cluster is connected and its quota is watched
+func (c *Cluster) ready() bool {
+	return c.clientsReady.Load() && c.quotaWatchLive.Load()
+}
+
+// freePods returns the number of pods which could still be created within the quota
+func (c *Cluster) freePods() int64 {
+	status := c.RQStatus.Get()
+	return status.Hard - status.Used
+}
+
+// homeCluster returns the cluster holding the leader Lease
+func (s *ServerSettings) homeCluster() *Cluster {
+	if len(s.Clusters) == 0 {
+		return nil
+	}
+	return s.Clusters[0]
+}
+
+// connectedClusters returns clusters with established clients
+func (s *ServerSettings) connectedClusters() []*Cluster {
+	clusters := make([]*Cluster, 0, len(s.Clusters))
+	for _, cluster := range s.Clusters {
+		if cluster.clientsReady.Load() {
+			clusters = append(clusters, cluster)
+		}
+	}
+	return clusters
+}
+
+// Regions returns regions of target clusters, empty if none of them sets one
+func (s *ServerSettings) Regions() []string {
+	seen := make(map[string]bool)
+	regions := []string{}
+	for _, cluster := range s.Clusters {
+		if cluster.Region == "" || seen[cluster.Region] {
+			continue
+		}
+		seen[cluster.Region] = true
+		regions = append(regions, cluster.Region)
+	}
+	return regions
+}
+
+// placeInstance picks the ready cluster with the most free pods in its quota.
+// Only clusters in region are considered if it's set
+func (s *ServerSettings) placeInstance(region string) (*Cluster, error) {
+	var placed *Cluster
+	candidates := 0
+	for _, cluster := range s.Clusters {
+		if region != "" && cluster.Region != region {
+			continue
+		}
+		if !cluster.ready() {
+			continue
+		}
+		candidates++
+		if cluster.freePods() <= 0 {
+			continue
+		}
+		if placed == nil || cluster.freePods() > placed.freePods() {
+			placed = cluster
+		}
+	}
+	switch {
+	case placed != nil:
+		return placed, nil
+	case candidates > 0:
+		return nil, ErrNoCapacity
+	case region != "":
+		return nil, fmt.Errorf("no target cluster in region %q is available", region)
+	}
+	return nil, ErrNotReady
+}
+
+// findInstanceCluster returns the connected cluster the instance lives in, nil if it's not found
+func (s *ServerSettings) findInstanceCluster(ctx context.Context, appLabel string) (*Cluster, error) {
+	for _, cluster := range s.connectedClusters() {
+		_, err := cluster.runtime.getRecord(ctx, appLabel)
+		if err == nil || cluster.runtime.exists(appLabel) {
+			return cluster, nil
+		}
+		if !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to look up instance in cluster %s: %v", cluster.Name, err)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,110 @@
+package kaas
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testClusters returns a server with ready clusters having the given free pods, indexed by name
+func testClusters(free map[string]int64, regions map[string]string) *ServerSettings {
+	server := &ServerSettings{Log: testLogger()}
+	for name, pods := range free {
+		cluster := server.AddCluster(ClusterConfig{Name: name, Region: regions[name]})
+		cluster.RQStatus.Set(RQuotaStatus{Used: 10 - pods, Hard: 10})
+		cluster.MarkClientsReady()
+		cluster.quotaWatchLive.Store(true)
+	}
+	return server
+}
+
+func TestPlaceInstance(t *testing.T) {
+	regions := map[string]string{"a": "us", "b": "us", "c": "eu"}
+
+	server := testClusters(map[string]int64{"a": 2, "b": 5, "c": 8}, regions)
+	for region, expected := range map[string]string{"": "c", "us": "b", "eu": "c"} {
+		cluster, err := server.placeInstance(region)
+		if err != nil {
+			t.Fatalf("failed to place instance in %q: %v", region, err)
+		}
+		if cluster.Name != expected {
+			t.Errorf("expected instance in %q to be placed in %s, got %s", region, expected, cluster.Name)
+		}
+	}
+	if _, err := server.placeInstance("ap"); err == nil || errors.Is(err, ErrNoCapacity) {
+		t.Errorf("expected unknown region to be refused, got %v", err)
+	}
+
+	full := testClusters(map[string]int64{"a": 0, "b": 0}, regions)
+	if _, err := full.placeInstance(""); !errors.Is(err, ErrNoCapacity) {
+		t.Errorf("expected ErrNoCapacity, got %v", err)
+	}
+
+	disconnected := &ServerSettings{Log: testLogger()}
+	disconnected.AddCluster(ClusterConfig{Name: "a"})
+	if _, err := disconnected.placeInstance(""); !errors.Is(err, ErrNotReady) {
+		t.Errorf("expected ErrNotReady, got %v", err)
+	}
+}
+
+func TestQuotaStatusIsSummed(t *testing.T) {
+	server := testClusters(map[string]int64{"a": 2, "b": 5}, nil)
+	if status := server.quotaStatus(); status.Hard != 20 || status.Used != 13 {
+		t.Errorf("unexpected total quota %+v", status)
+	}
+}
+
+func TestRegions(t *testing.T) {
+	server := &ServerSettings{}
+	for _, cfg := range []ClusterConfig{{Name: "a", Region: "us"}, {Name: "b"}, {Name: "c", Region: "eu"}, {Name: "d", Region: "us"}} {
+		server.AddCluster(cfg)
+	}
+	if regions := server.Regions(); len(regions) != 2 || regions[0] != "us" || regions[1] != "eu" {
+		t.Errorf("unexpected regions %v", regions)
+	}
+}
+
+func TestFindInstanceCluster(t *testing.T) {
+	server := testClusters(map[string]int64{"a": 5, "b": 5}, nil)
+	clients := map[string]*fake.Clientset{
+		"a": fake.NewSimpleClientset(),
+		"b": fake.NewSimpleClientset(testInstance("app", time.Now(), time.Now())...),
+	}
+	for _, cluster := range server.Clusters {
+		cluster.Namespace = testNamespace
+		cluster.K8sClient = clients[cluster.Name]
+	}
+
+	cluster, err := server.findInstanceCluster(context.TODO(), "app")
+	if err != nil || cluster == nil || cluster.Name != "b" {
+		t.Errorf("expected instance to be found in cluster b, got %v: %v", cluster, err)
+	}
+	if cluster, err := server.findInstanceCluster(context.TODO(), "missing"); err != nil || cluster != nil {
+		t.Errorf("expected missing instance not to be found, got %v: %v", cluster, err)
+	}
+
+	clients["a"].PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "missing-record", nil)
+	})
+	if _, err := server.findInstanceCluster(context.TODO(), "missing"); err == nil || !strings.Contains(err.Error(), "cluster a") {
+		t.Errorf("expected failed lookup to be reported, got %v", err)
+	}
+}
+
+func TestNewKASRefusesUnknownRegion(t *testing.T) {
+	env := newTestEnv(t, testConfig(), true)
+	conn := env.dial(t)
+
+	failure := lastMessage(createInstance(t, conn, newArtifactServer(t, jobArtifacts(testDumpPath)).URL+testJobRoot, map[string]string{"region": "ap"}))
+	if failure.Action != "failure" || !strings.Contains(failure.Message, `no target cluster in region "ap"`) {
+		t.Errorf("expected unknown region to be refused, got %v", failure)
+	}
+}
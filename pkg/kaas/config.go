@@ -0,0 +1,598 @@
+package kaas
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// ContainerResources stores resource requests and limits for a container
+type ContainerResources struct {
+	CPU    string `json:"cpu"`
+	Memory string `json:"memory"`
+	// MemoryLimit is not set if empty
+	MemoryLimit string `json:"memoryLimit"`
+}
+
+// requirements returns container resource requirements
+func (r ContainerResources) requirements() corev1.ResourceRequirements {
+	requirements := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			"cpu":    resource.MustParse(r.CPU),
+			"memory": resource.MustParse(r.Memory),
+		},
+	}
+	if r.MemoryLimit != "" {
+		requirements.Limits = corev1.ResourceList{
+			"memory": resource.MustParse(r.MemoryLimit),
+		}
+	}
+	return requirements
+}
+
+// Images stores images used to run KAS instances
+type Images struct {
+	KAS        string `json:"kas"`
+	CIFetcher  string `json:"ciFetcher"`
+	Console    string `json:"console"`
+	Prometheus string `json:"prometheus"`
+	Grafana    string `json:"grafana"`
+}
+
+// InstanceResources stores resource requests of instance containers
+type InstanceResources struct {
+	KAS        ContainerResources `json:"kas"`
+	Console    ContainerResources `json:"console"`
+	Prometheus ContainerResources `json:"prometheus"`
+	Grafana    ContainerResources `json:"grafana"`
+}
+
+// RetryPolicy configures how many times failed creations are attempted
+type RetryPolicy struct {
+	// Attempts is the total number of attempts, 1 disables retries
+	Attempts int             `json:"attempts"`
+	Backoff  metav1.Duration `json:"backoff"`
+}
+
+// DumpCache configures caching of extracted dumps on persistent volumes
+type DumpCache struct {
+	Enabled      bool                              `json:"enabled"`
+	StorageClass string                            `json:"storageClass"`
+	AccessMode   corev1.PersistentVolumeAccessMode `json:"accessMode"`
+	// VolumeSize is the size requested for cached dumps of unknown size, others request
+	// ephemeral storage of their sizing tier
+	VolumeSize string `json:"volumeSize"`
+	// MaxSize is the total size of cached dumps, least recently used dumps are evicted above it
+	MaxSize string `json:"maxSize"`
+}
+
+// SizeTier sets resources of static-kas serving dumps up to DumpSize
+type SizeTier struct {
+	// DumpSize is the largest dump archive served with this tier
+	DumpSize    string `json:"dumpSize"`
+	Memory      string `json:"memory"`
+	MemoryLimit string `json:"memoryLimit"`
+	// EphemeralStorage is requested for the extracted dump and limits the size of its emptyDir,
+	// cached dumps request volumes of this size
+	EphemeralStorage string `json:"ephemeralStorage"`
+}
+
+// DumpSizing configures instance resources based on dump archive size
+type DumpSizing struct {
+	// Tiers are ordered by DumpSize, dumps larger than the last tier use it
+	Tiers []SizeTier `json:"tiers"`
+	// MaxDumpSize is the largest dump archive accepted, any size is accepted if empty
+	MaxDumpSize string `json:"maxDumpSize"`
+}
+
+// ClusterConfig describes a target cluster namespace hosting instances
+type ClusterConfig struct {
+	Name string `json:"name"`
+	// Region lets users pick clusters, clusters in the same region are chosen by capacity
+	Region string `json:"region"`
+	// Kubeconfig is the path to cluster kubeconfig, in-cluster config is used if empty
+	Kubeconfig string `json:"kubeconfig"`
+	Namespace  string `json:"namespace"`
+	QuotaName  string `json:"quotaName"`
+	// RouteDomain sets hosts of instance routes to "<route name>.<routeDomain>", router default is used if empty
+	RouteDomain string `json:"routeDomain"`
+	// RouteLabels are added to instance routes, e.g. to select a router shard
+	RouteLabels map[string]string `json:"routeLabels"`
+}
+
+// LocalRuntimeConfig configures the local runtime, running static-kas processes instead of Deployments
+type LocalRuntimeConfig struct {
+	// Binary is the path to static-kas binary, looked up in PATH if it has no slashes
+	Binary string `json:"binary"`
+	// WorkDir stores extracted dumps, system temp dir is used if empty
+	WorkDir string `json:"workDir"`
+	// Host is the address of this machine used in instance URLs
+	Host string `json:"host"`
+	// MaxInstances limits the number of instances running at once
+	MaxInstances int `json:"maxInstances"`
+}
+
+// Config stores server configuration.
+// Fields marked as structural are read once on startup, the rest can be changed by editing the config file.
+type Config struct {
+	// Structural settings
+	ListenAddress   string          `json:"listenAddress"`
+	Kubeconfig      string          `json:"kubeconfig"`
+	Namespace       string          `json:"namespace"`
+	QuotaName       string          `json:"quotaName"`
+	StaticDir       string          `json:"staticDir"`
+	CleanupInterval metav1.Duration `json:"cleanupInterval"`
+	ShutdownTimeout metav1.Duration `json:"shutdownTimeout"`
+	// InstanceTemplate is the path to Go-templated YAML patching instance deployments
+	InstanceTemplate string `json:"instanceTemplate"`
+	// LeaseName is the Lease used to elect the replica running background jobs
+	LeaseName string `json:"leaseName"`
+	// Clusters are target clusters hosting instances. If empty, instances are created in
+	// namespace of the cluster set by kubeconfig. The first cluster holds the leader Lease
+	Clusters []ClusterConfig `json:"clusters"`
+	// Runtime runs instances, "kubernetes" creates Deployments in target clusters and "local" runs static-kas processes
+	Runtime string             `json:"runtime"`
+	Local   LocalRuntimeConfig `json:"local"`
+
+	// Reloadable settings
+	LogLevel       string          `json:"logLevel"`
+	Lifetime       metav1.Duration `json:"lifetime"`
+	RolloutTimeout metav1.Duration `json:"rolloutTimeout"`
+	Images         Images          `json:"images"`
+	// MaxLifetime bounds lifetime of instances which are still in use
+	MaxLifetime metav1.Duration `json:"maxLifetime"`
+	// ConsoleImages maps cluster "major.minor" versions to console images, images.console is used for other versions
+	ConsoleImages map[string]string `json:"consoleImages"`
+	Resources     InstanceResources `json:"resources"`
+	Retry         RetryPolicy       `json:"retry"`
+	// Console enables console in new instances unless requested otherwise
+	Console bool `json:"console"`
+	// Prometheus enables launching Prometheus from the metrics snapshot of the job
+	Prometheus bool `json:"prometheus"`
+	// Grafana enables Grafana with OpenShift dashboards, it's launched along with Prometheus only
+	Grafana bool `json:"grafana"`
+	// MaxDumps limits the number of dumps served by one instance
+	MaxDumps  int        `json:"maxDumps"`
+	DumpCache DumpCache  `json:"dumpCache"`
+	Sizing    DumpSizing `json:"sizing"`
+	// AllowedURLs lists URL prefixes, hosts and "*.domain" wildcards kaas fetches dumps from, empty allows any public host
+	AllowedURLs []string `json:"allowedURLs"`
+}
+
+// DefaultConfig returns configuration used when no overrides are set
+func DefaultConfig() Config {
+	return Config{
+		ListenAddress:   ":8080",
+		Namespace:       "kaas",
+		QuotaName:       "pod-quota",
+		StaticDir:       "./html",
+		CleanupInterval: metav1.Duration{Duration: 2 * time.Minute},
+		ShutdownTimeout: metav1.Duration{Duration: 25 * time.Second},
+		LeaseName:       "kaas-leader",
+		Runtime:         RuntimeKubernetes,
+		Local: LocalRuntimeConfig{
+			Binary:       "static-kas",
+			Host:         "127.0.0.1",
+			MaxInstances: 4,
+		},
+		LogLevel:       "info",
+		Lifetime:       metav1.Duration{Duration: 8 * time.Hour},
+		MaxLifetime:    metav1.Duration{Duration: 24 * time.Hour},
+		RolloutTimeout: metav1.Duration{Duration: 5 * time.Minute},
+		Images: Images{
+			KAS:        "kaas:static-kas",
+			CIFetcher:  "registry.access.redhat.com/ubi8/ubi:8.5",
+			Console:    "quay.io/openshift/origin-console:latest",
+			Prometheus: "quay.io/prometheus/prometheus:latest",
+			Grafana:    "docker.io/grafana/grafana:latest",
+		},
+		Resources: InstanceResources{
+			KAS:        ContainerResources{CPU: "100m", Memory: "500Mi", MemoryLimit: "1Gi"},
+			Console:    ContainerResources{CPU: "100m", Memory: "500Mi", MemoryLimit: "1Gi"},
+			Prometheus: ContainerResources{CPU: "100m", Memory: "1Gi", MemoryLimit: "4Gi"},
+			Grafana:    ContainerResources{CPU: "50m", Memory: "200Mi", MemoryLimit: "500Mi"},
+		},
+		Retry: RetryPolicy{
+			Attempts: 1,
+			Backoff:  metav1.Duration{Duration: 10 * time.Second},
+		},
+		Console:  true,
+		MaxDumps: 4,
+		DumpCache: DumpCache{
+			AccessMode: corev1.ReadWriteMany,
+			VolumeSize: "10Gi",
+			MaxSize:    "100Gi",
+		},
+		Sizing: DumpSizing{
+			Tiers: []SizeTier{
+				{DumpSize: "100Mi", Memory: "500Mi", MemoryLimit: "1Gi", EphemeralStorage: "2Gi"},
+				{DumpSize: "500Mi", Memory: "1Gi", MemoryLimit: "2Gi", EphemeralStorage: "8Gi"},
+				{DumpSize: "2Gi", Memory: "3Gi", MemoryLimit: "4Gi", EphemeralStorage: "24Gi"},
+			},
+		},
+		AllowedURLs: []string{
+			"prow.ci.openshift.org",
+			"gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com",
+			"storage.googleapis.com",
+		},
+	}
+}
+
+// LoadConfig reads the config file on top of defaults. Empty path returns defaults
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %v", err)
+	}
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// ApplyEnv overrides config with settings from environment variables
+func (c *Config) ApplyEnv() {
+	envVars := map[string]*string{
+		"KUBECONFIG": &c.Kubeconfig,
+		"NAMESPACE":  &c.Namespace,
+		"QUOTA_NAME": &c.QuotaName,
+		"LOG_LEVEL":  &c.LogLevel,
+	}
+	for name, field := range envVars {
+		if value := os.Getenv(name); len(value) != 0 {
+			*field = value
+		}
+	}
+}
+
+// ConfigSource records where settings come from, so that reloads of the config file keep env and flag overrides
+type ConfigSource struct {
+	// Path is the config file, empty if not set
+	Path string
+
+	name string
+	// flags are command line flags which were set explicitly
+	flags map[string]string
+}
+
+// Load builds config from defaults, config file, env vars and explicitly set flags, in increasing order of precedence
+func (src ConfigSource) Load() (Config, error) {
+	cfg, err := LoadConfig(src.Path)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ApplyEnv()
+
+	// Re-apply flags which were explicitly set on top of file and env settings
+	overrides := flag.NewFlagSet(src.name, flag.ContinueOnError)
+	cfg.bindFlags(overrides)
+	for name, value := range src.flags {
+		if err := overrides.Set(name, value); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// ParseConfig builds server config from defaults, config file, env vars and command line flags,
+// in increasing order of precedence. It returns validated config and its source, used to reload it
+func ParseConfig(name string, args []string) (Config, ConfigSource, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("CONFIG_FILE"), "Path to YAML config file")
+	flagCfg := DefaultConfig()
+	flagCfg.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return flagCfg, ConfigSource{}, err
+	}
+
+	src := ConfigSource{
+		Path:  *configPath,
+		name:  name,
+		flags: make(map[string]string),
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			src.flags[f.Name] = f.Value.String()
+		}
+	})
+	cfg, err := src.Load()
+	if err != nil {
+		return cfg, src, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, src, fmt.Errorf("invalid config: %v", err)
+	}
+	return cfg, src, nil
+}
+
+// bindFlags registers flags overriding config settings
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddress, "listen", c.ListenAddress, "Address to listen on")
+	fs.StringVar(&c.Kubeconfig, "kubeconfig", c.Kubeconfig, "Path to kubeconfig, in-cluster config is used if empty")
+	fs.StringVar(&c.Namespace, "namespace", c.Namespace, "Namespace to create instances in")
+	fs.StringVar(&c.QuotaName, "quota-name", c.QuotaName, "Name of ResourceQuota to report")
+	fs.StringVar(&c.StaticDir, "static-dir", c.StaticDir, "Directory with static HTML files")
+	fs.DurationVar(&c.CleanupInterval.Duration, "cleanup-interval", c.CleanupInterval.Duration, "Interval between old instance cleanups")
+	fs.DurationVar(&c.ShutdownTimeout.Duration, "shutdown-timeout", c.ShutdownTimeout.Duration, "Time to wait for in-flight creations on shutdown")
+	fs.StringVar(&c.InstanceTemplate, "instance-template", c.InstanceTemplate, "Path to template patching instance deployments")
+	fs.StringVar(&c.LeaseName, "lease-name", c.LeaseName, "Name of Lease used for leader election")
+	fs.StringVar(&c.Runtime, "runtime", c.Runtime, "Runtime running instances: kubernetes or local")
+	fs.StringVar(&c.Local.Binary, "static-kas-binary", c.Local.Binary, "Path to static-kas binary used by local runtime")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Log level")
+	fs.DurationVar(&c.Lifetime.Duration, "lifetime", c.Lifetime.Duration, "Time after which released instances are removed")
+	fs.DurationVar(&c.MaxLifetime.Duration, "max-lifetime", c.MaxLifetime.Duration, "Time after which instances are removed even if they are in use")
+	fs.DurationVar(&c.RolloutTimeout.Duration, "rollout-timeout", c.RolloutTimeout.Duration, "Time to wait for instance to become ready")
+	fs.IntVar(&c.Retry.Attempts, "retry-attempts", c.Retry.Attempts, "Number of attempts to create an instance on transient errors")
+	fs.BoolVar(&c.Console, "console", c.Console, "Run console in new instances by default")
+	fs.BoolVar(&c.Prometheus, "prometheus", c.Prometheus, "Launch Prometheus from job metrics snapshot")
+	fs.BoolVar(&c.Grafana, "grafana", c.Grafana, "Launch Grafana with OpenShift dashboards along with Prometheus")
+	fs.IntVar(&c.MaxDumps, "max-dumps", c.MaxDumps, "Maximum number of dumps served by one instance")
+	fs.BoolVar(&c.DumpCache.Enabled, "dump-cache", c.DumpCache.Enabled, "Cache extracted dumps on persistent volumes")
+	fs.StringVar(&c.Sizing.MaxDumpSize, "max-dump-size", c.Sizing.MaxDumpSize, "Largest dump archive accepted, empty allows any size")
+	fs.StringVar(&c.Images.KAS, "kas-image", c.Images.KAS, "static-kas image")
+	fs.StringVar(&c.Images.CIFetcher, "ci-fetcher-image", c.Images.CIFetcher, "Image used to download dumps")
+	fs.StringVar(&c.Images.Console, "console-image", c.Images.Console, "OpenShift console image")
+}
+
+// Validate checks that config settings are usable
+func (c *Config) Validate() error {
+	if c.ListenAddress == "" {
+		return fmt.Errorf("listenAddress must be set")
+	}
+	if c.Namespace == "" {
+		return fmt.Errorf("namespace must be set")
+	}
+	if c.QuotaName == "" {
+		return fmt.Errorf("quotaName must be set")
+	}
+	if c.LeaseName == "" {
+		return fmt.Errorf("leaseName must be set")
+	}
+	switch c.Runtime {
+	case RuntimeKubernetes:
+	case RuntimeLocal:
+		if c.Local.Binary == "" {
+			return fmt.Errorf("local.binary must be set")
+		}
+		if c.Local.Host == "" {
+			return fmt.Errorf("local.host must be set")
+		}
+		if c.Local.MaxInstances < 1 {
+			return fmt.Errorf("local.maxInstances must be at least 1")
+		}
+	default:
+		return fmt.Errorf("unknown runtime %q, must be %s or %s", c.Runtime, RuntimeKubernetes, RuntimeLocal)
+	}
+	names := make(map[string]bool, len(c.Clusters))
+	for i, cluster := range c.Clusters {
+		if cluster.Name == "" {
+			return fmt.Errorf("clusters[%d].name must be set", i)
+		}
+		if names[cluster.Name] {
+			return fmt.Errorf("cluster name %q is used more than once", cluster.Name)
+		}
+		names[cluster.Name] = true
+		if cluster.Namespace == "" {
+			return fmt.Errorf("clusters[%d].namespace must be set", i)
+		}
+		if cluster.QuotaName == "" {
+			return fmt.Errorf("clusters[%d].quotaName must be set", i)
+		}
+	}
+	if c.CleanupInterval.Duration < time.Minute {
+		return fmt.Errorf("cleanupInterval must be at least 1m, got %s", c.CleanupInterval.Duration)
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		return fmt.Errorf("shutdownTimeout must be positive")
+	}
+	if c.Lifetime.Duration <= 0 {
+		return fmt.Errorf("lifetime must be positive")
+	}
+	if c.MaxLifetime.Duration < c.Lifetime.Duration {
+		return fmt.Errorf("maxLifetime must not be shorter than lifetime")
+	}
+	if c.RolloutTimeout.Duration <= 0 {
+		return fmt.Errorf("rolloutTimeout must be positive")
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("invalid logLevel: %v", err)
+	}
+	if c.Images.KAS == "" || c.Images.CIFetcher == "" || c.Images.Console == "" {
+		return fmt.Errorf("images.kas, images.ciFetcher and images.console must be set")
+	}
+	for version, image := range c.ConsoleImages {
+		if versionMinor(version) != version {
+			return fmt.Errorf("consoleImages key %q must be in major.minor format", version)
+		}
+		if image == "" {
+			return fmt.Errorf("consoleImages image for %s must be set", version)
+		}
+	}
+	if c.Retry.Attempts < 1 {
+		return fmt.Errorf("retry.attempts must be at least 1")
+	}
+	if c.Retry.Backoff.Duration < 0 {
+		return fmt.Errorf("retry.backoff must not be negative")
+	}
+	if c.MaxDumps < 1 {
+		return fmt.Errorf("maxDumps must be at least 1")
+	}
+	quantities := map[string]string{
+		"resources.kas.cpu":        c.Resources.KAS.CPU,
+		"resources.kas.memory":     c.Resources.KAS.Memory,
+		"resources.console.cpu":    c.Resources.Console.CPU,
+		"resources.console.memory": c.Resources.Console.Memory,
+	}
+	if c.Resources.KAS.MemoryLimit != "" {
+		quantities["resources.kas.memoryLimit"] = c.Resources.KAS.MemoryLimit
+	}
+	if c.Resources.Console.MemoryLimit != "" {
+		quantities["resources.console.memoryLimit"] = c.Resources.Console.MemoryLimit
+	}
+	if c.Prometheus {
+		if c.Images.Prometheus == "" {
+			return fmt.Errorf("images.prometheus must be set when prometheus is enabled")
+		}
+		quantities["resources.prometheus.cpu"] = c.Resources.Prometheus.CPU
+		quantities["resources.prometheus.memory"] = c.Resources.Prometheus.Memory
+		if c.Resources.Prometheus.MemoryLimit != "" {
+			quantities["resources.prometheus.memoryLimit"] = c.Resources.Prometheus.MemoryLimit
+		}
+	}
+	if c.Grafana {
+		if !c.Prometheus {
+			return fmt.Errorf("grafana requires prometheus to be enabled")
+		}
+		if c.Images.Grafana == "" {
+			return fmt.Errorf("images.grafana must be set when grafana is enabled")
+		}
+		quantities["resources.grafana.cpu"] = c.Resources.Grafana.CPU
+		quantities["resources.grafana.memory"] = c.Resources.Grafana.Memory
+		if c.Resources.Grafana.MemoryLimit != "" {
+			quantities["resources.grafana.memoryLimit"] = c.Resources.Grafana.MemoryLimit
+		}
+	}
+	if c.DumpCache.Enabled {
+		quantities["dumpCache.volumeSize"] = c.DumpCache.VolumeSize
+		quantities["dumpCache.maxSize"] = c.DumpCache.MaxSize
+		switch c.DumpCache.AccessMode {
+		case corev1.ReadWriteOnce, corev1.ReadWriteMany:
+		default:
+			return fmt.Errorf("dumpCache.accessMode must be ReadWriteOnce or ReadWriteMany, got %q", c.DumpCache.AccessMode)
+		}
+	}
+	for _, entry := range c.AllowedURLs {
+		if err := validateAllowedURL(entry); err != nil {
+			return err
+		}
+	}
+	if err := c.Sizing.validate(); err != nil {
+		return err
+	}
+	for name, value := range quantities {
+		if _, err := resource.ParseQuantity(value); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", name, value, err)
+		}
+	}
+	return nil
+}
+
+// TargetClusters returns configured target clusters, falling back to a single cluster
+// set by kubeconfig, namespace and quotaName
+func (c Config) TargetClusters() []ClusterConfig {
+	if len(c.Clusters) != 0 {
+		return c.Clusters
+	}
+	return []ClusterConfig{{
+		Name:       defaultClusterName,
+		Kubeconfig: c.Kubeconfig,
+		Namespace:  c.Namespace,
+		QuotaName:  c.QuotaName,
+	}}
+}
+
+// withReloadable returns a copy of c with reloadable settings taken from newCfg
+func (c Config) withReloadable(newCfg Config) Config {
+	c.LogLevel = newCfg.LogLevel
+	c.Lifetime = newCfg.Lifetime
+	c.MaxLifetime = newCfg.MaxLifetime
+	c.RolloutTimeout = newCfg.RolloutTimeout
+	c.Images = newCfg.Images
+	c.ConsoleImages = newCfg.ConsoleImages
+	c.Resources = newCfg.Resources
+	c.Retry = newCfg.Retry
+	c.Console = newCfg.Console
+	c.Prometheus = newCfg.Prometheus
+	c.Grafana = newCfg.Grafana
+	c.MaxDumps = newCfg.MaxDumps
+	c.DumpCache = newCfg.DumpCache
+	c.Sizing = newCfg.Sizing
+	c.AllowedURLs = newCfg.AllowedURLs
+	return c
+}
+
+// Config returns a snapshot of current server config
+func (s *ServerSettings) Config() Config {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	if s.config == nil {
+		return DefaultConfig()
+	}
+	return *s.config
+}
+
+// SetConfig replaces server config
+func (s *ServerSettings) SetConfig(cfg Config) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	s.config = &cfg
+	setAllowedURLs(cfg.AllowedURLs)
+}
+
+// WatchConfig polls the config file and applies changes to reloadable settings.
+// Env and flag overrides keep precedence over the file. Structural settings require a restart,
+// so changes to them are only reported.
+func (s *ServerSettings) WatchConfig(ctx context.Context, src ConfigSource, interval time.Duration) {
+	path := src.Path
+	logger := s.logger().WithField("config", path)
+	var lastData []byte
+	lastCfg, err := src.Load()
+	if err == nil {
+		lastData, _ = os.ReadFile(path)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logger.WithError(err).Warn("failed to read config file")
+			continue
+		}
+		if bytes.Equal(data, lastData) {
+			continue
+		}
+		lastData = data
+
+		newCfg, err := src.Load()
+		if err != nil {
+			logger.WithError(err).Error("failed to reload config")
+			continue
+		}
+		merged := s.Config().withReloadable(newCfg)
+		if err := merged.Validate(); err != nil {
+			logger.WithError(err).Error("reloaded config is invalid, keeping current settings")
+			continue
+		}
+		if !reflect.DeepEqual(newCfg.withReloadable(lastCfg), lastCfg) {
+			logger.Warn("structural settings changed, restart is required to apply them")
+		}
+		lastCfg = newCfg
+		if lvl, err := logrus.ParseLevel(merged.LogLevel); err == nil && s.Log != nil {
+			s.Log.Logger.SetLevel(lvl)
+		}
+		s.SetConfig(merged)
+		logger.Info("config reloaded")
+	}
+}
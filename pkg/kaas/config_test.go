@@ -0,0 +1,102 @@
+package kaas
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestWatchConfigKeepsOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("logLevel: debug\nlifetime: 1h\nrolloutTimeout: 1m\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LOG_LEVEL", "warn")
+	cfg, src, err := ParseConfig("kaas", []string{"--config", path, "--lifetime", "2h"})
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	if cfg.LogLevel != "warn" || cfg.Lifetime.Duration != 2*time.Hour || cfg.RolloutTimeout.Duration != time.Minute {
+		t.Fatalf("unexpected config %s %s %s", cfg.LogLevel, cfg.Lifetime.Duration, cfg.RolloutTimeout.Duration)
+	}
+
+	server := &ServerSettings{Log: testLogger()}
+	server.SetConfig(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.WatchConfig(ctx, src, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(path, []byte("logLevel: error\nlifetime: 3h\nrolloutTimeout: 2m\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, testReadTimeout, func() (bool, error) {
+		return server.Config().RolloutTimeout.Duration == 2*time.Minute, nil
+	})
+	if err != nil {
+		t.Fatalf("expected config to be reloaded")
+	}
+	reloaded := server.Config()
+	if reloaded.LogLevel != "warn" {
+		t.Errorf("expected LOG_LEVEL to override reloaded file, got %s", reloaded.LogLevel)
+	}
+	if reloaded.Lifetime.Duration != 2*time.Hour {
+		t.Errorf("expected --lifetime to override reloaded file, got %s", reloaded.Lifetime.Duration)
+	}
+}
+
+func TestParseConfigRefusesInvalidSettings(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		file    string
+		args    []string
+		message string
+	}{
+		{
+			name:    "unknown field",
+			file:    "lifetme: 1h\n",
+			message: "unknown field",
+		},
+		{
+			name:    "bad log level",
+			args:    []string{"--log-level", "verbose"},
+			message: "invalid logLevel",
+		},
+		{
+			name:    "short cleanup interval",
+			file:    "cleanupInterval: 10s\n",
+			message: "cleanupInterval must be at least 1m",
+		},
+		{
+			name:    "max lifetime shorter than lifetime",
+			file:    "lifetime: 8h\nmaxLifetime: 4h\n",
+			message: "maxLifetime must not be shorter than lifetime",
+		},
+		{
+			name:    "console images key",
+			file:    "consoleImages:\n  4.14.1: console:4.14\n",
+			message: "must be in major.minor format",
+		},
+		{
+			name:    "grafana without prometheus",
+			file:    "grafana: true\n",
+			message: "grafana requires prometheus",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tc.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, _, err := ParseConfig("kaas", append([]string{"--config", path}, tc.args...))
+			if err == nil || !strings.Contains(err.Error(), tc.message) {
+				t.Errorf("expected error containing %q, got %v", tc.message, err)
+			}
+		})
+	}
+}
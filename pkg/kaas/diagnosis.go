@@ -0,0 +1,320 @@
+package kaas
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	diagnosisLogLines = int64(100)
+	diagnosisLogBytes = int64(64 * 1024)
+)
+
+// FailureCategory is a suggested cause of instance failure
+type FailureCategory string
+
+const (
+	FailureImagePull     FailureCategory = "image-pull"
+	FailureDownload      FailureCategory = "dump-download"
+	FailureCrashLoop     FailureCategory = "crash-loop"
+	FailureUnschedulable FailureCategory = "unschedulable"
+	FailureQuota         FailureCategory = "quota-exceeded"
+	FailureTimeout       FailureCategory = "timeout"
+	FailureUnknown       FailureCategory = "unknown"
+)
+
+// Diagnosis describes why an instance failed to become ready
+type Diagnosis struct {
+	Instance string          `json:"instance"`
+	Category FailureCategory `json:"category"`
+	Summary  string          `json:"summary"`
+	Pods     []PodDiagnosis  `json:"pods"`
+	Events   []EventInfo     `json:"events"`
+	Quota    RQuotaStatus    `json:"quota"`
+	Errors   []string        `json:"errors,omitempty"`
+}
+
+// PodDiagnosis describes state of an instance pod
+type PodDiagnosis struct {
+	Name       string               `json:"name"`
+	Phase      corev1.PodPhase      `json:"phase"`
+	Reason     string               `json:"reason,omitempty"`
+	Conditions []ConditionInfo      `json:"conditions"`
+	Containers []ContainerDiagnosis `json:"containers"`
+}
+
+// ConditionInfo is a pod condition
+type ConditionInfo struct {
+	Type    corev1.PodConditionType `json:"type"`
+	Status  corev1.ConditionStatus  `json:"status"`
+	Reason  string                  `json:"reason,omitempty"`
+	Message string                  `json:"message,omitempty"`
+}
+
+// ContainerDiagnosis describes state and logs of a failed container
+type ContainerDiagnosis struct {
+	Name                  string `json:"name"`
+	Init                  bool   `json:"init"`
+	Ready                 bool   `json:"ready"`
+	RestartCount          int32  `json:"restartCount"`
+	State                 string `json:"state"`
+	Reason                string `json:"reason,omitempty"`
+	Message               string `json:"message,omitempty"`
+	ExitCode              *int32 `json:"exitCode,omitempty"`
+	LastTerminationReason string `json:"lastTerminationReason,omitempty"`
+	LastExitCode          *int32 `json:"lastExitCode,omitempty"`
+	Logs                  string `json:"logs,omitempty"`
+	PreviousLogs          string `json:"previousLogs,omitempty"`
+}
+
+// EventInfo is an event related to instance objects
+type EventInfo struct {
+	Object   string    `json:"object"`
+	Type     string    `json:"type"`
+	Reason   string    `json:"reason"`
+	Message  string    `json:"message"`
+	Count    int32     `json:"count"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// Error makes Diagnosis usable as an error returned by rollout waits
+func (d *Diagnosis) Error() string {
+	return d.Summary
+}
+
+// diagnoseInstance collects state of instance pods, related events and quota.
+// cause is the failure detected while waiting, nil means rollout timed out
+func (c *Cluster) diagnoseInstance(ctx context.Context, logger *logrus.Entry, appLabel string, cause error) *Diagnosis {
+	ctx, span := startSpan(ctx, "diagnoseInstance", attrInstance.String(appLabel))
+	defer span.End()
+
+	d := &Diagnosis{
+		Instance: appLabel,
+		Quota:    c.RQStatus.Get(),
+	}
+
+	listOpts := metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", appLabelKey, appLabel)}
+	podList, err := c.K8sClient.CoreV1().Pods(c.Namespace).List(ctx, listOpts)
+	if err != nil {
+		d.Errors = append(d.Errors, fmt.Sprintf("failed to list pods: %v", err))
+	} else {
+		for i := range podList.Items {
+			d.Pods = append(d.Pods, c.diagnosePod(ctx, d, &podList.Items[i]))
+		}
+	}
+
+	eventList, err := c.K8sClient.CoreV1().Events(c.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		d.Errors = append(d.Errors, fmt.Sprintf("failed to list events: %v", err))
+	} else {
+		// Deployment, its replicasets and pods share the prefix
+		prefix := fmt.Sprintf("%s-kas", appLabel)
+		for _, event := range eventList.Items {
+			if !strings.HasPrefix(event.InvolvedObject.Name, prefix) {
+				continue
+			}
+			lastSeen := event.LastTimestamp.Time
+			if lastSeen.IsZero() {
+				lastSeen = event.EventTime.Time
+			}
+			d.Events = append(d.Events, EventInfo{
+				Object:   fmt.Sprintf("%s/%s", event.InvolvedObject.Kind, event.InvolvedObject.Name),
+				Type:     event.Type,
+				Reason:   event.Reason,
+				Message:  event.Message,
+				Count:    event.Count,
+				LastSeen: lastSeen,
+			})
+		}
+		sort.Slice(d.Events, func(i, j int) bool {
+			return d.Events[i].LastSeen.Before(d.Events[j].LastSeen)
+		})
+	}
+
+	d.Category = suggestCategory(d, cause)
+	d.Summary = summarize(d, cause)
+	logger.WithFields(logrus.Fields{
+		"category": d.Category,
+		"pods":     len(d.Pods),
+		"events":   len(d.Events),
+	}).Info("instance failure diagnosed")
+	return d
+}
+
+func (c *Cluster) diagnosePod(ctx context.Context, d *Diagnosis, pod *corev1.Pod) PodDiagnosis {
+	pd := PodDiagnosis{
+		Name:   pod.Name,
+		Phase:  pod.Status.Phase,
+		Reason: pod.Status.Reason,
+	}
+	for _, cond := range pod.Status.Conditions {
+		pd.Conditions = append(pd.Conditions, ConditionInfo{
+			Type:    cond.Type,
+			Status:  cond.Status,
+			Reason:  cond.Reason,
+			Message: cond.Message,
+		})
+	}
+
+	statuses := make([]ContainerDiagnosis, 0, len(pod.Status.InitContainerStatuses)+len(pod.Status.ContainerStatuses))
+	for _, status := range pod.Status.InitContainerStatuses {
+		statuses = append(statuses, containerDiagnosis(status, true))
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		statuses = append(statuses, containerDiagnosis(status, false))
+	}
+
+	for _, cd := range statuses {
+		if !containerFailed(cd) {
+			continue
+		}
+		if cd.State != "waiting" || cd.RestartCount > 0 {
+			logs, err := c.containerLogs(ctx, pod.Name, cd.Name, false)
+			if err != nil {
+				d.Errors = append(d.Errors, err.Error())
+			}
+			cd.Logs = logs
+		}
+		if cd.RestartCount > 0 {
+			logs, err := c.containerLogs(ctx, pod.Name, cd.Name, true)
+			if err != nil {
+				d.Errors = append(d.Errors, err.Error())
+			}
+			cd.PreviousLogs = logs
+		}
+		pd.Containers = append(pd.Containers, cd)
+	}
+	return pd
+}
+
+func containerDiagnosis(status corev1.ContainerStatus, init bool) ContainerDiagnosis {
+	cd := ContainerDiagnosis{
+		Name:         status.Name,
+		Init:         init,
+		Ready:        status.Ready,
+		RestartCount: status.RestartCount,
+	}
+	switch {
+	case status.State.Waiting != nil:
+		cd.State = "waiting"
+		cd.Reason = status.State.Waiting.Reason
+		cd.Message = status.State.Waiting.Message
+	case status.State.Running != nil:
+		cd.State = "running"
+	case status.State.Terminated != nil:
+		cd.State = "terminated"
+		cd.Reason = status.State.Terminated.Reason
+		cd.Message = status.State.Terminated.Message
+		exitCode := status.State.Terminated.ExitCode
+		cd.ExitCode = &exitCode
+	}
+	if last := status.LastTerminationState.Terminated; last != nil {
+		cd.LastTerminationReason = last.Reason
+		exitCode := last.ExitCode
+		cd.LastExitCode = &exitCode
+	}
+	return cd
+}
+
+// containerFailed reports whether container is worth including in the diagnosis
+func containerFailed(cd ContainerDiagnosis) bool {
+	if cd.Init {
+		// Successfully completed init containers are not ready, but fine
+		return !(cd.State == "terminated" && cd.ExitCode != nil && *cd.ExitCode == 0)
+	}
+	return !cd.Ready || cd.RestartCount > 0
+}
+
+func (c *Cluster) containerLogs(ctx context.Context, podName, container string, previous bool) (string, error) {
+	tailLines := diagnosisLogLines
+	limitBytes := diagnosisLogBytes
+	req := c.K8sClient.CoreV1().Pods(c.Namespace).GetLogs(podName, &corev1.PodLogOptions{
+		Container:  container,
+		Previous:   previous,
+		TailLines:  &tailLines,
+		LimitBytes: &limitBytes,
+	})
+	stream, err := req.Stream(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch logs of container %s in pod %s: %v", container, podName, err)
+	}
+	defer stream.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, stream); err != nil {
+		return buf.String(), fmt.Errorf("failed to read logs of container %s in pod %s: %v", container, podName, err)
+	}
+	return buf.String(), nil
+}
+
+// suggestCategory guesses the most likely cause of failure
+func suggestCategory(d *Diagnosis, cause error) FailureCategory {
+	var failure *InstanceFailure
+	if errors.As(cause, &failure) {
+		switch failure.Reason {
+		case "ImagePullBackOff", "ErrImagePull", "InvalidImageName":
+			return FailureImagePull
+		case "CrashLoopBackOff":
+			return FailureCrashLoop
+		case corev1.PodReasonUnschedulable:
+			return FailureUnschedulable
+		}
+	}
+
+	for _, event := range d.Events {
+		if event.Reason == "FailedCreate" && strings.Contains(event.Message, "exceeded quota") {
+			return FailureQuota
+		}
+	}
+	for _, pod := range d.Pods {
+		for _, cond := range pod.Conditions {
+			if cond.Type == corev1.PodScheduled && cond.Reason == corev1.PodReasonUnschedulable {
+				return FailureUnschedulable
+			}
+		}
+		for _, cd := range pod.Containers {
+			switch {
+			case cd.Reason == "ImagePullBackOff" || cd.Reason == "ErrImagePull" || cd.Reason == "InvalidImageName":
+				return FailureImagePull
+			case cd.Init && (cd.ExitCode != nil && *cd.ExitCode != 0 || cd.LastExitCode != nil && *cd.LastExitCode != 0):
+				return FailureDownload
+			case cd.Reason == "CrashLoopBackOff" || cd.RestartCount > 0:
+				return FailureCrashLoop
+			}
+		}
+	}
+	if len(d.Pods) == 0 && d.Quota.Hard > 0 && d.Quota.Used >= d.Quota.Hard {
+		return FailureQuota
+	}
+	if cause == nil {
+		return FailureTimeout
+	}
+	return FailureUnknown
+}
+
+func summarize(d *Diagnosis, cause error) string {
+	hints := map[FailureCategory]string{
+		FailureImagePull:     "an instance image could not be pulled",
+		FailureDownload:      "the dump could not be downloaded or extracted",
+		FailureCrashLoop:     "an instance container keeps crashing",
+		FailureUnschedulable: "the instance pod could not be scheduled",
+		FailureQuota:         "the namespace quota is exhausted, try again once other instances are removed",
+		FailureTimeout:       "the instance did not become ready in time, the dump may be too large",
+		FailureUnknown:       "the cause is unknown",
+	}
+	summary := fmt.Sprintf("Instance %s failed to start: %s", d.Instance, hints[d.Category])
+	if cause != nil {
+		summary = fmt.Sprintf("%s (%v)", summary, cause)
+	}
+	return summary
+}
@@ -0,0 +1,137 @@
+package kaas
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSuggestCategory(t *testing.T) {
+	exitCode := int32(1)
+	for _, tc := range []struct {
+		name      string
+		diagnosis Diagnosis
+		cause     error
+		expected  FailureCategory
+	}{
+		{
+			name:     "image pull failure",
+			cause:    &InstanceFailure{Reason: "ImagePullBackOff"},
+			expected: FailureImagePull,
+		},
+		{
+			name:     "unschedulable failure",
+			cause:    &InstanceFailure{Reason: corev1.PodReasonUnschedulable},
+			expected: FailureUnschedulable,
+		},
+		{
+			name: "quota exceeded event",
+			diagnosis: Diagnosis{Events: []EventInfo{
+				{Reason: "FailedCreate", Message: `pods "app-kas-1" is forbidden: exceeded quota: pod-quota`},
+			}},
+			expected: FailureQuota,
+		},
+		{
+			name:      "quota exhausted without pods",
+			diagnosis: Diagnosis{Quota: RQuotaStatus{Used: 7, Hard: 7}},
+			expected:  FailureQuota,
+		},
+		{
+			name: "download failed",
+			diagnosis: Diagnosis{Pods: []PodDiagnosis{{Containers: []ContainerDiagnosis{
+				{Name: "ci-fetcher", Init: true, State: "terminated", ExitCode: &exitCode},
+			}}}},
+			cause:    &InstanceFailure{Reason: "Error"},
+			expected: FailureDownload,
+		},
+		{
+			name: "container restarts",
+			diagnosis: Diagnosis{Pods: []PodDiagnosis{{Containers: []ContainerDiagnosis{
+				{Name: "kas", State: "running", RestartCount: 2},
+			}}}},
+			expected: FailureCrashLoop,
+		},
+		{
+			name:     "timeout",
+			expected: FailureTimeout,
+		},
+		{
+			name:     "unknown",
+			cause:    errors.New("deployment was removed"),
+			expected: FailureUnknown,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if category := suggestCategory(&tc.diagnosis, tc.cause); category != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, category)
+			}
+		})
+	}
+}
+
+func TestDiagnoseInstance(t *testing.T) {
+	podMeta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: testNamespace, Labels: map[string]string{appLabelKey: "app"}}
+	}
+	event := func(object, reason string, lastSeen time.Time) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: object + "." + reason, Namespace: testNamespace},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: object},
+			Type:           corev1.EventTypeWarning,
+			Reason:         reason,
+			LastTimestamp:  metav1.NewTime(lastSeen),
+		}
+	}
+	now := time.Now()
+	pod := &corev1.Pod{
+		ObjectMeta: podMeta("app-kas-1"),
+		Status: corev1.PodStatus{
+			Phase: corev1.PodPending,
+			InitContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "ci-fetcher",
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 22, Reason: "Error"}},
+			}},
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "kas", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "PodInitializing"}}},
+				{Name: "sidecar", Ready: true, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+			},
+		},
+	}
+	env := newTestEnv(t, testConfig(), false, pod,
+		event("app-kas-1", "BackOff", now),
+		event("app-kas-1", "Pulled", now.Add(-time.Minute)),
+		event("other-kas-1", "BackOff", now),
+	)
+
+	d := env.cluster.diagnoseInstance(context.TODO(), testLogger(), "app", &InstanceFailure{Pod: pod.Name, Container: "ci-fetcher", Reason: "Error"})
+	if d.Category != FailureDownload || !strings.Contains(d.Summary, "could not be downloaded") {
+		t.Errorf("expected download failure, got %s: %s", d.Category, d.Summary)
+	}
+	if len(d.Pods) != 1 {
+		t.Fatalf("expected a single pod, got %+v", d.Pods)
+	}
+	containers := map[string]ContainerDiagnosis{}
+	for _, cd := range d.Pods[0].Containers {
+		containers[cd.Name] = cd
+	}
+	if _, ok := containers["sidecar"]; ok || len(containers) != 2 {
+		t.Errorf("expected only failed containers to be diagnosed, got %+v", d.Pods[0].Containers)
+	}
+	if fetcher := containers["ci-fetcher"]; fetcher.Logs == "" || fetcher.ExitCode == nil || *fetcher.ExitCode != 22 {
+		t.Errorf("expected logs and exit code of failed fetcher, got %+v", fetcher)
+	}
+	if kas := containers["kas"]; kas.Logs != "" {
+		t.Errorf("expected logs of waiting container not to be fetched, got %q", kas.Logs)
+	}
+	if len(d.Events) != 2 || d.Events[0].Reason != "Pulled" || d.Events[1].Reason != "BackOff" {
+		t.Errorf("expected instance events ordered by time, got %+v", d.Events)
+	}
+	if len(d.Errors) != 0 {
+		t.Errorf("unexpected errors %v", d.Errors)
+	}
+}
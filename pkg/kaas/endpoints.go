@@ -0,0 +1,390 @@
+package kaas
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	kasPort     = 8080
+	consolePort = 9000
+
+	// defaultContext is the kubeconfig context of single dump instances
+	defaultContext = "static-kas"
+
+	// hostedClusterPrefix starts names of directories with hosted cluster resources in hypershift dumps
+	hostedClusterPrefix = "hostedcluster-"
+
+	// dumpScanLimit and dumpScanTimeout bound reading dump archives while the user waits for the instance
+	dumpScanLimit   = 1 << 30
+	dumpScanTimeout = 2 * time.Minute
+)
+
+// instanceSpec describes what the instance serves
+type instanceSpec struct {
+	Dumps []string
+	// DumpSources are URLs the dumps are downloaded from, with redirects resolved and checked by kaas
+	DumpSources []string
+	// Headless instances serve API only, without console
+	Headless bool
+	// ConsoleImages are console images for each dump, configured console image is used if empty
+	ConsoleImages []string
+	// PrometheusTarball is the metrics snapshot, Prometheus is not launched if empty
+	PrometheusTarball string
+	// Grafana is set to launch Grafana using Prometheus as datasource
+	Grafana bool
+	// Job is used to set time range of dashboards
+	Job *JobInfo
+	// DumpSizes are sizes of dump archives used to pick resources, negative if unknown
+	DumpSizes []int64
+	// HostedClusters are hosted cluster directories of each dump, empty for non-hypershift dumps
+	HostedClusters [][]string
+}
+
+// dumpTier returns the resource tier of the dump with index d, nil if its size is unknown
+func (spec instanceSpec) dumpTier(cfg Config, d int) *SizeTier {
+	if d >= len(spec.DumpSizes) {
+		return nil
+	}
+	return cfg.Sizing.tierFor(spec.DumpSizes[d])
+}
+
+// dumpSource returns the URL the dump with index d is downloaded from
+func (spec instanceSpec) dumpSource(d int) string {
+	if d < len(spec.DumpSources) && spec.DumpSources[d] != "" {
+		return spec.DumpSources[d]
+	}
+	return spec.Dumps[d]
+}
+
+// consoleImage returns console image for the dump with index d
+func (spec instanceSpec) consoleImage(cfg Config, d int) string {
+	if d < len(spec.ConsoleImages) && spec.ConsoleImages[d] != "" {
+		return spec.ConsoleImages[d]
+	}
+	return cfg.Images.Console
+}
+
+// instanceURLs stores external URLs of the instance
+type instanceURLs struct {
+	Endpoints []instanceEndpoint
+	// Companions maps names of additional services, like Prometheus, to their URLs
+	Companions map[string]string
+}
+
+// instanceEndpoint describes the API and console serving one cluster of the instance.
+// Every dump is served by one endpoint, except for hypershift dumps which have separate
+// endpoints for the management cluster and each hosted cluster
+type instanceEndpoint struct {
+	Name       string `json:"name"`
+	Dump       string `json:"dump"`
+	APIURL     string `json:"apiURL"`
+	ConsoleURL string `json:"consoleURL,omitempty"`
+
+	// dumpIndex is the index of the dump volume the endpoint reads
+	dumpIndex int
+	// baseDir is the path to cluster resources relative to the dump root
+	baseDir string
+}
+
+// endpointSuffix is appended to names of objects related to the endpoint or dump with index i.
+// The first one uses plain names, so single dump instances look the same as before
+func endpointSuffix(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return fmt.Sprintf("-%d", i)
+}
+
+// newInstanceEndpoints names endpoints after the step which produced the dump,
+// e.g. ".../artifacts/e2e/gather-must-gather/artifacts/must-gather.tar" is named "gather-must-gather".
+// Hypershift endpoints are named "management" and "hosted-<name>" after hosted cluster directories,
+// prefixed with the step name if several dumps are loaded
+func newInstanceEndpoints(dumpURLs []string, hostedClusters [][]string) []instanceEndpoint {
+	endpoints := make([]instanceEndpoint, 0, len(dumpURLs))
+	seen := make(map[string]bool, len(dumpURLs))
+	for i, dumpURL := range dumpURLs {
+		name := dumpStepName(dumpURL)
+		if name == "" || seen[name] {
+			name = fmt.Sprintf("dump-%d", i)
+		}
+		seen[name] = true
+		if !isHypershiftDump(dumpURL) {
+			endpoints = append(endpoints, instanceEndpoint{Name: name, Dump: dumpURL, dumpIndex: i})
+			continue
+		}
+		prefix := ""
+		if len(dumpURLs) > 1 {
+			prefix = name + "-"
+		}
+		endpoints = append(endpoints, instanceEndpoint{Name: prefix + "management", Dump: dumpURL, dumpIndex: i})
+		if i >= len(hostedClusters) {
+			continue
+		}
+		for _, dir := range hostedClusters[i] {
+			endpoints = append(endpoints, instanceEndpoint{
+				Name:      prefix + "hosted-" + strings.TrimPrefix(dir, hostedClusterPrefix),
+				Dump:      dumpURL,
+				dumpIndex: i,
+				baseDir:   dir,
+			})
+		}
+	}
+	return endpoints
+}
+
+func isHypershiftDump(dumpURL string) bool {
+	return strings.Contains(dumpURL, "hypershift-dump.tar")
+}
+
+// errDumpScanLimit is returned when the dump archive is larger than the walk may read
+var errDumpScanLimit = errors.New("read limit reached")
+
+// scanLimitReader fails once more than n bytes are read, so the caller can tell truncated archives from limits
+type scanLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *scanLimitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errDumpScanLimit
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// walkDump streams the dump archive and calls visit for its members until it returns false.
+// At most limit bytes of the archive are downloaded and the walk is cancelled after timeout
+func walkDump(ctx context.Context, dumpURL string, limit int64, timeout time.Duration, visit func(name string, member io.Reader) (bool, error)) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	defer func() {
+		// Reads of cancelled responses don't always report the cause
+		if ctxErr := ctx.Err(); err != nil && ctxErr != nil && !errors.Is(err, ctxErr) {
+			err = fmt.Errorf("%v: %w", err, ctxErr)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dumpURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
+	}
+	gz, err := gzip.NewReader(&scanLimitReader{r: res.Body, n: limit})
+	if err != nil {
+		return fmt.Errorf("failed to read dump archive: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read dump archive: %w", err)
+		}
+		more, err := visit(strings.TrimPrefix(path.Clean("/"+header.Name), "/"), tr)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// dumpScanStopped reports whether the dump walk was stopped by its limits
+func dumpScanStopped(err error) bool {
+	return errors.Is(err, errDumpScanLimit) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// listHostedClusters returns sorted names of hosted cluster directories in the root of hypershift dump.
+// The archive is streamed, as the directories have to be known before the instance is created.
+// Directories found so far are returned along with the error if the scan limits are reached
+func listHostedClusters(ctx context.Context, dumpURL string, limit int64, timeout time.Duration) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "listHostedClusters", attrURL.String(dumpURL))
+	defer func() { endSpan(span, err) }()
+
+	found := map[string]bool{}
+	err = walkDump(ctx, dumpURL, limit, timeout, func(name string, _ io.Reader) (bool, error) {
+		dir := strings.SplitN(name, "/", 2)[0]
+		if strings.HasPrefix(dir, hostedClusterPrefix) && len(dir) > len(hostedClusterPrefix) {
+			found[dir] = true
+		}
+		return true, nil
+	})
+	if err != nil && !dumpScanStopped(err) {
+		return nil, err
+	}
+	hosted := make([]string, 0, len(found))
+	for dir := range found {
+		hosted = append(hosted, dir)
+	}
+	sort.Strings(hosted)
+	return hosted, err
+}
+
+// hostedClusters lists hosted clusters of hypershift dumps. If the dump is too large to be scanned
+// while the user waits, hosted clusters found until then are served
+func (s *ServerSettings) hostedClusters(ctx context.Context, logger *logrus.Entry, conn *wsConn, dumpURLs []string) ([][]string, error) {
+	hosted := make([][]string, len(dumpURLs))
+	for i, dumpURL := range dumpURLs {
+		if !isHypershiftDump(dumpURL) {
+			continue
+		}
+		dumpLogger := logger.WithField("dump", dumpURL)
+		sendWSMessage(conn, "status", fmt.Sprintf("Looking for hosted clusters in %s", dumpURL))
+		dirs, err := listHostedClusters(ctx, dumpURL, dumpScanLimit, dumpScanTimeout)
+		switch {
+		case dumpScanStopped(err):
+			dumpLogger.WithError(err).Warn("stopped looking for hosted clusters")
+			sendWSMessage(conn, "status", fmt.Sprintf("Dump %s is too large to be scanned for hosted clusters, some of them may be missing", dumpURL))
+		case err != nil:
+			return nil, fmt.Errorf("Failed to list hosted clusters in %s: %v", dumpURL, err)
+		}
+		dumpLogger.WithField("hosted", dirs).Debug("found hosted clusters")
+		if len(dirs) == 0 {
+			sendWSMessage(conn, "status", fmt.Sprintf("No hosted clusters found in %s, serving management cluster only", dumpURL))
+		}
+		hosted[i] = dirs
+	}
+	return hosted, nil
+}
+
+func dumpStepName(dumpURL string) string {
+	u, err := url.Parse(dumpURL)
+	if err != nil {
+		return ""
+	}
+	segments := strings.Split(strings.Trim(path.Dir(u.Path), "/"), "/")
+	for i := len(segments) - 1; i > 0; i-- {
+		if segments[i] == "artifacts" {
+			return segments[i-1]
+		}
+	}
+	return ""
+}
+
+// dumpsKey identifies the set of dumps served by an instance
+func dumpsKey(dumpURLs []string) string {
+	return strings.Join(dumpURLs, "\n")
+}
+
+func kasArgs(i int, baseDir string) []string {
+	args := []string{
+		"--base-dir",
+		path.Join("/must-gather/", baseDir) + "/",
+	}
+	if i > 0 {
+		args = append(args, "--port", strconv.Itoa(kasPort+i))
+	}
+	return args
+}
+
+// consoleArgs returns args of the console serving endpoint i. The console talks to static-kas in the same pod
+// over localhost, as instance egress to the route and pod network is blocked
+func consoleArgs(i int) []string {
+	args := []string{
+		"/opt/bridge/bin/bridge",
+		"--public-dir=/opt/bridge/static",
+	}
+	if i > 0 {
+		args = append(args, fmt.Sprintf("--listen=http://0.0.0.0:%d", consolePort+i))
+	}
+	return append(args,
+		"--k8s-mode=off-cluster",
+		fmt.Sprintf("--k8s-mode-off-cluster-endpoint=http://localhost:%d", kasPort+i),
+		"--user-auth=disabled",
+		"--k8s-auth=bearer-token",
+		"--k8s-auth-bearer-token=dummy",
+		"--user-settings-location=localstorage",
+	)
+}
+
+// endpointContext returns kubeconfig context name of the endpoint
+func endpointContext(endpoints []instanceEndpoint, i int) string {
+	if len(endpoints) == 1 {
+		return defaultContext
+	}
+	return fmt.Sprintf("%s-%s", defaultContext, endpoints[i].Name)
+}
+
+// renderKubeconfig returns kubeconfig with a context per endpoint, the first one is current
+func renderKubeconfig(endpoints []instanceEndpoint) string {
+	if len(endpoints) == 1 {
+		return fmt.Sprintf(kubeConfigTemplate, endpoints[0].APIURL)
+	}
+	var b strings.Builder
+	b.WriteString("apiVersion: v1\nclusters:\n")
+	for i, endpoint := range endpoints {
+		fmt.Fprintf(&b, "- cluster:\n    server: %s\n  name: %s\n", endpoint.APIURL, endpointContext(endpoints, i))
+	}
+	b.WriteString("contexts:\n")
+	for i := range endpoints {
+		name := endpointContext(endpoints, i)
+		fmt.Fprintf(&b, "- context:\n    cluster: %s\n    namespace: default\n    user: admin\n  name: %s\n", name, name)
+	}
+	fmt.Fprintf(&b, "current-context: %s\n", endpointContext(endpoints, 0))
+	b.WriteString("kind: Config\nusers:\n- name: admin\n  user:\n    token: dummy")
+	return b.String()
+}
+
+// consoleLinks maps endpoint names to console URLs
+func consoleLinks(endpoints []instanceEndpoint) map[string]string {
+	links := make(map[string]string, len(endpoints))
+	for _, endpoint := range endpoints {
+		if endpoint.ConsoleURL != "" {
+			links[endpoint.Name] = endpoint.ConsoleURL
+		}
+	}
+	return links
+}
+
+func marshalEndpoints(endpoints []instanceEndpoint) string {
+	data, err := json.Marshal(endpoints)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func marshalCompanions(companions map[string]string) string {
+	data, err := json.Marshal(companions)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func unmarshalEndpoints(data string) ([]instanceEndpoint, error) {
+	endpoints := []instanceEndpoint{}
+	if err := json.Unmarshal([]byte(data), &endpoints); err != nil {
+		return nil, fmt.Errorf("failed to parse instance endpoints: %v", err)
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,129 @@
+package kaas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestWalkDumpLimits(t *testing.T) {
+	// Random content doesn't compress, so the archive is larger than the limit
+	noise := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(noise)
+	artifacts := newArtifactServer(t, map[string][]byte{
+		"/dump.tar.gz": dumpArchive(t, map[string]string{"noise": string(noise)}),
+	})
+	dumpURL := artifacts.URL + "/dump.tar.gz"
+	readAll := func(_ string, member io.Reader) (bool, error) {
+		_, err := io.Copy(io.Discard, member)
+		return true, err
+	}
+
+	if err := walkDump(context.Background(), dumpURL, 1<<20, time.Minute, readAll); err != nil {
+		t.Errorf("expected archive to be read within limits, got %v", err)
+	}
+	if err := walkDump(context.Background(), dumpURL, 1<<10, time.Minute, readAll); !errors.Is(err, errDumpScanLimit) {
+		t.Errorf("expected walk to stop at read limit, got %v", err)
+	}
+	if err := walkDump(context.Background(), dumpURL, 1<<20, 0, readAll); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected walk to time out, got %v", err)
+	}
+}
+
+func TestListHostedClusters(t *testing.T) {
+	noise := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(noise)
+	artifacts := newArtifactServer(t, map[string][]byte{
+		"/hypershift-dump.tar.gz": dumpArchive(t, map[string]string{
+			"namespaces/default/core/pods.yaml":                   string(noise),
+			"hostedcluster-a/namespaces/default/core/pods.yaml":   "kind: PodList",
+			"hostedcluster-b/cluster-scoped-resources/nodes.yaml": "kind: NodeList",
+			"hostedcluster-/ignored.yaml":                         "",
+		}),
+	})
+	dumpURL := artifacts.URL + "/hypershift-dump.tar.gz"
+
+	hosted, err := listHostedClusters(context.Background(), dumpURL, 1<<20, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to list hosted clusters: %v", err)
+	}
+	if strings.Join(hosted, ",") != "hostedcluster-a,hostedcluster-b" {
+		t.Errorf("unexpected hosted clusters %v", hosted)
+	}
+	if _, err := listHostedClusters(context.Background(), dumpURL, 1<<10, time.Minute); !dumpScanStopped(err) {
+		t.Errorf("expected listing to stop at read limit, got %v", err)
+	}
+}
+
+func TestNewInstanceEndpoints(t *testing.T) {
+	const root = "https://example.com/logs/job/1/artifacts/"
+	endpoints := newInstanceEndpoints([]string{
+		root + "e2e/gather-must-gather/artifacts/must-gather.tar",
+		root + "upgrade/gather-must-gather/artifacts/must-gather.tar",
+		root + "e2e/dump-management-cluster/artifacts/hypershift-dump.tar",
+		"https://example.com/must-gather.tar",
+	}, [][]string{nil, nil, {"hostedcluster-a"}})
+
+	names := []string{}
+	for _, endpoint := range endpoints {
+		names = append(names, fmt.Sprintf("%s@%d:%s", endpoint.Name, endpoint.dumpIndex, endpoint.baseDir))
+	}
+	expected := []string{
+		"gather-must-gather@0:",
+		// Steps with the same name in different tests are told apart by index
+		"dump-1@1:",
+		"dump-management-cluster-management@2:",
+		"dump-management-cluster-hosted-a@2:hostedcluster-a",
+		"dump-3@3:",
+	}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected endpoints %v, got %v", expected, names)
+	}
+	if single := newInstanceEndpoints([]string{root + "e2e/dump/artifacts/hypershift-dump.tar"}, nil); len(single) != 1 || single[0].Name != "management" {
+		t.Errorf("expected hypershift dump without hosted clusters to be served as management, got %+v", single)
+	}
+}
+
+func TestRenderKubeconfig(t *testing.T) {
+	single, err := clientcmd.Load([]byte(renderKubeconfig([]instanceEndpoint{{Name: "e2e", APIURL: "https://api-1.example.com"}})))
+	if err != nil {
+		t.Fatalf("failed to parse kubeconfig: %v", err)
+	}
+	if single.CurrentContext != defaultContext || single.Clusters[defaultContext].Server != "https://api-1.example.com" {
+		t.Errorf("expected single dump kubeconfig to use %s context, got %+v", defaultContext, single)
+	}
+
+	multi, err := clientcmd.Load([]byte(renderKubeconfig([]instanceEndpoint{
+		{Name: "management", APIURL: "https://api-1.example.com"},
+		{Name: "hosted-a", APIURL: "https://api-2.example.com"},
+	})))
+	if err != nil {
+		t.Fatalf("failed to parse kubeconfig: %v", err)
+	}
+	if multi.CurrentContext != "static-kas-management" || len(multi.Contexts) != 2 {
+		t.Errorf("expected a context per endpoint, got %+v", multi.Contexts)
+	}
+	if cluster := multi.Clusters[multi.Contexts["static-kas-hosted-a"].Cluster]; cluster == nil || cluster.Server != "https://api-2.example.com" {
+		t.Errorf("expected hosted-a context to point to its API, got %+v", cluster)
+	}
+}
+
+func TestEndpointPorts(t *testing.T) {
+	if args := strings.Join(kasArgs(0, ""), " "); args != "--base-dir /must-gather/" {
+		t.Errorf("unexpected args of the first static-kas: %s", args)
+	}
+	if args := strings.Join(kasArgs(2, "hostedcluster-a"), " "); args != "--base-dir /must-gather/hostedcluster-a/ --port 8082" {
+		t.Errorf("unexpected args of the third static-kas: %s", args)
+	}
+	args := strings.Join(consoleArgs(2), " ")
+	if !strings.Contains(args, "--listen=http://0.0.0.0:9002") || !strings.Contains(args, "--k8s-mode-off-cluster-endpoint=http://localhost:8082") {
+		t.Errorf("expected the third console to listen on its own port and use the third static-kas, got %s", args)
+	}
+}
@@ -0,0 +1,161 @@
+package kaas
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	grafanaPort = 3000
+
+	// companionGrafana is the name of Grafana link
+	companionGrafana = "grafana"
+
+	grafanaDatasourceUID = "prometheus"
+	grafanaDashboardsDir = "/etc/grafana/dashboards"
+)
+
+// dashboards is a curated set of dashboards provisioned in Grafana
+//
+//go:embed dashboards/*.json
+var dashboards embed.FS
+
+const grafanaDatasourceTemplate = `apiVersion: 1
+datasources:
+- name: Prometheus
+  uid: %s
+  type: prometheus
+  access: proxy
+  url: http://localhost:%d
+  isDefault: true
+  editable: false
+`
+
+const grafanaDashboardProvider = `apiVersion: 1
+providers:
+- name: kaas
+  type: file
+  allowUiUpdates: false
+  options:
+    path: ` + grafanaDashboardsDir + `
+`
+
+func grafanaConfigMapName(appLabel string) string {
+	return fmt.Sprintf("%s-grafana", appLabel)
+}
+
+// grafanaConfigMap returns provisioning config of instance Grafana. Dashboards show job run time if it's known
+func grafanaConfigMap(appLabel string, job *JobInfo) (*corev1.ConfigMap, error) {
+	data := map[string]string{
+		"datasource.yaml": fmt.Sprintf(grafanaDatasourceTemplate, grafanaDatasourceUID, prometheusPort),
+		"dashboards.yaml": grafanaDashboardProvider,
+	}
+	files, err := dashboards.ReadDir("dashboards")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		content, err := dashboards.ReadFile(path.Join("dashboards", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if job != nil && job.Started != nil {
+			content, err = withTimeRange(content, job)
+			if err != nil {
+				return nil, fmt.Errorf("failed to set time range of dashboard %s: %v", file.Name(), err)
+			}
+		}
+		data[file.Name()] = string(content)
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: grafanaConfigMapName(appLabel),
+			Labels: map[string]string{
+				"app": appLabel,
+			},
+		},
+		Data: data,
+	}, nil
+}
+
+// withTimeRange sets dashboard time range to the job run
+func withTimeRange(dashboard []byte, job *JobInfo) ([]byte, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(dashboard, &fields); err != nil {
+		return nil, err
+	}
+	to := time.Now().UTC()
+	if job.Finished != nil {
+		to = *job.Finished
+	}
+	fields["time"] = map[string]string{
+		"from": job.Started.Format(time.RFC3339),
+		"to":   to.Format(time.RFC3339),
+	}
+	return json.Marshal(fields)
+}
+
+// grafanaContainer returns Grafana container using instance Prometheus as datasource and its volume
+func grafanaContainer(cfg Config, appLabel string) (corev1.Container, corev1.Volume) {
+	configItems := []corev1.KeyToPath{
+		{Key: "datasource.yaml", Path: "provisioning/datasources/datasource.yaml"},
+		{Key: "dashboards.yaml", Path: "provisioning/dashboards/dashboards.yaml"},
+	}
+	if files, err := dashboards.ReadDir("dashboards"); err == nil {
+		for _, file := range files {
+			configItems = append(configItems, corev1.KeyToPath{Key: file.Name(), Path: path.Join("dashboards", file.Name())})
+		}
+	}
+	volume := corev1.Volume{
+		Name: "grafana-config",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: grafanaConfigMapName(appLabel)},
+				Items:                configItems,
+			},
+		},
+	}
+	container := corev1.Container{
+		Name:  "grafana",
+		Image: cfg.Images.Grafana,
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          "grafana",
+				Protocol:      corev1.ProtocolTCP,
+				ContainerPort: grafanaPort,
+			},
+		},
+		Env: []corev1.EnvVar{
+			{Name: "GF_SERVER_HTTP_PORT", Value: fmt.Sprint(grafanaPort)},
+			{Name: "GF_PATHS_PROVISIONING", Value: "/etc/grafana/provisioning"},
+			// Root filesystem is read-only, so Grafana database and logs are kept in writable /tmp
+			{Name: "GF_PATHS_DATA", Value: "/tmp/grafana"},
+			{Name: "GF_PATHS_LOGS", Value: "/tmp/grafana/logs"},
+			{Name: "GF_AUTH_ANONYMOUS_ENABLED", Value: "true"},
+			// Anyone with the link can open Grafana, so they may only view provisioned dashboards
+			{Name: "GF_AUTH_ANONYMOUS_ORG_ROLE", Value: "Viewer"},
+			{Name: "GF_AUTH_DISABLE_LOGIN_FORM", Value: "true"},
+			{Name: "GF_ANALYTICS_REPORTING_ENABLED", Value: "false"},
+		},
+		Resources: cfg.Resources.Grafana.requirements(),
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "grafana-config",
+				MountPath: "/etc/grafana/provisioning",
+				SubPath:   "provisioning",
+			},
+			{
+				Name:      "grafana-config",
+				MountPath: grafanaDashboardsDir,
+				SubPath:   "dashboards",
+			},
+		},
+	}
+	return container, volume
+}
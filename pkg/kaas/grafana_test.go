@@ -0,0 +1,112 @@
+package kaas
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGrafanaContainerIsReadOnly(t *testing.T) {
+	container, _ := grafanaContainer(testConfig(), "app")
+	env := map[string]string{}
+	for _, v := range container.Env {
+		env[v.Name] = v.Value
+	}
+	if env["GF_AUTH_ANONYMOUS_ENABLED"] != "true" || env["GF_AUTH_ANONYMOUS_ORG_ROLE"] != "Viewer" {
+		t.Errorf("expected anonymous users to be viewers, got %v", env)
+	}
+}
+
+func TestGrafanaConfigMap(t *testing.T) {
+	started := time.Date(2023, 11, 14, 22, 0, 0, 0, time.UTC)
+	finished := started.Add(time.Hour)
+	cm, err := grafanaConfigMap("app", &JobInfo{Started: &started, Finished: &finished})
+	if err != nil {
+		t.Fatalf("failed to render grafana config: %v", err)
+	}
+	if cm.Name != grafanaConfigMapName("app") || cm.Labels["app"] != "app" {
+		t.Errorf("unexpected config map metadata %+v", cm.ObjectMeta)
+	}
+
+	_, volume := grafanaContainer(testConfig(), "app")
+	if len(volume.ConfigMap.Items) != len(cm.Data) {
+		t.Errorf("expected every config key to be mounted, got %d items for %d keys", len(volume.ConfigMap.Items), len(cm.Data))
+	}
+	dashboardCount := 0
+	for _, item := range volume.ConfigMap.Items {
+		content, ok := cm.Data[item.Key]
+		if !ok {
+			t.Errorf("mounted key %s is missing in config map", item.Key)
+			continue
+		}
+		if item.Key == "datasource.yaml" || item.Key == "dashboards.yaml" {
+			continue
+		}
+		dashboardCount++
+		var dashboard struct {
+			Time map[string]string `json:"time"`
+		}
+		if err := json.Unmarshal([]byte(content), &dashboard); err != nil {
+			t.Errorf("dashboard %s is not valid JSON: %v", item.Key, err)
+			continue
+		}
+		if dashboard.Time["from"] != "2023-11-14T22:00:00Z" || dashboard.Time["to"] != "2023-11-14T23:00:00Z" {
+			t.Errorf("expected dashboard %s to show the job run, got %v", item.Key, dashboard.Time)
+		}
+	}
+	if dashboardCount == 0 {
+		t.Errorf("expected dashboards to be provisioned")
+	}
+}
+
+func TestGrafanaConfigMapWithoutJobTimes(t *testing.T) {
+	cm, err := grafanaConfigMap("app", &JobInfo{Job: "periodic-e2e"})
+	if err != nil {
+		t.Fatalf("failed to render grafana config: %v", err)
+	}
+	files, err := dashboards.ReadDir("dashboards")
+	if err != nil {
+		t.Fatalf("failed to list dashboards: %v", err)
+	}
+	for _, file := range files {
+		content, _ := dashboards.ReadFile("dashboards/" + file.Name())
+		if cm.Data[file.Name()] != string(content) {
+			t.Errorf("expected dashboard %s to be kept as is without job run time", file.Name())
+		}
+	}
+}
+
+func TestNewKASLaunchesGrafana(t *testing.T) {
+	files := jobArtifacts(testDumpPath)
+	files[testJobRoot+"artifacts/e2e/gather-extra/artifacts/metrics/"+prometheusTarball] = []byte("metrics")
+	artifacts := newArtifactServer(t, files)
+	cfg := testConfig()
+	cfg.Prometheus = true
+	cfg.Grafana = true
+	env := newTestEnv(t, cfg, true)
+	conn := env.dial(t)
+
+	messages := createInstance(t, conn, artifacts.URL+testJobRoot, nil)
+	if lastMessage(messages).Action != "done" {
+		t.Fatalf("expected instance to be created, got %v", messages)
+	}
+	deployment := instanceDeployment(t, env, messages)
+	found := false
+	for _, c := range deployment.Spec.Template.Spec.Containers {
+		found = found || c.Name == "grafana"
+	}
+	if !found {
+		t.Errorf("expected Grafana container")
+	}
+
+	appLabel := findMessage(messages, "app-label").Message
+	if _, err := env.kube.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), grafanaConfigMapName(appLabel), metav1.GetOptions{}); err != nil {
+		t.Errorf("expected Grafana config map: %v", err)
+	}
+	if _, err := env.routes.RouteV1().Routes(testNamespace).Get(context.TODO(), appLabel+"-grafana", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected Grafana route: %v", err)
+	}
+}
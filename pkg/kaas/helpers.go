@@ -1,8 +1,8 @@
 package kaas
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -10,12 +10,13 @@ import (
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
-	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 )
 
 const (
-	charset    = "abcdefghijklmnopqrstuvwxyz"
-	randLength = 8
+	charset          = "abcdefghijklmnopqrstuvwxyz"
+	randLength       = 8
+	connIDRandLength = 12
 )
 
 var (
@@ -27,17 +28,26 @@ var (
 	clusterDumps = []string{"must-gather.tar", "hypershift-dump.tar"}
 )
 
-func generateAppLabel() string {
+func randomString(length int) string {
 	seededRand := rand.New(rand.NewSource(time.Now().UnixNano()))
 
-	b := make([]byte, randLength)
+	b := make([]byte, length)
 	for i := range b {
 		b[i] = charset[seededRand.Intn(len(charset))]
 	}
 	return string(b)
 }
 
-func getTarPaths(conn *websocket.Conn, url string) (*ProwInfo, error) {
+func generateAppLabel() string {
+	return randomString(randLength)
+}
+
+// generateConnID returns a random ID used to correlate log lines of a websocket connection
+func generateConnID() string {
+	return randomString(connIDRandLength)
+}
+
+func getTarPaths(ctx context.Context, logger *logrus.Entry, conn *wsConn, url string) (*ProwInfo, error) {
 	// If we got a URL directly to a tar, just use it
 	if strings.HasSuffix(url, ".tar") {
 		sendWSMessage(conn, "status", fmt.Sprintf("Found tardump at %s", url))
@@ -45,22 +55,23 @@ func getTarPaths(conn *websocket.Conn, url string) (*ProwInfo, error) {
 			ClusterDumpURLs: []string{
 				url,
 			},
+			Job: findJobInfo(ctx, logger, conn, url),
 		}, nil
 	}
 
 	// Otherwise we got a prow or gcsweb url, and we need to find our potential artifacts
 	sendWSMessage(conn, "status", fmt.Sprintf("Finding artifacts for %s", url))
 	// Get the URL for artifacts directory
-	artifactURL, err := findArtifactURL(url)
+	artifactURL, err := findArtifactURL(ctx, logger, url)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get artifact url: %+v", err)
 
 	}
 	sendWSMessage(conn, "status", fmt.Sprintf("Found artifact url: %s", artifactURL))
 
-	dumpURLs, err := findURLsRecursively(artifactURL, clusterDumps)
+	dumpURLs, err := findURLsRecursively(ctx, logger, artifactURL, clusterDumps)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't fetch urls:% +v")
+		return nil, fmt.Errorf("couldn't fetch urls: %+v", err)
 	}
 
 	for _, u := range dumpURLs {
@@ -69,11 +80,34 @@ func getTarPaths(conn *websocket.Conn, url string) (*ProwInfo, error) {
 
 	return &ProwInfo{
 		ClusterDumpURLs: dumpURLs,
+		Job:             findJobInfo(ctx, logger, conn, artifactURL),
 	}, nil
 }
 
-func newDocument(url string) (*goquery.Document, error) {
-	res, err := http.Get(url)
+// findJobInfo fetches metadata of the job which produced artifact at url, nil if it's not a Prow artifact
+func findJobInfo(ctx context.Context, logger *logrus.Entry, conn *wsConn, url string) *JobInfo {
+	rootURL, ok := jobRootURL(url)
+	if !ok {
+		return nil
+	}
+	job, err := fetchJobInfo(ctx, logger, rootURL)
+	if err != nil {
+		logger.WithError(err).Warn("failed to fetch job metadata")
+		return nil
+	}
+	sendWSMessage(conn, "status", fmt.Sprintf("Found job %s #%s", job.Job, job.BuildID))
+	return job
+}
+
+func newDocument(ctx context.Context, url string) (*goquery.Document, error) {
+	if err := checkDerivedURL(url); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -87,9 +121,12 @@ func newDocument(url string) (*goquery.Document, error) {
 }
 
 // findArtifactURL finds the "artifacts" directory path
-func findArtifactURL(bucketURL string) (string, error) {
-	log.Printf("finding artifacts url %s", bucketURL)
-	doc, err := newDocument(bucketURL)
+func findArtifactURL(ctx context.Context, logger *logrus.Entry, bucketURL string) (artifactURL string, err error) {
+	ctx, span := startSpan(ctx, "findArtifactURL", attrURL.String(bucketURL))
+	defer func() { endSpan(span, err) }()
+
+	logger.WithField("url", bucketURL).Debug("finding artifacts url")
+	doc, err := newDocument(ctx, bucketURL)
 	if err != nil {
 		return "", err
 	}
@@ -108,8 +145,8 @@ func findArtifactURL(bucketURL string) (string, error) {
 			if err != nil {
 				return "", err
 			}
-			log.Printf("have prow url, fetching gcsweb link")
-			return findArtifactURL(gcsURL)
+			logger.WithField("url", gcsURL).Debug("have prow url, fetching gcsweb link")
+			return findArtifactURL(ctx, logger, gcsURL)
 		}
 	}
 
@@ -122,12 +159,15 @@ func findArtifactURL(bucketURL string) (string, error) {
 }
 
 // find matching paths
-func findURLsRecursively(url string, paths []string) ([]string, error) {
-	log.Printf("processing %s", url)
-	doc, err := newDocument(url)
+func findURLsRecursively(ctx context.Context, logger *logrus.Entry, url string, paths []string) ([]string, error) {
+	logger.WithField("url", url).Debug("processing")
+	fetchCtx, span := startSpan(ctx, "findURLsRecursively", attrURL.String(url))
+	doc, err := newDocument(fetchCtx, url)
 	if err != nil {
+		endSpan(span, err)
 		return nil, err
 	}
+	endSpan(span, nil)
 	var urls []string
 
 	doc.Find("a").Each(func(_ int, s *goquery.Selection) {
@@ -136,7 +176,7 @@ func findURLsRecursively(url string, paths []string) ([]string, error) {
 				pathURL, _ := s.Attr("href")
 				pathURL, err = joinWithBaseURL(url, pathURL)
 				if err != nil {
-					log.Printf("couldn't build url: %+v", err)
+					logger.WithError(err).Warn("couldn't build url")
 					continue
 				}
 
@@ -148,9 +188,9 @@ func findURLsRecursively(url string, paths []string) ([]string, error) {
 			subURL, exists := s.Attr("href")
 			if exists && !isIgnoredPath(subURL) {
 				subURL, _ = joinWithBaseURL(url, subURL)
-				results, err := findURLsRecursively(subURL, paths)
+				results, err := findURLsRecursively(ctx, logger, subURL, paths)
 				if err != nil {
-					log.Printf("encountered error at %s: %+v", subURL, err)
+					logger.WithError(err).WithField("url", subURL).Warn("encountered error while crawling")
 					return
 				}
 
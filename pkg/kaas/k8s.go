@@ -1,18 +1,15 @@
 package kaas
 
 import (
-	"bytes"
 	"context"
-	"errors"
 	"fmt"
-	"io"
-	"log"
 	"math/rand"
 	"strings"
 	"time"
 
 	routeApi "github.com/openshift/api/route/v1"
 	routeClient "github.com/openshift/client-go/route/clientset/versioned/typed/route/v1"
+	"github.com/sirupsen/logrus"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -24,17 +21,6 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-const (
-	deploymentRolloutTime = 5 * time.Minute
-	deploymentLifetime    = 8 * time.Hour
-	kasImage              = "kaas:static-kas"
-	ciFetcherImage        = "registry.access.redhat.com/ubi8/ubi:8.5"
-)
-
-var (
-	ErrorContainerLog = errors.New("failed to start prometheus")
-)
-
 func buildConfig(kubeconfig string) (*rest.Config, error) {
 	if kubeconfig != "" {
 		return clientcmd.BuildConfigFromFlags("", kubeconfig)
@@ -43,7 +29,7 @@ func buildConfig(kubeconfig string) (*rest.Config, error) {
 }
 
 // TryLogin returns k8s clientset and route client
-func TryLogin(kubeconfigPath string) (*k8s.Clientset, *routeClient.RouteV1Client, error) {
+func TryLogin(kubeconfigPath string) (k8s.Interface, routeClient.RouteV1Interface, error) {
 	config, err := buildConfig(kubeconfigPath)
 	if err != nil {
 		return nil, nil, err
@@ -68,11 +54,20 @@ func TryLogin(kubeconfigPath string) (*k8s.Clientset, *routeClient.RouteV1Client
 
 }
 
-func (s *ServerSettings) launchKASApp(appLabel string, tarBall string) (string, string, error) {
+func (c *Cluster) launchKASApp(ctx context.Context, logger *logrus.Entry, appLabel string, spec instanceSpec) (_ *instanceURLs, err error) {
+	tarBalls := spec.Dumps
+	ctx, launchSpan := startSpan(ctx, "launchKASApp", attrInstance.String(appLabel), attrURL.StringSlice(tarBalls))
+	defer func() { endSpan(launchSpan, err) }()
+
+	cfg := c.Config()
 	replicas := int32(1)
-	sharePIDNamespace := true
-	ctx := context.TODO()
 	createOpts := metav1.CreateOptions{}
+	endpoints := newInstanceEndpoints(tarBalls, spec.HostedClusters)
+	companions := map[string]string{}
+
+	if err := c.createNetworkPolicy(ctx, logger, appLabel); err != nil {
+		return nil, err
+	}
 
 	// Create service and route and fetch the host
 	service := &corev1.Service{
@@ -83,92 +78,201 @@ func (s *ServerSettings) launchKASApp(appLabel string, tarBall string) (string,
 			},
 		},
 		Spec: corev1.ServiceSpec{
-			Ports: []corev1.ServicePort{
-				{
-					Port:     8080,
-					Protocol: corev1.ProtocolTCP,
-					Name:     "api",
-				},
-				{
-					Port:     9000,
-					Protocol: corev1.ProtocolTCP,
-					Name:     "console",
-				},
-			},
 			Selector: map[string]string{
 				"app": appLabel,
 			},
 		},
 	}
-	_, err := s.K8sClient.CoreV1().Services(s.Namespace).Create(ctx, service, createOpts)
+	for i := range endpoints {
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+			Port:     int32(kasPort + i),
+			Protocol: corev1.ProtocolTCP,
+			Name:     "api" + endpointSuffix(i),
+		})
+		if !spec.Headless {
+			service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+				Port:     int32(consolePort + i),
+				Protocol: corev1.ProtocolTCP,
+				Name:     "console" + endpointSuffix(i),
+			})
+		}
+	}
+	if spec.PrometheusTarball != "" {
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+			Port:     prometheusPort,
+			Protocol: corev1.ProtocolTCP,
+			Name:     "prometheus",
+		})
+		if spec.Grafana {
+			service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+				Port:     grafanaPort,
+				Protocol: corev1.ProtocolTCP,
+				Name:     "grafana",
+			})
+		}
+	}
+	spanCtx, span := startSpan(ctx, "create service", attrObject.String(service.Name))
+	_, err = c.K8sClient.CoreV1().Services(c.Namespace).Create(spanCtx, service, createOpts)
+	endSpan(span, err)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create new service: %s", err.Error())
+		return nil, fmt.Errorf("failed to create new service: %w", err)
 	}
+	logger.WithField("service", service.Name).Debug("created service")
 
-	kasAPIRoute := &routeApi.Route{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: fmt.Sprintf("%s-api", appLabel),
-			Labels: map[string]string{
-				"app": appLabel,
-			},
-		},
-		Spec: routeApi.RouteSpec{
-			To: routeApi.RouteTargetReference{
-				Kind: "Service",
-				Name: appLabel,
-			},
-			Port: &routeApi.RoutePort{
-				TargetPort: intstr.FromInt(8080),
-			},
-			TLS: &routeApi.TLSConfig{
-				Termination:                   routeApi.TLSTerminationEdge,
-				InsecureEdgeTerminationPolicy: routeApi.InsecureEdgeTerminationPolicyRedirect,
-			},
-		},
+	for i := range endpoints {
+		endpoints[i].APIURL, err = c.createRoute(ctx, logger, fmt.Sprintf("%s-api%s", appLabel, endpointSuffix(i)), appLabel, "", kasPort+i)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Headless {
+			continue
+		}
+		endpoints[i].ConsoleURL, err = c.createRoute(ctx, logger, fmt.Sprintf("%s-console%s", appLabel, endpointSuffix(i)), appLabel, "/", consolePort+i)
+		if err != nil {
+			return nil, err
+		}
 	}
-	apiRoute, err := s.RouteClient.Routes(s.Namespace).Create(ctx, kasAPIRoute, createOpts)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create route: %v", err)
+	if spec.PrometheusTarball != "" {
+		companions[companionPrometheus], err = c.createRoute(ctx, logger, fmt.Sprintf("%s-prometheus", appLabel), appLabel, "", prometheusPort)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Grafana {
+			companions[companionGrafana], err = c.createRoute(ctx, logger, fmt.Sprintf("%s-grafana", appLabel), appLabel, "", grafanaPort)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
-	externalAPIURL := fmt.Sprintf("https://%s", apiRoute.Spec.Host)
-	consoleAPIRoute := &routeApi.Route{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: fmt.Sprintf("%s-console", appLabel),
-			Labels: map[string]string{
-				"app": appLabel,
+
+	initContainers := []corev1.Container{}
+	volumes := []corev1.Volume{}
+	readOnly := make([]bool, len(tarBalls))
+	for d, tarBall := range tarBalls {
+		suffix := endpointSuffix(d)
+		volumeName := "must-gather-volume" + suffix
+
+		// Hypershift dumps are served from the root and from hosted cluster directories,
+		// other dumps are moved out of their top level directory
+		cmdStr := "true"
+		if !isHypershiftDump(tarBall) {
+			cmdStr = "mv */* ."
+		}
+
+		tier := spec.dumpTier(cfg, d)
+		dumpVol := c.dumpVolume(ctx, logger, appLabel, tarBall, tier)
+		readOnly[d] = !dumpVol.populate
+		if tier != nil && tier.EphemeralStorage != "" && dumpVol.source.EmptyDir != nil {
+			sizeLimit := resource.MustParse(tier.EphemeralStorage)
+			dumpVol.source.EmptyDir.SizeLimit = &sizeLimit
+		}
+		if dumpVol.populate {
+			initContainers = append(initContainers, corev1.Container{
+				Name:  "ci-fetcher" + suffix,
+				Image: cfg.Images.CIFetcher,
+				Command: []string{
+					"/bin/bash",
+					"-c",
+					fetcherScript(cmdStr, dumpVol.cached),
+				},
+				WorkingDir: "/must-gather/",
+				Env: []corev1.EnvVar{
+					{
+						Name:  "DUMPTAR",
+						Value: spec.dumpSource(d),
+					},
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{
+						Name:      volumeName,
+						MountPath: "/must-gather/",
+					},
+				},
+			})
+		}
+		volumes = append(volumes, corev1.Volume{
+			Name:         volumeName,
+			VolumeSource: dumpVol.source,
+		})
+	}
+
+	containers := []corev1.Container{}
+	for i, endpoint := range endpoints {
+		suffix := endpointSuffix(i)
+		// Extracted dump is accounted to the first container serving it
+		ephemeral := !readOnly[endpoint.dumpIndex] && (i == 0 || endpoints[i-1].dumpIndex != endpoint.dumpIndex)
+		containers = append(containers, corev1.Container{
+			Name:  "kas" + suffix,
+			Image: cfg.Images.KAS,
+			Ports: []corev1.ContainerPort{
+				{
+					Name:          "api" + suffix,
+					Protocol:      corev1.ProtocolTCP,
+					ContainerPort: int32(kasPort + i),
+				},
 			},
-		},
-		Spec: routeApi.RouteSpec{
-			Path: "/",
-			To: routeApi.RouteTargetReference{
-				Kind: "Service",
-				Name: appLabel,
+			Args: kasArgs(i, endpoint.baseDir),
+			ReadinessProbe: &corev1.Probe{
+				TimeoutSeconds:   1,
+				PeriodSeconds:    10,
+				SuccessThreshold: 1,
+				FailureThreshold: 3,
+				Handler: corev1.Handler{
+					HTTPGet: &corev1.HTTPGetAction{
+						Path:   "/version",
+						Port:   intstr.FromInt(kasPort + i),
+						Scheme: "HTTP",
+					},
+				},
 			},
-			Port: &routeApi.RoutePort{
-				TargetPort: intstr.FromInt(9000),
+			Resources: kasResources(cfg, spec.dumpTier(cfg, endpoint.dumpIndex), ephemeral),
+			VolumeMounts: []corev1.VolumeMount{
+				{
+					Name:      "must-gather-volume" + endpointSuffix(endpoint.dumpIndex),
+					MountPath: "/must-gather/",
+					ReadOnly:  readOnly[endpoint.dumpIndex],
+				},
 			},
-			TLS: &routeApi.TLSConfig{
-				Termination:                   routeApi.TLSTerminationEdge,
-				InsecureEdgeTerminationPolicy: routeApi.InsecureEdgeTerminationPolicyRedirect,
+		})
+		if spec.Headless {
+			continue
+		}
+		containers = append(containers, corev1.Container{
+			Name:  "console" + suffix,
+			Image: spec.consoleImage(cfg, endpoint.dumpIndex),
+			Ports: []corev1.ContainerPort{
+				{
+					Name:          "ui" + suffix,
+					Protocol:      corev1.ProtocolTCP,
+					ContainerPort: int32(consolePort + i),
+				},
 			},
-		},
+			Args:      consoleArgs(i),
+			Resources: cfg.Resources.Console.requirements(),
+		})
 	}
-	consoleRoute, err := s.RouteClient.Routes(s.Namespace).Create(ctx, consoleAPIRoute, createOpts)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create route: %v", err)
-	}
-	consoleURL := fmt.Sprintf("https://%s", consoleRoute.Spec.Host)
 
-	cmdStr := ""
-	if strings.Contains(tarBall, "hypershift-dump.tar") {
-		// Hypershift dumps contain two sets of resources, one from the management cluster in the root,
-		// and the other from the hosted cluster in hostedcluster-XXXXXX. static-kas doesn't understand this,
-		// so we merge them together.
-		cmdStr = `cp -rfv hostedcluster-*/cluster-scoped-resources/* cluster-scoped-resources/ && \
-                  cp -rfv hostedcluster-*/namespaces/* namespaces/ && \
-                  rm -rf hostedcluster-*`
-	} else {
-		cmdStr = "mv */* ."
+	if spec.PrometheusTarball != "" {
+		fetcher, prometheus, volume := prometheusContainers(cfg, spec.PrometheusTarball)
+		initContainers = append(initContainers, fetcher)
+		containers = append(containers, prometheus)
+		volumes = append(volumes, volume)
+
+		if spec.Grafana {
+			grafanaCM, err := grafanaConfigMap(appLabel, spec.Job)
+			if err != nil {
+				return nil, fmt.Errorf("failed to render grafana config: %w", err)
+			}
+			spanCtx, span := startSpan(ctx, "create config map", attrObject.String(grafanaCM.Name))
+			_, err = c.K8sClient.CoreV1().ConfigMaps(c.Namespace).Create(spanCtx, grafanaCM, createOpts)
+			endSpan(span, err)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create grafana config: %w", err)
+			}
+			grafana, volume := grafanaContainer(cfg, appLabel)
+			containers = append(containers, grafana)
+			volumes = append(volumes, volume)
+		}
 	}
 
 	// Declare and create new deployment
@@ -196,214 +300,146 @@ func (s *ServerSettings) launchKASApp(appLabel string, tarBall string) (string,
 					},
 				},
 				Spec: corev1.PodSpec{
-					InitContainers: []corev1.Container{
-						{
-							Name:  "ci-fetcher",
-							Image: ciFetcherImage,
-							Command: []string{
-								"/bin/bash",
-								"-c",
-								`set -uxo pipefail && \
-								umask 0000 && \
-								curl -sL ${DUMPTAR} | tar xvz -m --no-overwrite-dir --checkpoint=.100 && ` +
-									cmdStr,
-							},
-							WorkingDir: "/must-gather/",
-							Env: []corev1.EnvVar{
-								{
-									Name:  "DUMPTAR",
-									Value: tarBall,
-								},
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "must-gather-volume",
-									MountPath: "/must-gather/",
-								},
-							},
-						},
-					},
-					Containers: []corev1.Container{
-						{
-							Name:  "kas",
-							Image: kasImage,
-							Ports: []corev1.ContainerPort{
-								{
-									Name:          "api",
-									Protocol:      corev1.ProtocolTCP,
-									ContainerPort: 8080,
-								},
-							},
-							Args: []string{
-								"--base-dir",
-								"/must-gather/",
-							},
-							ReadinessProbe: &corev1.Probe{
-								TimeoutSeconds:   1,
-								PeriodSeconds:    10,
-								SuccessThreshold: 1,
-								FailureThreshold: 3,
-								Handler: corev1.Handler{
-									HTTPGet: &corev1.HTTPGetAction{
-										Path:   "/version",
-										Port:   intstr.FromInt(8080),
-										Scheme: "HTTP",
-									},
-								},
-							},
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{
-									"cpu":    resource.MustParse("100m"),
-									"memory": resource.MustParse("500Mi"),
-								},
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "must-gather-volume",
-									MountPath: "/must-gather/",
-								},
-							},
-						}, {
-							Name:  "console",
-							Image: "quay.io/openshift/origin-console:latest",
-							Ports: []corev1.ContainerPort{
-								{
-									Name:          "ui",
-									Protocol:      corev1.ProtocolTCP,
-									ContainerPort: 9000,
-								},
-							},
-							Args: []string{
-								"/opt/bridge/bin/bridge",
-								"--public-dir=/opt/bridge/static",
-								"--k8s-mode=off-cluster",
-								fmt.Sprintf("--k8s-mode-off-cluster-endpoint=%s", externalAPIURL),
-								"--user-auth=disabled",
-								"--k8s-auth=bearer-token",
-								"--k8s-auth-bearer-token=dummy",
-								"--user-settings-location=localstorage",
-							},
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{
-									"cpu":    resource.MustParse("100m"),
-									"memory": resource.MustParse("500Mi"),
-								},
-							},
-						},
-					},
-					ShareProcessNamespace: &sharePIDNamespace,
-					Volumes: []corev1.Volume{
-						{
-							Name: "must-gather-volume",
-							VolumeSource: corev1.VolumeSource{
-								EmptyDir: &corev1.EmptyDirVolumeSource{},
-							},
-						},
-					},
+					InitContainers: initContainers,
+					Containers:     containers,
+					Volumes:        volumes,
 				},
 			},
 		},
 	}
-	_, err = s.K8sClient.AppsV1().Deployments(s.Namespace).Create(ctx, deployment, createOpts)
+	if c.server.Template != nil {
+		vars := TemplateVars{
+			AppLabel:  appLabel,
+			Cluster:   c.Name,
+			Region:    c.Region,
+			Namespace: c.Namespace,
+			DumpURL:   tarBalls[0],
+			DumpURLs:  tarBalls,
+			APIURL:    endpoints[0].APIURL,
+			Job:       spec.Job,
+		}
+		for _, endpoint := range endpoints {
+			vars.APIURLs = append(vars.APIURLs, endpoint.APIURL)
+		}
+		deployment, err = c.server.Template.apply(deployment, vars)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply instance template: %w", err)
+		}
+	}
+	hardenPodSpec(&deployment.Spec.Template.Spec)
+	spanCtx, span = startSpan(ctx, "create deployment", attrObject.String(deployment.Name))
+	_, err = c.K8sClient.AppsV1().Deployments(c.Namespace).Create(spanCtx, deployment, createOpts)
+	endSpan(span, err)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create new deployment: %s", err.Error())
+		return nil, fmt.Errorf("failed to create new deployment: %w", err)
 	}
+	logger.WithField("deployment", deployment.Name).Info("created deployment")
 
-	return externalAPIURL, consoleURL, nil
+	return &instanceURLs{Endpoints: endpoints, Companions: companions}, nil
 }
 
-func (s *ServerSettings) waitForDeploymentReady(ctx context.Context, appLabel string) error {
-	deploymentName := fmt.Sprintf("%s-kas", appLabel)
-	log.Printf("watching deployment %s", deploymentName)
-	watcher, err := s.K8sClient.AppsV1().Deployments(s.Namespace).Watch(ctx, metav1.ListOptions{})
+// createRoute exposes the service port of the instance and returns the external URL
+func (c *Cluster) createRoute(ctx context.Context, logger *logrus.Entry, name, appLabel, path string, port int) (string, error) {
+	route := &routeApi.Route{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"app": appLabel,
+			},
+		},
+		Spec: routeApi.RouteSpec{
+			Path: path,
+			To: routeApi.RouteTargetReference{
+				Kind: "Service",
+				Name: appLabel,
+			},
+			Port: &routeApi.RoutePort{
+				TargetPort: intstr.FromInt(port),
+			},
+			TLS: &routeApi.TLSConfig{
+				Termination:                   routeApi.TLSTerminationEdge,
+				InsecureEdgeTerminationPolicy: routeApi.InsecureEdgeTerminationPolicyRedirect,
+			},
+		},
+	}
+	for k, v := range c.RouteLabels {
+		if k != appLabelKey {
+			route.Labels[k] = v
+		}
+	}
+	if c.RouteDomain != "" {
+		route.Spec.Host = fmt.Sprintf("%s.%s", name, c.RouteDomain)
+	}
+	spanCtx, span := startSpan(ctx, "create route", attrObject.String(route.Name))
+	created, err := c.RouteClient.Routes(c.Namespace).Create(spanCtx, route, metav1.CreateOptions{})
+	endSpan(span, err)
 	if err != nil {
-		return fmt.Errorf("failed to fetch deployment: %v", err)
+		return "", fmt.Errorf("failed to create route: %w", err)
 	}
-	defer watcher.Stop()
+	logger.WithField("route", created.Name).Debug("created route")
+	return fmt.Sprintf("https://%s", created.Spec.Host), nil
+}
 
-	timer := time.NewTimer(deploymentRolloutTime)
+func (c *Cluster) waitForDeploymentReady(ctx context.Context, logger *logrus.Entry, appLabel string) (err error) {
+	ctx, span := startSpan(ctx, "waitForDeploymentReady", attrInstance.String(appLabel))
+	defer func() { endSpan(span, err) }()
+
+	deploymentName := fmt.Sprintf("%s-kas", appLabel)
+	logger = logger.WithField("deployment", deploymentName)
+	if c.tracker == nil {
+		return fmt.Errorf("instance tracker is not running")
+	}
+	logger.Debug("waiting for deployment")
+	updates := c.tracker.subscribe(appLabel)
+	defer c.tracker.unsubscribe(appLabel, updates)
+
+	timer := time.NewTimer(c.Config().RolloutTimeout.Duration)
+	defer timer.Stop()
+	recheck := time.NewTicker(readinessRecheckInterval)
+	defer recheck.Stop()
 	for {
+		ready, err := c.tracker.instanceReady(logger, appLabel)
+		if err != nil {
+			logger.WithError(err).Warn("instance failed")
+			return c.diagnoseInstance(ctx, logger, appLabel, err)
+		}
+		if ready {
+			return nil
+		}
+
 		select {
-		case event := <-watcher.ResultChan():
-			deployment, ok := event.Object.(*appsv1.Deployment)
+		case _, ok := <-updates:
 			if !ok {
-				log.Printf("invalid object watched: %#v", deployment)
-				continue
-			}
-			log.Printf("deployment status: %#v", deployment.Status)
-			if deployment.Status.AvailableReplicas == 1 {
-				return nil
+				return fmt.Errorf("stopped waiting for deployment %s: kaas is shutting down", deploymentName)
 			}
+		case <-recheck.C:
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-timer.C:
-			log.Printf("timed out waiting for deployment %s to rollout", deploymentName)
-			// Find the pod created by this deployment
-			listOpts := metav1.ListOptions{
-				LabelSelector: fmt.Sprintf("app=%s", appLabel),
-			}
-			podList, err := s.K8sClient.CoreV1().Pods(s.Namespace).List(ctx, listOpts)
-			if err != nil {
-				return fmt.Errorf("error finding pods created by deployment %s: %v, please report this to #forum-crt", deploymentName, err)
-			}
-			if podList.Items == nil || len(podList.Items) < 1 {
-				return fmt.Errorf("failed to list pods created by deployment %s: %#v, please report this to #forum-crt", deploymentName, podList)
-			}
-			pod := podList.Items[0] // We only create one pod
-
-			// Find the failing container in initContainers or containers
-			failingContainerName := ""
-			for _, initContainerStatus := range pod.Status.InitContainerStatuses {
-				if !initContainerStatus.Ready {
-					failingContainerName = initContainerStatus.Name
-					break
-				}
-			}
-			if failingContainerName == "" {
-				for _, containerStatus := range pod.Status.ContainerStatuses {
-					if !containerStatus.Ready {
-						failingContainerName = containerStatus.Name
-						break
-					}
-				}
-			}
-			if failingContainerName == "" {
-				return fmt.Errorf("failed to find failing container in pod %s created by deployment %s: %v, please report this to #forum-crt", pod.Name, deploymentName, err)
-			}
-
-			// Fetch container logs
-			podLogOptions := corev1.PodLogOptions{
-				Container: failingContainerName,
-				Follow:    false,
-			}
-			req := s.K8sClient.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &podLogOptions)
-			podLogs, err := req.Stream(ctx)
-			if err != nil {
-				return fmt.Errorf("error opening stream to fetch failing logs in pod %s created by deployment %s: %v, please report this to #forum-crt", pod.Name, deploymentName, err)
-			}
-			defer podLogs.Close()
-
-			buf := new(bytes.Buffer)
-			_, err = io.Copy(buf, podLogs)
-			if err != nil {
-				return fmt.Errorf("error copying logs in pod %s created by deployment %s: %v, please report this to #forum-crt", pod.Name, deploymentName, err)
-			}
-			return fmt.Errorf("%w:\n%s", ErrorContainerLog, buf.String())
+			logger.Warn("timed out waiting for deployment to rollout")
+			return c.diagnoseInstance(ctx, logger, appLabel, nil)
 		}
 	}
 }
 
-func (s *ServerSettings) deletePods(appLabel string) (string, error) {
+// deletePods removes all instance resources. Instance record is preserved if keepRecord is set
+func (c *Cluster) deletePods(ctx context.Context, logger *logrus.Entry, appLabel string, keepRecord bool) (_ string, err error) {
+	ctx, span := startSpan(ctx, "deletePods", attrInstance.String(appLabel))
+	defer func() { endSpan(span, err) }()
+
 	actionLog := []string{}
-	ctx := context.TODO()
-	delOptions := metav1.DeleteOptions{}
+	// Remove pods before the deployment is gone, so that instance could be recreated with the same label
+	propagation := metav1.DeletePropagationForeground
+	delOptions := metav1.DeleteOptions{PropagationPolicy: &propagation}
 
 	// Delete service
 	listOpts := metav1.ListOptions{LabelSelector: fmt.Sprintf("app=%s", appLabel)}
-	svcList, err := s.K8sClient.CoreV1().Services(s.Namespace).List(ctx, listOpts)
-	if err != nil || svcList.Items == nil {
+	svcList, err := c.K8sClient.CoreV1().Services(c.Namespace).List(ctx, listOpts)
+	if err != nil {
 		return "", fmt.Errorf("failed to find services: %v", err)
 	}
 	for _, svc := range svcList.Items {
-		err := s.K8sClient.CoreV1().Services(s.Namespace).Delete(ctx, svc.Name, delOptions)
+		err := c.K8sClient.CoreV1().Services(c.Namespace).Delete(ctx, svc.Name, delOptions)
 		if err != nil {
 			return strings.Join(actionLog, "\n"),
 				fmt.Errorf("error removing service %s: %v", svc.Name, err)
@@ -412,12 +448,12 @@ func (s *ServerSettings) deletePods(appLabel string) (string, error) {
 	}
 
 	// Delete deployment
-	depList, err := s.K8sClient.AppsV1().Deployments(s.Namespace).List(ctx, listOpts)
-	if err != nil || depList.Items == nil {
+	depList, err := c.K8sClient.AppsV1().Deployments(c.Namespace).List(ctx, listOpts)
+	if err != nil {
 		return "", fmt.Errorf("failed to find deployments: %v", err)
 	}
 	for _, dep := range depList.Items {
-		err := s.K8sClient.AppsV1().Deployments(s.Namespace).Delete(ctx, dep.Name, delOptions)
+		err := c.K8sClient.AppsV1().Deployments(c.Namespace).Delete(ctx, dep.Name, delOptions)
 		if err != nil {
 			return strings.Join(actionLog, "\n"),
 				fmt.Errorf("error removing deployment %s: %v", dep.Name, err)
@@ -426,12 +462,15 @@ func (s *ServerSettings) deletePods(appLabel string) (string, error) {
 	}
 
 	// Delete configmap
-	cmList, err := s.K8sClient.CoreV1().ConfigMaps(s.Namespace).List(ctx, listOpts)
-	if err != nil || cmList.Items == nil {
+	cmList, err := c.K8sClient.CoreV1().ConfigMaps(c.Namespace).List(ctx, listOpts)
+	if err != nil {
 		return "", fmt.Errorf("failed to find config maps: %v", err)
 	}
 	for _, cm := range cmList.Items {
-		err := s.K8sClient.CoreV1().ConfigMaps(s.Namespace).Delete(ctx, cm.Name, delOptions)
+		if keepRecord && cm.Name == recordName(appLabel) {
+			continue
+		}
+		err := c.K8sClient.CoreV1().ConfigMaps(c.Namespace).Delete(ctx, cm.Name, delOptions)
 		if err != nil {
 			return strings.Join(actionLog, "\n"),
 				fmt.Errorf("error removing config map %s: %v", cm.Name, err)
@@ -440,12 +479,12 @@ func (s *ServerSettings) deletePods(appLabel string) (string, error) {
 	}
 
 	// Delete route
-	routeList, err := s.RouteClient.Routes(s.Namespace).List(ctx, listOpts)
-	if err != nil || routeList.Items == nil {
+	routeList, err := c.RouteClient.Routes(c.Namespace).List(ctx, listOpts)
+	if err != nil {
 		return "", fmt.Errorf("failed to find routes: %v", err)
 	}
 	for _, route := range routeList.Items {
-		err := s.RouteClient.Routes(s.Namespace).Delete(ctx, route.Name, delOptions)
+		err := c.RouteClient.Routes(c.Namespace).Delete(ctx, route.Name, delOptions)
 		if err != nil {
 			return strings.Join(actionLog, "\n"),
 				fmt.Errorf("error removing route %s: %v", route.Name, err)
@@ -453,73 +492,64 @@ func (s *ServerSettings) deletePods(appLabel string) (string, error) {
 		actionLog = append(actionLog, fmt.Sprintf("Removed route %s", route.Name))
 	}
 
+	// Delete network policy
+	policyList, err := c.K8sClient.NetworkingV1().NetworkPolicies(c.Namespace).List(ctx, listOpts)
+	if err != nil {
+		return "", fmt.Errorf("failed to find network policies: %v", err)
+	}
+	for _, policy := range policyList.Items {
+		err := c.K8sClient.NetworkingV1().NetworkPolicies(c.Namespace).Delete(ctx, policy.Name, delOptions)
+		if err != nil {
+			return strings.Join(actionLog, "\n"),
+				fmt.Errorf("error removing network policy %s: %v", policy.Name, err)
+		}
+		actionLog = append(actionLog, fmt.Sprintf("Removed network policy %s", policy.Name))
+	}
+
+	logger.WithField("actions", len(actionLog)).Info("removed instance resources")
 	return strings.Join(actionLog, "\n"), nil
 }
 
-// CleanupOldDeployements periodically removes old deployments
+// CleanupOldDeployements periodically removes old deployments in all connected clusters
 func (s *ServerSettings) CleanupOldDeployements() {
-	log.Println("Cleaning up old deployments")
+	for _, cluster := range s.connectedClusters() {
+		cluster.runtime.cleanup()
+	}
+}
+
+// cleanupOldDeployments removes instances of the cluster which outlived their lifetime
+func (c *Cluster) cleanupOldDeployments() {
+	logger := c.logger()
+	logger.Debug("cleaning up old deployments")
 	// List all deployments, find those which are older than n hours and call 'deletePods'
-	depsList, err := s.K8sClient.AppsV1().Deployments(s.Namespace).List(context.TODO(), metav1.ListOptions{})
-	if err != nil || depsList.Items == nil {
+	depsList, err := c.K8sClient.AppsV1().Deployments(c.Namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		logger.WithError(err).Warn("failed to list deployments for cleanup")
 		return
 	}
 	now := time.Now()
 	for _, dep := range depsList.Items {
-		log.Printf("Found %s", dep.Name)
+		depLogger := logger.WithField("deployment", dep.Name)
 		// Get dep label and create time
 		appLabel, ok := dep.Labels["app"]
 		if !ok {
-			log.Println("Deployment has no appLabel, skipping")
+			depLogger.Debug("deployment has no app label, skipping")
 			// Deployment has no app label
 			continue
 		}
-		createdAt := dep.GetCreationTimestamp()
-		if now.After(createdAt.Add(deploymentLifetime)) {
-			log.Println("Deployment will be garbage collected")
-			go s.deletePods(appLabel)
+		depLogger = depLogger.WithField(logFieldInstance, appLabel)
+		if c.instanceExpired(context.TODO(), appLabel, dep.GetCreationTimestamp().Time, now) {
+			depLogger.Info("deployment will be garbage collected")
+			go func() {
+				if _, err := c.deletePods(context.Background(), depLogger, appLabel, false); err != nil {
+					depLogger.WithError(err).Error("failed to garbage collect deployment")
+				}
+			}()
 		} else {
-			log.Println("Deployment will live see another dawn")
+			depLogger.Debug("deployment will live see another dawn")
 		}
 	}
-}
-
-// GetResourceQuota updates current resource quota setting
-func (s *ServerSettings) GetResourceQuota() error {
-	rquota, err := s.K8sClient.CoreV1().ResourceQuotas(s.Namespace).Get(context.TODO(), s.RQuotaName, metav1.GetOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to get ResourceQuota: %v", err)
-	}
-	s.RQStatus = &RQuotaStatus{
-		Used: rquota.Status.Used.Pods().Value(),
-		Hard: rquota.Status.Hard.Pods().Value(),
-	}
-	s.sendResourceQuotaUpdate()
-	return nil
-}
 
-// WatchResourceQuota passes RQ updates from k8s to UI
-func (s *ServerSettings) WatchResourceQuota() {
-	for {
-		// TODO: Make sure we watch correct resourceQuota
-		watcher, err := s.K8sClient.CoreV1().ResourceQuotas(s.Namespace).Watch(context.TODO(), metav1.ListOptions{})
-		if err != nil {
-			log.Printf("Failed to setup ResourceQuota watcher: %v", err)
-			continue
-		}
-		ch := watcher.ResultChan()
-		for event := range ch {
-			rq, ok := event.Object.(*corev1.ResourceQuota)
-			if !ok || rq.Name != s.RQuotaName {
-				log.Printf("Skipping rq update: %v, %s", ok, rq.Name)
-				continue
-			}
-			s.RQStatus = &RQuotaStatus{
-				Used: rq.Status.Used.Pods().Value(),
-				Hard: rq.Status.Hard.Pods().Value(),
-			}
-			log.Printf("ResourceQuota update: %v", s.RQStatus)
-			s.sendResourceQuotaUpdate()
-		}
-	}
+	c.cleanupStaleRecords(logger)
+	c.evictCachedDumps(context.TODO(), logger, 0)
 }
@@ -0,0 +1,110 @@
+package kaas
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// testInstance returns the deployment and the record of an instance created at the given time
+func testInstance(appLabel string, created, acquired time.Time) []runtime.Object {
+	meta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         testNamespace,
+			Labels:            map[string]string{appLabelKey: appLabel},
+			CreationTimestamp: metav1.NewTime(created),
+		}
+	}
+	record := &corev1.ConfigMap{
+		ObjectMeta: meta(recordName(appLabel)),
+		Data: map[string]string{
+			recordState:      stateReady,
+			recordAcquiredAt: acquired.UTC().Format(time.RFC3339),
+		},
+	}
+	record.Labels[recordLabel] = "true"
+	return []runtime.Object{
+		&appsv1.Deployment{ObjectMeta: meta(appLabel + "-kas")},
+		&corev1.Service{ObjectMeta: meta(appLabel)},
+		record,
+	}
+}
+
+func TestCleanupOldDeployments(t *testing.T) {
+	now := time.Now()
+	lifetime := testConfig().Lifetime.Duration
+	objects := []runtime.Object{}
+	objects = append(objects, testInstance("expired", now.Add(-2*lifetime), now.Add(-2*lifetime))...)
+	objects = append(objects, testInstance("fresh", now.Add(-time.Minute), now.Add(-time.Minute))...)
+	// Shared instances live for the lifetime since they were last acquired
+	objects = append(objects, testInstance("shared", now.Add(-2*lifetime), now.Add(-time.Minute))...)
+	// Records of failed creations are removed once they outlive the lifetime
+	objects = append(objects, testInstance("failed", now.Add(-2*lifetime), now.Add(-2*lifetime))[2])
+	// Instances in use are kept until the max lifetime
+	maxLifetime := testConfig().MaxLifetime.Duration
+	for appLabel, created := range map[string]time.Time{"held": now.Add(-2 * lifetime), "held-too-long": now.Add(-maxLifetime - time.Minute)} {
+		instance := testInstance(appLabel, created, created)
+		instance[2].(*corev1.ConfigMap).Data[recordRefCount] = "2"
+		objects = append(objects, instance...)
+	}
+	env := newTestEnv(t, testConfig(), true, objects...)
+
+	// Records of instances are kept until the instances are removed
+	env.server.CleanupOldDeployements()
+	env.server.CleanupOldDeployements()
+
+	err := wait.PollImmediate(10*time.Millisecond, testReadTimeout, func() (bool, error) {
+		return !env.cluster.instanceExists("expired") && !env.cluster.instanceExists("held-too-long"), nil
+	})
+	if err != nil {
+		t.Fatalf("expected expired instances to be removed")
+	}
+	for _, appLabel := range []string{"fresh", "shared", "held"} {
+		if !env.cluster.instanceExists(appLabel) {
+			t.Errorf("expected instance %s to be kept", appLabel)
+		}
+		if _, err := env.cluster.runtime.getRecord(context.TODO(), appLabel); err != nil {
+			t.Errorf("expected record of instance %s to be kept: %v", appLabel, err)
+		}
+	}
+	if _, err := env.cluster.runtime.getRecord(context.TODO(), "failed"); err == nil {
+		t.Errorf("expected stale record to be removed")
+	}
+	err = wait.PollImmediate(10*time.Millisecond, testReadTimeout, func() (bool, error) {
+		_, err := env.kube.CoreV1().Services(testNamespace).Get(context.TODO(), "expired", metav1.GetOptions{})
+		return err != nil, nil
+	})
+	if err != nil {
+		t.Errorf("expected service of expired instance to be removed")
+	}
+}
+
+func TestDeletePodsKeepsRecord(t *testing.T) {
+	now := time.Now()
+	env := newTestEnv(t, testConfig(), true, testInstance("app", now, now)...)
+
+	output, err := env.cluster.deletePods(context.TODO(), testLogger(), "app", true)
+	if err != nil {
+		t.Fatalf("failed to delete instance: %v\n%s", err, output)
+	}
+	if _, err := env.kube.AppsV1().Deployments(testNamespace).Get(context.TODO(), "app-kas", metav1.GetOptions{}); err == nil {
+		t.Errorf("expected deployment to be removed")
+	}
+	if _, err := env.cluster.runtime.getRecord(context.TODO(), "app"); err != nil {
+		t.Errorf("expected record to be kept: %v", err)
+	}
+
+	if _, err := env.cluster.deletePods(context.TODO(), testLogger(), "app", false); err != nil {
+		t.Fatalf("failed to delete instance: %v", err)
+	}
+	if _, err := env.cluster.runtime.getRecord(context.TODO(), "app"); err == nil {
+		t.Errorf("expected record to be removed")
+	}
+}
@@ -0,0 +1,272 @@
+package kaas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	routefake "github.com/openshift/client-go/route/clientset/versioned/fake"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	testNamespace   = "kaas"
+	testQuotaName   = "pod-quota"
+	testRouteDomain = "apps.example.com"
+	// testReadTimeout bounds waiting for a websocket message
+	testReadTimeout = 30 * time.Second
+)
+
+func TestMain(m *testing.M) {
+	// Local runtime tests run the test binary as static-kas
+	if mode := os.Getenv(fakeStaticKASEnv); mode != "" {
+		os.Exit(runFakeStaticKAS(mode, os.Args[1:]))
+	}
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// testConfig returns config of a headless server fetching from any host, with short timeouts
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Console = false
+	cfg.AllowedURLs = nil
+	cfg.RolloutTimeout = metav1.Duration{Duration: 5 * time.Second}
+	cfg.Retry.Backoff = metav1.Duration{Duration: 10 * time.Millisecond}
+	return cfg
+}
+
+func testLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logrus.NewEntry(logger)
+}
+
+// testEnv is a kaas server with a single target cluster backed by fake clientsets
+type testEnv struct {
+	server  *ServerSettings
+	cluster *Cluster
+	kube    *fake.Clientset
+	routes  *routefake.Clientset
+	ws      *httptest.Server
+}
+
+// newTestEnv starts a server with the tracker and quota of the fake cluster synced.
+// If rollout is set, instance deployments become available as soon as they're created
+func newTestEnv(t *testing.T, cfg Config, rollout bool, objects ...runtime.Object) *testEnv {
+	t.Helper()
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: testQuotaName, Namespace: testNamespace},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10")},
+			Used: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("0")},
+		},
+	}
+	kube := fake.NewSimpleClientset(append(objects, quota)...)
+	if rollout {
+		kube.PrependReactor("create", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			deployment := action.(k8stesting.CreateAction).GetObject().(*appsv1.Deployment)
+			deployment.Status.UpdatedReplicas = *deployment.Spec.Replicas
+			deployment.Status.AvailableReplicas = *deployment.Spec.Replicas
+			return false, nil, nil
+		})
+	}
+	routes := routefake.NewSimpleClientset()
+
+	env := &testEnv{
+		server: &ServerSettings{Log: testLogger()},
+		kube:   kube,
+		routes: routes,
+	}
+	env.server.SetConfig(cfg)
+	env.cluster = env.server.AddCluster(ClusterConfig{
+		Name:        "test",
+		Namespace:   testNamespace,
+		QuotaName:   testQuotaName,
+		RouteDomain: testRouteDomain,
+	})
+	env.cluster.K8sClient = kube
+	env.cluster.RouteClient = routes.RouteV1()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := env.cluster.StartInstanceTracker(ctx); err != nil {
+		t.Fatalf("failed to start instance tracker: %v", err)
+	}
+	if err := env.cluster.GetResourceQuota(); err != nil {
+		t.Fatalf("failed to get resource quota: %v", err)
+	}
+	env.cluster.MarkClientsReady()
+	env.cluster.quotaWatchLive.Store(true)
+
+	r := gin.New()
+	r.GET("/ws/status", env.server.HandleStatusViaWS)
+	env.ws = httptest.NewServer(r)
+	t.Cleanup(env.ws.Close)
+	return env
+}
+
+// dial opens a websocket connection to the server
+func (e *testEnv) dial(t *testing.T) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(e.ws.URL, "http")+"/ws/status", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to websocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// send writes the message to the websocket
+func send(t *testing.T, conn *websocket.Conn, m WSMessage) {
+	t.Helper()
+	if err := conn.WriteJSON(m); err != nil {
+		t.Fatalf("failed to send %s message: %v", m.Action, err)
+	}
+}
+
+// readUntil reads messages until one with any of actions arrives and returns all of them
+func readUntil(t *testing.T, conn *websocket.Conn, actions ...string) []WSMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(testReadTimeout))
+	messages := []WSMessage{}
+	for {
+		var m WSMessage
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatalf("failed to read message, got %v so far: %v", messages, err)
+		}
+		messages = append(messages, m)
+		for _, action := range actions {
+			if m.Action == action {
+				return messages
+			}
+		}
+	}
+}
+
+// lastMessage returns the last message in messages
+func lastMessage(messages []WSMessage) WSMessage {
+	return messages[len(messages)-1]
+}
+
+// findMessage returns the first message with the action, nil if there is none
+func findMessage(messages []WSMessage, action string) *WSMessage {
+	for i := range messages {
+		if messages[i].Action == action {
+			return &messages[i]
+		}
+	}
+	return nil
+}
+
+// artifactServer is a stand-in for Prow and gcsweb. Files are served at their paths, directories
+// ending with "/" list their children like gcsweb, "/view/gs/<path>" pages link to "/gcs/<path>/" like Prow
+type artifactServer struct {
+	*httptest.Server
+	files map[string][]byte
+	// redirects map paths to URLs they redirect to, they take precedence over files
+	redirects map[string]string
+}
+
+func newArtifactServer(t *testing.T, files map[string][]byte) *artifactServer {
+	t.Helper()
+	a := &artifactServer{files: files}
+	a.Server = httptest.NewServer(http.HandlerFunc(a.serve))
+	t.Cleanup(a.Close)
+	// The server listens on loopback, which kaas refuses to connect to otherwise
+	allowInternalServer(t, a.Server)
+	return a
+}
+
+// allowInternalServer exempts the test server from the internal address check until the test ends
+func allowInternalServer(t *testing.T, server *httptest.Server) {
+	address := server.Listener.Addr().String()
+	allowedInternalAddresses.Store(address, true)
+	t.Cleanup(func() { allowedInternalAddresses.Delete(address) })
+}
+
+func (a *artifactServer) serve(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	if target, ok := a.redirects[p]; ok {
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	if content, ok := a.files[p]; ok {
+		http.ServeContent(w, r, path.Base(p), time.Time{}, bytes.NewReader(content))
+		return
+	}
+	if strings.HasPrefix(p, "/view/gs/") {
+		fmt.Fprintf(w, `<html><body><a href="/gcs/%s/">Artifacts</a></body></html>`, strings.Trim(strings.TrimPrefix(p, "/view/gs/"), "/"))
+		return
+	}
+	if !strings.HasSuffix(p, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	children := map[string]bool{}
+	for file := range a.files {
+		if !strings.HasPrefix(file, p) {
+			continue
+		}
+		child := strings.TrimPrefix(file, p)
+		if i := strings.Index(child, "/"); i != -1 {
+			child = child[:i+1]
+		}
+		children[child] = true
+	}
+	if len(children) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	names := make([]string, 0, len(children))
+	for child := range children {
+		names = append(names, child)
+	}
+	sort.Strings(names)
+	fmt.Fprint(w, "<html><body>\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "<a href=\"%s%s\">%s</a>\n", p, name, name)
+	}
+	fmt.Fprint(w, "</body></html>\n")
+}
+
+// testJobRoot is the run directory of the job served by artifact server
+const testJobRoot = "/gcs/test-bucket/logs/periodic-e2e/1234/"
+
+// jobArtifacts returns files of a job run with dumps at the given paths relative to the artifacts directory
+func jobArtifacts(dumps ...string) map[string][]byte {
+	prowJob, _ := json.Marshal(ProwJob{
+		Spec:   ProwJobSpec{Job: "periodic-e2e", Type: "periodic"},
+		Status: ProwJobStatus{BuildID: "1234", State: "failure"},
+	})
+	files := map[string][]byte{
+		testJobRoot + "started.json":                []byte(`{"timestamp": 1700000000}`),
+		testJobRoot + "finished.json":               []byte(`{"timestamp": 1700003600, "result": "FAILURE"}`),
+		testJobRoot + "prowjob.json":                prowJob,
+		testJobRoot + "artifacts/e2e/build-log.txt": []byte("log"),
+	}
+	for _, dump := range dumps {
+		files[testJobRoot+"artifacts/"+dump] = []byte("dump archive")
+	}
+	return files
+}
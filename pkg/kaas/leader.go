@@ -0,0 +1,86 @@
+package kaas
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// leaderIdentity returns the identity of this replica in the leader lease, pod name with a random suffix
+func leaderIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "kaas"
+	}
+	return fmt.Sprintf("%s_%s", hostname, randomString(randLength))
+}
+
+// IsLeader reports whether this replica runs background jobs
+func (s *ServerSettings) IsLeader() bool {
+	return s.leader.Load()
+}
+
+// RunWhileLeader runs leaderJobs while this replica holds the leader Lease in the home cluster, so that background jobs
+// like cleanups run in one replica only. leaderJobs context is cancelled once the lease is lost,
+// and the replica competes for the lease again. The lease is released when ctx is done
+func (s *ServerSettings) RunWhileLeader(ctx context.Context, leaseName string, leaderJobs func(ctx context.Context)) {
+	home := s.homeCluster()
+	identity := leaderIdentity()
+	logger := s.logger().WithFields(logrus.Fields{
+		"lease":    leaseName,
+		"identity": identity,
+	})
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaseName,
+			Namespace: home.Namespace,
+		},
+		Client: home.K8sClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+	for ctx.Err() == nil {
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			ReleaseOnCancel: true,
+			Name:            leaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(leaderCtx context.Context) {
+					s.leader.Store(true)
+					logger.Info("became leader, starting background jobs")
+					leaderJobs(leaderCtx)
+				},
+				OnStoppedLeading: func() {
+					s.leader.Store(false)
+					logger.Info("stopped leading")
+				},
+				OnNewLeader: func(current string) {
+					if current != identity {
+						logger.WithField("leader", current).Debug("observed leader")
+					}
+				},
+			},
+		})
+		if err != nil {
+			logger.WithError(err).Error("failed to setup leader election")
+			return
+		}
+		elector.Run(ctx)
+	}
+}
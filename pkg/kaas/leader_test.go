@@ -0,0 +1,97 @@
+package kaas
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const testLeaseName = "kaas-leader"
+
+func TestRunWhileLeader(t *testing.T) {
+	env := newTestEnv(t, testConfig(), true)
+	ctx, cancel := context.WithCancel(context.Background())
+	leading := make(chan struct{})
+	jobsStopped := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		env.server.RunWhileLeader(ctx, testLeaseName, func(leaderCtx context.Context) {
+			close(leading)
+			<-leaderCtx.Done()
+			close(jobsStopped)
+		})
+		close(stopped)
+	}()
+
+	select {
+	case <-leading:
+	case <-time.After(testReadTimeout):
+		cancel()
+		t.Fatalf("expected replica to become leader")
+	}
+	if !env.server.IsLeader() {
+		t.Errorf("expected replica to report leadership")
+	}
+	leases := env.kube.CoordinationV1().Leases(testNamespace)
+	lease, err := leases.Get(context.TODO(), testLeaseName, metav1.GetOptions{})
+	if err != nil || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+		t.Fatalf("expected lease to be held, got %+v: %v", lease, err)
+	}
+
+	cancel()
+	<-jobsStopped
+	<-stopped
+	if env.server.IsLeader() {
+		t.Errorf("expected replica not to be leader once stopped")
+	}
+	lease, err = leases.Get(context.TODO(), testLeaseName, metav1.GetOptions{})
+	if err != nil || (lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != "") {
+		t.Errorf("expected lease to be released, got %+v: %v", lease, err)
+	}
+}
+
+func TestRunWhileLeaderWaitsForLease(t *testing.T) {
+	holder := "other-replica"
+	duration := int32(leaseDuration / time.Second)
+	now := metav1.NewMicroTime(time.Now())
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: testLeaseName, Namespace: testNamespace},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}
+	env := newTestEnv(t, testConfig(), true, lease)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	env.server.RunWhileLeader(ctx, testLeaseName, func(context.Context) {
+		t.Errorf("expected jobs not to run while another replica holds the lease")
+	})
+	if env.server.IsLeader() {
+		t.Errorf("expected replica not to be leader")
+	}
+}
+
+func TestResumeInterruptedSkipsResumingInstances(t *testing.T) {
+	objects := testInstance("stuck", time.Now(), time.Now())[1:]
+	objects[0].(*corev1.Service).Annotations = map[string]string{interruptedAnnotation: "true"}
+	env := newTestEnv(t, testConfig(), true, objects...)
+	env.server.resuming.Store("stuck", struct{}{})
+
+	env.server.ResumeInterrupted(context.Background())
+	err := wait.PollImmediate(10*time.Millisecond, 200*time.Millisecond, func() (bool, error) {
+		_, err := env.kube.CoreV1().Services(testNamespace).Get(context.TODO(), "stuck", metav1.GetOptions{})
+		return err != nil, nil
+	})
+	if err == nil {
+		t.Errorf("expected instance resumed by another goroutine not to be resumed again")
+	}
+}
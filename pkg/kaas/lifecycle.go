@@ -0,0 +1,212 @@
+package kaas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// interruptedAnnotation marks services of instances which were being created when kaas was stopped
+	interruptedAnnotation = "kaas.openshift.io/interrupted"
+)
+
+var (
+	ErrShuttingDown = errors.New("kaas is shutting down, please retry in a minute")
+	ErrNotReady     = errors.New("kaas is not connected to target clusters yet, please retry in a minute")
+)
+
+// MarkClientsReady records that Kubernetes clients were created and the cluster API is reachable
+func (c *Cluster) MarkClientsReady() {
+	c.clientsReady.Store(true)
+}
+
+// Ready returns nil if the server can handle new instances in at least one cluster
+func (s *ServerSettings) Ready() error {
+	if s.draining.Load() {
+		return ErrShuttingDown
+	}
+	connected := s.connectedClusters()
+	if len(connected) == 0 {
+		return ErrNotReady
+	}
+	for _, cluster := range connected {
+		if cluster.quotaWatchLive.Load() {
+			return nil
+		}
+	}
+	return fmt.Errorf("resource quota watch is not established")
+}
+
+// HandleReadyz is k8s endpoint for readiness check
+func (s *ServerSettings) HandleReadyz(c *gin.Context) {
+	if err := s.Ready(); err != nil {
+		c.String(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	c.String(http.StatusOK, "")
+}
+
+// beginCreation registers an in-flight instance creation in the cluster. It returns an error if new instances can't be created
+func (s *ServerSettings) beginCreation(appLabel string, cluster *Cluster) error {
+	s.inflightLock.Lock()
+	defer s.inflightLock.Unlock()
+
+	if s.draining.Load() {
+		return ErrShuttingDown
+	}
+	if !cluster.clientsReady.Load() {
+		return ErrNotReady
+	}
+	if s.inflight == nil {
+		s.inflight = make(map[string]*Cluster)
+	}
+	s.inflight[appLabel] = cluster
+	s.inflightWG.Add(1)
+	return nil
+}
+
+// endCreation marks in-flight creation as finished
+func (s *ServerSettings) endCreation(appLabel string) {
+	s.inflightLock.Lock()
+	defer s.inflightLock.Unlock()
+
+	delete(s.inflight, appLabel)
+	s.inflightWG.Done()
+}
+
+// Shutdown stops accepting new instances, notifies connected clients and waits for in-flight creations.
+// Creations which didn't finish before ctx expires are recorded so that they can be resumed on next start
+func (s *ServerSettings) Shutdown(ctx context.Context) error {
+	logger := s.logger()
+	s.inflightLock.Lock()
+	s.draining.Store(true)
+	s.inflightLock.Unlock()
+
+	s.broadcast("status", "kaas is restarting, new instances can't be created for a minute")
+
+	done := make(chan struct{})
+	go func() {
+		s.inflightWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Info("all in-flight creations finished")
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.inflightLock.Lock()
+	pending := make(map[string]*Cluster, len(s.inflight))
+	for appLabel, cluster := range s.inflight {
+		pending[appLabel] = cluster
+	}
+	s.inflightLock.Unlock()
+
+	// Use a fresh context, as the one passed has expired already
+	recordCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var errs []error
+	for appLabel, cluster := range pending {
+		runtime, ok := cluster.runtime.(resumableRuntime)
+		if !ok {
+			continue
+		}
+		if err := runtime.markInterrupted(recordCtx, appLabel); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		logger.WithFields(logrus.Fields{
+			logFieldInstance: appLabel,
+			logFieldCluster:  cluster.Name,
+		}).Warn("creation interrupted, recorded for resumption")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to record interrupted creations: %v", errs)
+	}
+	return nil
+}
+
+// markInterrupted annotates the instance service, so the next kaas process could finish or roll it back
+func (c *Cluster) markInterrupted(ctx context.Context, appLabel string) error {
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:"true"}}}`, interruptedAnnotation)
+	_, err := c.K8sClient.CoreV1().Services(c.Namespace).Patch(ctx, appLabel, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	if apierrors.IsNotFound(err) {
+		// Nothing was created yet
+		return nil
+	}
+	return err
+}
+
+// ResumeInterrupted finds instances which were being created when a kaas replica stopped.
+// Instances which become ready are kept, the rest are removed. It runs in the leader replica only,
+// instances which are being resumed already are skipped
+func (s *ServerSettings) ResumeInterrupted(ctx context.Context) {
+	for _, cluster := range s.connectedClusters() {
+		if runtime, ok := cluster.runtime.(resumableRuntime); ok {
+			runtime.resumeInterrupted(ctx)
+		}
+	}
+}
+
+// resumeInterrupted resumes interrupted creations in the cluster
+func (c *Cluster) resumeInterrupted(ctx context.Context) {
+	logger := c.logger()
+	svcList, err := c.K8sClient.CoreV1().Services(c.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		logger.WithError(err).Error("failed to list services to resume interrupted creations")
+		return
+	}
+	for _, svc := range svcList.Items {
+		if _, ok := svc.Annotations[interruptedAnnotation]; !ok {
+			continue
+		}
+		appLabel := svc.Labels["app"]
+		if appLabel == "" {
+			continue
+		}
+		if _, resuming := c.server.resuming.LoadOrStore(appLabel, struct{}{}); resuming {
+			continue
+		}
+		go c.resumeCreation(ctx, appLabel)
+	}
+}
+
+func (c *Cluster) resumeCreation(ctx context.Context, appLabel string) {
+	defer c.server.resuming.Delete(appLabel)
+	logger := c.logger().WithField(logFieldInstance, appLabel)
+	logger.Info("resuming interrupted creation")
+
+	_, err := c.K8sClient.AppsV1().Deployments(c.Namespace).Get(ctx, fmt.Sprintf("%s-kas", appLabel), metav1.GetOptions{})
+	if err == nil {
+		err = c.waitForDeploymentReady(ctx, logger, appLabel)
+	}
+	if err == nil {
+		patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:null}}}`, interruptedAnnotation)
+		_, err = c.K8sClient.CoreV1().Services(c.Namespace).Patch(ctx, appLabel, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+		if err != nil {
+			logger.WithError(err).Warn("failed to clear interrupted annotation")
+		}
+		logger.Info("interrupted instance became ready")
+		return
+	}
+
+	if ctx.Err() != nil {
+		// kaas is stopping again, leave the instance for the next process
+		return
+	}
+	logger.WithError(err).Warn("interrupted instance didn't become ready, removing it")
+	if _, err := c.deletePods(ctx, logger, appLabel, false); err != nil {
+		logger.WithError(err).Error("failed to remove interrupted instance")
+	}
+}
@@ -0,0 +1,113 @@
+package kaas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// readyzStatus returns the status code of readiness endpoint
+func readyzStatus(s *ServerSettings) int {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	s.HandleReadyz(c)
+	return w.Code
+}
+
+func TestReady(t *testing.T) {
+	env := newTestEnv(t, testConfig(), true)
+	if err := env.server.Ready(); err != nil {
+		t.Errorf("expected server to be ready, got %v", err)
+	}
+	if status := readyzStatus(env.server); status != http.StatusOK {
+		t.Errorf("expected readyz to succeed, got %d", status)
+	}
+
+	env.cluster.quotaWatchLive.Store(false)
+	if err := env.server.Ready(); err == nil {
+		t.Errorf("expected server without quota watch not to be ready")
+	}
+	env.cluster.clientsReady.Store(false)
+	if err := env.server.Ready(); !errors.Is(err, ErrNotReady) {
+		t.Errorf("expected server without clusters not to be ready, got %v", err)
+	}
+	if err := env.server.beginCreation("app", env.cluster); !errors.Is(err, ErrNotReady) {
+		t.Errorf("expected creation to be refused, got %v", err)
+	}
+
+	env.cluster.clientsReady.Store(true)
+	env.cluster.quotaWatchLive.Store(true)
+	env.server.draining.Store(true)
+	if err := env.server.Ready(); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("expected draining server not to be ready, got %v", err)
+	}
+	if status := readyzStatus(env.server); status != http.StatusServiceUnavailable {
+		t.Errorf("expected readyz to fail while draining, got %d", status)
+	}
+}
+
+func TestShutdownRecordsInterruptedCreations(t *testing.T) {
+	env := newTestEnv(t, testConfig(), true, testInstance("app", time.Now(), time.Now())...)
+	if err := env.server.beginCreation("app", env.cluster); err != nil {
+		t.Fatalf("failed to begin creation: %v", err)
+	}
+	defer env.server.endCreation("app")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := env.server.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+	svc, err := env.kube.CoreV1().Services(testNamespace).Get(context.TODO(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	if svc.Annotations[interruptedAnnotation] != "true" {
+		t.Errorf("expected interrupted creation to be recorded, got %v", svc.Annotations)
+	}
+	if err := env.server.beginCreation("other", env.cluster); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("expected creations to be refused after shutdown, got %v", err)
+	}
+}
+
+func TestResumeInterrupted(t *testing.T) {
+	interrupted := func(appLabel string, available bool) []runtime.Object {
+		objects := testInstance(appLabel, time.Now(), time.Now())
+		objects[1].(*corev1.Service).Annotations = map[string]string{interruptedAnnotation: "true"}
+		if !available {
+			return objects[1:]
+		}
+		deployment := objects[0].(*appsv1.Deployment)
+		deployment.Status.UpdatedReplicas = 1
+		deployment.Status.AvailableReplicas = 1
+		return objects
+	}
+	objects := append(interrupted("ready", true), interrupted("stuck", false)...)
+	env := newTestEnv(t, testConfig(), true, objects...)
+
+	env.server.ResumeInterrupted(context.Background())
+	services := env.kube.CoreV1().Services(testNamespace)
+	err := wait.PollImmediate(10*time.Millisecond, testReadTimeout, func() (bool, error) {
+		ready, err := services.Get(context.TODO(), "ready", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		_, err = services.Get(context.TODO(), "stuck", metav1.GetOptions{})
+		_, marked := ready.Annotations[interruptedAnnotation]
+		return !marked && apierrors.IsNotFound(err), nil
+	})
+	if err != nil {
+		t.Errorf("expected ready instance to be kept and stuck one to be removed: %v", err)
+	}
+}
@@ -0,0 +1,656 @@
+package kaas
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// localClusterName names the cluster of local runtime
+	localClusterName = "local"
+
+	localReadyPollInterval = time.Second
+	localLogTailBytes      = 64 * 1024
+)
+
+// localInstance is a set of static-kas processes serving dumps extracted into dir
+type localInstance struct {
+	appLabel string
+	dir      string
+	created  time.Time
+	ports    []int
+	cancel   context.CancelFunc
+
+	// ready is closed once the instance serves requests or fails to start, err is set then
+	ready chan struct{}
+	err   error
+	// stopped is closed once all processes have exited
+	stopped chan struct{}
+
+	lock      sync.Mutex
+	exitCodes map[int]int32
+}
+
+// LocalRuntime runs instances as static-kas processes on this machine, e.g. for development without a cluster.
+// Dumps are downloaded and extracted into a temporary directory. Instances and their records are kept in memory,
+// so they're removed when kaas stops. Console, Prometheus and Grafana are not launched
+type LocalRuntime struct {
+	cfg     LocalRuntimeConfig
+	cluster *Cluster
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock      sync.Mutex
+	instances map[string]*localInstance
+	records   map[string]*corev1.ConfigMap
+	// version is the last resource version assigned to a record
+	version int
+}
+
+// NewLocalRuntime returns local runtime, Close stops its instances
+func NewLocalRuntime(cfg LocalRuntimeConfig) *LocalRuntime {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &LocalRuntime{
+		cfg:       cfg,
+		ctx:       ctx,
+		cancel:    cancel,
+		instances: make(map[string]*localInstance),
+		records:   make(map[string]*corev1.ConfigMap),
+	}
+}
+
+// AddLocalCluster registers the local runtime as a cluster hosting instances, it's ready right away
+func (s *ServerSettings) AddLocalCluster(runtime *LocalRuntime) *Cluster {
+	cluster := &Cluster{
+		Name:     localClusterName,
+		RQStatus: &QuotaState{},
+		server:   s,
+		runtime:  runtime,
+	}
+	runtime.cluster = cluster
+	runtime.updateQuota()
+	cluster.clientsReady.Store(true)
+	cluster.quotaWatchLive.Store(true)
+	s.Clusters = append(s.Clusters, cluster)
+	return cluster
+}
+
+// isLocal reports whether the cluster runs instances as local processes, which serve API only
+func (c *Cluster) isLocal() bool {
+	_, ok := c.runtime.(*LocalRuntime)
+	return ok
+}
+
+// Close stops all instances and removes their directories
+func (r *LocalRuntime) Close() {
+	r.cancel()
+	r.lock.Lock()
+	instances := r.instances
+	r.instances = make(map[string]*localInstance)
+	r.lock.Unlock()
+
+	for _, instance := range instances {
+		<-instance.stopped
+		os.RemoveAll(instance.dir)
+	}
+}
+
+// updateQuota reports running instances as quota usage, so that placement and UI see the capacity left
+func (r *LocalRuntime) updateQuota() {
+	r.lock.Lock()
+	status := RQuotaStatus{
+		Used: int64(len(r.instances)),
+		Hard: int64(r.cfg.MaxInstances),
+	}
+	r.lock.Unlock()
+	if r.cluster.RQStatus.Set(status) {
+		r.cluster.server.sendResourceQuotaUpdate()
+	}
+}
+
+func (r *LocalRuntime) instance(appLabel string) *localInstance {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.instances[appLabel]
+}
+
+// freePort returns a port which is not used on this machine
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// dumpDir returns the directory the dump with index d is extracted to
+func (i *localInstance) dumpDir(d int) string {
+	return filepath.Join(i.dir, "must-gather"+endpointSuffix(d))
+}
+
+// logPath returns the path to the log of static-kas serving the endpoint with index e
+func (i *localInstance) logPath(e int) string {
+	return filepath.Join(i.dir, fmt.Sprintf("kas%s.log", endpointSuffix(e)))
+}
+
+func (r *LocalRuntime) launch(ctx context.Context, logger *logrus.Entry, appLabel string, spec instanceSpec) (_ *instanceURLs, err error) {
+	_, span := startSpan(ctx, "launchLocalInstance", attrInstance.String(appLabel), attrURL.StringSlice(spec.Dumps))
+	defer func() { endSpan(span, err) }()
+
+	endpoints := newInstanceEndpoints(spec.Dumps, spec.HostedClusters)
+	ports := make([]int, len(endpoints))
+	for i := range endpoints {
+		if ports[i], err = freePort(); err != nil {
+			return nil, fmt.Errorf("failed to find a free port: %w", err)
+		}
+		endpoints[i].APIURL = fmt.Sprintf("http://%s", net.JoinHostPort(r.cfg.Host, strconv.Itoa(ports[i])))
+	}
+	if !spec.Headless || spec.PrometheusTarball != "" {
+		logger.Debug("console and metrics are not supported by local runtime, serving API only")
+	}
+
+	dir, err := os.MkdirTemp(r.cfg.WorkDir, fmt.Sprintf("kaas-%s-", appLabel))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create instance directory: %w", err)
+	}
+	instanceCtx, cancel := context.WithCancel(r.ctx)
+	instance := &localInstance{
+		appLabel:  appLabel,
+		dir:       dir,
+		created:   time.Now(),
+		ports:     ports,
+		cancel:    cancel,
+		ready:     make(chan struct{}),
+		stopped:   make(chan struct{}),
+		exitCodes: make(map[int]int32),
+	}
+
+	r.lock.Lock()
+	if _, ok := r.instances[appLabel]; ok || len(r.instances) >= r.cfg.MaxInstances {
+		running := len(r.instances)
+		r.lock.Unlock()
+		cancel()
+		os.RemoveAll(dir)
+		if ok {
+			return nil, fmt.Errorf("instance %s is running already", appLabel)
+		}
+		return nil, fmt.Errorf("%w: %d instances are running", ErrNoCapacity, running)
+	}
+	r.instances[appLabel] = instance
+	r.lock.Unlock()
+	r.updateQuota()
+
+	go r.run(instanceCtx, logger, instance, spec.Dumps, endpoints)
+	logger.WithField("dir", dir).Info("launched local instance")
+	return &instanceURLs{Endpoints: endpoints}, nil
+}
+
+// run downloads dumps, starts static-kas for every endpoint and waits for them to serve requests.
+// Processes are stopped once ctx is done
+func (r *LocalRuntime) run(ctx context.Context, logger *logrus.Entry, instance *localInstance, dumps []string, endpoints []instanceEndpoint) {
+	var processes sync.WaitGroup
+	exited := make(chan error, len(endpoints))
+	if err := r.start(ctx, logger, instance, dumps, endpoints, &processes, exited); err != nil {
+		instance.err = err
+	} else if err := r.waitForServing(ctx, instance, exited); err != nil {
+		instance.err = err
+	}
+	close(instance.ready)
+
+	processes.Wait()
+	close(instance.stopped)
+}
+
+func (r *LocalRuntime) start(ctx context.Context, logger *logrus.Entry, instance *localInstance, dumps []string,
+	endpoints []instanceEndpoint, processes *sync.WaitGroup, exited chan<- error) error {
+	for d, dumpURL := range dumps {
+		logger.WithField("dump", dumpURL).Debug("downloading dump")
+		if err := fetchDump(ctx, dumpURL, instance.dumpDir(d)); err != nil {
+			return r.diagnose(instance, FailureDownload, err)
+		}
+	}
+
+	for i, endpoint := range endpoints {
+		logFile, err := os.Create(instance.logPath(i))
+		if err != nil {
+			return r.diagnose(instance, FailureUnknown, err)
+		}
+		baseDir := filepath.Join(instance.dumpDir(endpoint.dumpIndex), endpoint.baseDir) + "/"
+		cmd := exec.CommandContext(ctx, r.cfg.Binary, "--base-dir", baseDir, "--port", strconv.Itoa(instance.ports[i]))
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+		if err := cmd.Start(); err != nil {
+			logFile.Close()
+			return r.diagnose(instance, FailureUnknown, fmt.Errorf("failed to start static-kas: %v", err))
+		}
+
+		processes.Add(1)
+		go func(i int) {
+			defer processes.Done()
+			defer logFile.Close()
+			err := cmd.Wait()
+			instance.lock.Lock()
+			instance.exitCodes[i] = int32(cmd.ProcessState.ExitCode())
+			instance.lock.Unlock()
+			if ctx.Err() == nil {
+				logger.WithError(err).WithField("port", instance.ports[i]).Warn("static-kas exited")
+			}
+			exited <- fmt.Errorf("static-kas serving %s exited: %v", endpoints[i].Name, err)
+		}(i)
+	}
+	return nil
+}
+
+// waitForServing polls static-kas processes until all of them serve requests
+func (r *LocalRuntime) waitForServing(ctx context.Context, instance *localInstance, exited <-chan error) error {
+	client := &http.Client{Timeout: localReadyPollInterval}
+	serving := func() bool {
+		for _, port := range instance.ports {
+			res, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/version", port))
+			if err != nil {
+				return false
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return false
+			}
+		}
+		return true
+	}
+
+	ticker := time.NewTicker(localReadyPollInterval)
+	defer ticker.Stop()
+	for !serving() {
+		select {
+		case err := <-exited:
+			return r.diagnose(instance, FailureCrashLoop, err)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// diagnose describes the failed instance, every static-kas process is reported as a container with its log
+func (r *LocalRuntime) diagnose(instance *localInstance, category FailureCategory, cause error) *Diagnosis {
+	d := &Diagnosis{
+		Instance: instance.appLabel,
+		Category: category,
+		Quota:    r.cluster.RQStatus.Get(),
+	}
+	pod := PodDiagnosis{Name: instance.appLabel}
+	instance.lock.Lock()
+	for i := range instance.ports {
+		cd := ContainerDiagnosis{
+			Name:  "kas" + endpointSuffix(i),
+			State: "running",
+		}
+		if exitCode, ok := instance.exitCodes[i]; ok {
+			cd.State = "terminated"
+			cd.ExitCode = &exitCode
+		}
+		if logs, err := tailFile(instance.logPath(i), localLogTailBytes); err == nil {
+			cd.Logs = logs
+		}
+		pod.Containers = append(pod.Containers, cd)
+	}
+	instance.lock.Unlock()
+	d.Pods = []PodDiagnosis{pod}
+	d.Summary = summarize(d, cause)
+	return d
+}
+
+// tailFile returns up to size last bytes of the file
+func tailFile(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > size {
+		if _, err := f.Seek(-size, io.SeekEnd); err != nil {
+			return "", err
+		}
+	}
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+func (r *LocalRuntime) waitForReady(ctx context.Context, logger *logrus.Entry, appLabel string) (err error) {
+	ctx, span := startSpan(ctx, "waitForLocalInstance", attrInstance.String(appLabel))
+	defer func() { endSpan(span, err) }()
+
+	instance := r.instance(appLabel)
+	if instance == nil {
+		return fmt.Errorf("instance %s is not running", appLabel)
+	}
+	timer := time.NewTimer(r.cluster.Config().RolloutTimeout.Duration)
+	defer timer.Stop()
+	select {
+	case <-instance.ready:
+		if instance.err != nil {
+			logger.WithError(instance.err).Warn("instance failed")
+		}
+		return instance.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		logger.Warn("timed out waiting for instance to start")
+		return r.diagnose(instance, FailureTimeout, nil)
+	}
+}
+
+func (r *LocalRuntime) exists(appLabel string) bool {
+	return r.instance(appLabel) != nil
+}
+
+// remove stops instance processes and removes its directory
+func (r *LocalRuntime) remove(ctx context.Context, logger *logrus.Entry, appLabel string, keepRecord bool) (_ string, err error) {
+	ctx, span := startSpan(ctx, "removeLocalInstance", attrInstance.String(appLabel))
+	defer func() { endSpan(span, err) }()
+
+	actionLog := []string{}
+	r.lock.Lock()
+	instance := r.instances[appLabel]
+	delete(r.instances, appLabel)
+	r.lock.Unlock()
+
+	if instance != nil {
+		instance.cancel()
+		select {
+		case <-instance.stopped:
+		case <-ctx.Done():
+			return "", fmt.Errorf("error stopping instance %s: %v", appLabel, ctx.Err())
+		}
+		actionLog = append(actionLog, fmt.Sprintf("Stopped static-kas of %s", appLabel))
+		r.updateQuota()
+		if err := os.RemoveAll(instance.dir); err != nil {
+			return strings.Join(actionLog, "\n"),
+				fmt.Errorf("error removing directory %s: %v", instance.dir, err)
+		}
+		actionLog = append(actionLog, fmt.Sprintf("Removed directory %s", instance.dir))
+	}
+
+	if !keepRecord {
+		r.lock.Lock()
+		if _, ok := r.records[recordName(appLabel)]; ok {
+			delete(r.records, recordName(appLabel))
+			actionLog = append(actionLog, fmt.Sprintf("Removed record %s", recordName(appLabel)))
+		}
+		r.lock.Unlock()
+	}
+
+	logger.WithField("actions", len(actionLog)).Info("removed instance resources")
+	return strings.Join(actionLog, "\n"), nil
+}
+
+// cleanup removes instances and records which outlived their lifetime
+func (r *LocalRuntime) cleanup() {
+	logger := r.cluster.logger()
+	lifetime := r.cluster.Config().Lifetime.Duration
+	now := time.Now()
+
+	r.lock.Lock()
+	created := make(map[string]time.Time, len(r.instances))
+	for appLabel, instance := range r.instances {
+		created[appLabel] = instance.created
+	}
+	staleRecords := []string{}
+	for name, cm := range r.records {
+		if _, ok := r.instances[cm.Labels[appLabelKey]]; !ok && now.After(cm.CreationTimestamp.Add(lifetime)) {
+			staleRecords = append(staleRecords, name)
+		}
+	}
+	for _, name := range staleRecords {
+		delete(r.records, name)
+	}
+	r.lock.Unlock()
+
+	for appLabel, createdAt := range created {
+		instanceLogger := logger.WithField(logFieldInstance, appLabel)
+		if !r.cluster.instanceExpired(context.TODO(), appLabel, createdAt, now) {
+			continue
+		}
+		instanceLogger.Info("instance will be garbage collected")
+		if _, err := r.remove(context.Background(), instanceLogger, appLabel, false); err != nil {
+			instanceLogger.WithError(err).Error("failed to garbage collect instance")
+		}
+	}
+	if len(staleRecords) > 0 {
+		logger.WithField("records", len(staleRecords)).Debug("removed stale instance records")
+	}
+}
+
+func (r *LocalRuntime) getRecord(_ context.Context, appLabel string) (*corev1.ConfigMap, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	cm, ok := r.records[recordName(appLabel)]
+	if !ok {
+		return nil, apierrors.NewNotFound(corev1.Resource("configmaps"), recordName(appLabel))
+	}
+	return cm.DeepCopy(), nil
+}
+
+func (r *LocalRuntime) listRecords(_ context.Context, selector string) ([]corev1.ConfigMap, error) {
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	records := []corev1.ConfigMap{}
+	for _, cm := range r.records {
+		if parsed.Matches(labels.Set(cm.Labels)) {
+			records = append(records, *cm.DeepCopy())
+		}
+	}
+	return records, nil
+}
+
+func (r *LocalRuntime) createRecord(_ context.Context, cm *corev1.ConfigMap) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.records[cm.Name]; ok {
+		return apierrors.NewAlreadyExists(corev1.Resource("configmaps"), cm.Name)
+	}
+	stored := cm.DeepCopy()
+	stored.CreationTimestamp = metav1.Now()
+	r.version++
+	stored.ResourceVersion = strconv.Itoa(r.version)
+	r.records[cm.Name] = stored
+	return nil
+}
+
+// updateRecord replaces the record, failing with Conflict if it was changed since cm was read
+func (r *LocalRuntime) updateRecord(_ context.Context, cm *corev1.ConfigMap) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	current, ok := r.records[cm.Name]
+	if !ok {
+		return apierrors.NewNotFound(corev1.Resource("configmaps"), cm.Name)
+	}
+	if cm.ResourceVersion != current.ResourceVersion {
+		return apierrors.NewConflict(corev1.Resource("configmaps"), cm.Name, errors.New("the record has been modified"))
+	}
+	stored := cm.DeepCopy()
+	stored.CreationTimestamp = current.CreationTimestamp
+	r.version++
+	stored.ResourceVersion = strconv.Itoa(r.version)
+	r.records[cm.Name] = stored
+	return nil
+}
+
+// fetchDump downloads the dump archive into dir and lays it out like the fetcher init container does
+func fetchDump(ctx context.Context, dumpURL, dir string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dumpURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return err
+	}
+	if err := extractTarball(res.Body, dir); err != nil {
+		return err
+	}
+	if !isHypershiftDump(dumpURL) {
+		return flattenDump(dir)
+	}
+	return nil
+}
+
+// extractTarball extracts gzipped tarball into dir without preserving ownership and permissions.
+// Leading "/" and ".." are stripped from member names, members written through symlinks pointing
+// outside of dir and symlinks left pointing outside of it fail the extraction
+func extractTarball(r io.Reader, dir string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read dump archive: %v", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read dump archive: %v", err)
+		}
+		target := filepath.Join(root, filepath.Clean("/"+header.Name))
+		if err := checkInsideDump(root, target); err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0o755)
+		case tar.TypeReg:
+			err = extractFile(tr, target)
+		case tar.TypeSymlink:
+			if filepath.IsAbs(header.Linkname) || !isWithin(root, filepath.Join(filepath.Dir(target), header.Linkname)) {
+				return fmt.Errorf("symlink %s points outside of the dump", header.Name)
+			}
+			err = os.Symlink(header.Linkname, target)
+		case tar.TypeLink:
+			source := filepath.Join(root, filepath.Clean("/"+header.Linkname))
+			if err := checkInsideDump(root, source); err != nil {
+				return err
+			}
+			err = os.Link(source, target)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %v", header.Name, err)
+		}
+	}
+
+	// Symlinks may point outside of the dump through other symlinks
+	return filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.Type()&os.ModeSymlink == 0 {
+			return err
+		}
+		if resolved, err := filepath.EvalSymlinks(path); err == nil && !isWithin(root, resolved) {
+			return fmt.Errorf("symlink %s points outside of the dump", strings.TrimPrefix(path, root+"/"))
+		}
+		return nil
+	})
+}
+
+func extractFile(r io.Reader, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkInsideDump resolves symlinks in the existing part of path and checks that it stays inside root
+func checkInsideDump(root, path string) error {
+	existing := path
+	for {
+		if _, err := os.Lstat(existing); err == nil || existing == root {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil || !isWithin(root, resolved) {
+		return fmt.Errorf("%s points outside of the dump", strings.TrimPrefix(path, root+"/"))
+	}
+	return nil
+}
+
+// isWithin reports whether path is root or inside of it
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// flattenDump moves contents of top level directories into dir, as must-gather archives have a single top level directory
+func flattenDump(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		children, err := os.ReadDir(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := os.Rename(filepath.Join(dir, entry.Name(), child.Name()), filepath.Join(dir, child.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package kaas
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeStaticKASEnv makes the test binary act as static-kas, "fail" makes it exit on startup
+const fakeStaticKASEnv = "KAAS_FAKE_STATIC_KAS"
+
+// runFakeStaticKAS serves /version on --port if --base-dir exists, returning the exit code
+func runFakeStaticKAS(mode string, args []string) int {
+	fs := flag.NewFlagSet("static-kas", flag.ContinueOnError)
+	baseDir := fs.String("base-dir", "", "")
+	port := fs.Int("port", 0, "")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if mode == "fail" {
+		fmt.Println("failed to load dump")
+		return 1
+	}
+	if _, err := os.Stat(*baseDir); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	http.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"gitVersion": "v1.26.0"}`)
+	})
+	fmt.Println(http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", *port), nil))
+	return 1
+}
+
+// newLocalEnv returns local runtime running the test binary as static-kas in mode, serving dumps from artifact server
+func newLocalEnv(t *testing.T, mode string, maxInstances int) (*LocalRuntime, *artifactServer) {
+	t.Helper()
+	t.Setenv(fakeStaticKASEnv, mode)
+	files := jobArtifacts()
+	files[testJobRoot+"artifacts/"+testDumpPath] = dumpArchive(t, map[string]string{
+		"must-gather.local.1/quay-io-must-gather/version": "4.14.0",
+	})
+	artifacts := newArtifactServer(t, files)
+
+	r := NewLocalRuntime(LocalRuntimeConfig{Binary: os.Args[0], WorkDir: t.TempDir(), Host: "127.0.0.1", MaxInstances: maxInstances})
+	t.Cleanup(r.Close)
+	server := &ServerSettings{Log: testLogger()}
+	server.SetConfig(testConfig())
+	server.AddLocalCluster(r)
+	return r, artifacts
+}
+
+// tarball returns gzipped tarball of members, regular files contain their names
+func tarball(t *testing.T, members ...tar.Header) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, header := range members {
+		header := header
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(header.Name))
+		}
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatalf("failed to write %s: %v", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			tw.Write([]byte(header.Name))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to write tarball: %v", err)
+	}
+	gz.Close()
+	return buf
+}
+
+func TestExtractTarball(t *testing.T) {
+	dir := t.TempDir()
+	archive := tarball(t,
+		tar.Header{Name: "must-gather.local.1/", Typeflag: tar.TypeDir},
+		tar.Header{Name: "must-gather.local.1/namespaces/default/pods.yaml", Typeflag: tar.TypeReg},
+		tar.Header{Name: "must-gather.local.1/latest", Typeflag: tar.TypeSymlink, Linkname: "namespaces"},
+		tar.Header{Name: "../../escaped", Typeflag: tar.TypeReg},
+	)
+	if err := extractTarball(archive, dir); err != nil {
+		t.Fatalf("failed to extract tarball: %v", err)
+	}
+	if err := flattenDump(dir); err != nil {
+		t.Fatalf("failed to flatten dump: %v", err)
+	}
+	for _, path := range []string{"namespaces/default/pods.yaml", "latest/default/pods.yaml", "escaped"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("expected %s to be extracted: %v", path, err)
+		}
+	}
+}
+
+func TestExtractTarballRefusesEscapes(t *testing.T) {
+	for name, members := range map[string][]tar.Header{
+		"absolute symlink": {
+			{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		},
+		"relative symlink": {
+			{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		},
+		"chained symlinks": {
+			{Name: "here", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "here/.."},
+		},
+		"write through symlink": {
+			{Name: "here", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "here/.."},
+			{Name: "up/escaped", Typeflag: tar.TypeReg},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "dump")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := extractTarball(tarball(t, members...), dir); err == nil {
+				t.Errorf("expected extraction to fail")
+			}
+			if _, err := os.Stat(filepath.Join(parent, "escaped")); err == nil {
+				t.Errorf("expected no files to be written outside of the dump")
+			}
+		})
+	}
+}
+
+func TestLocalRecordStore(t *testing.T) {
+	ctx := context.TODO()
+	r := NewLocalRuntime(DefaultConfig().Local)
+	defer r.Close()
+
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Name:   recordName("app"),
+		Labels: map[string]string{appLabelKey: "app", recordLabel: "true"},
+	}}
+	if err := r.createRecord(ctx, cm); err != nil {
+		t.Fatalf("failed to create record: %v", err)
+	}
+	if err := r.createRecord(ctx, cm); !apierrors.IsAlreadyExists(err) {
+		t.Errorf("expected AlreadyExists, got %v", err)
+	}
+	stored, err := r.getRecord(ctx, "app")
+	if err != nil {
+		t.Fatalf("failed to get record: %v", err)
+	}
+	if stored.CreationTimestamp.IsZero() {
+		t.Errorf("expected creation timestamp to be set")
+	}
+
+	stored.Data = map[string]string{recordState: stateReady}
+	if err := r.updateRecord(ctx, stored.DeepCopy()); err != nil {
+		t.Fatalf("failed to update record: %v", err)
+	}
+	if err := r.updateRecord(ctx, stored); !apierrors.IsConflict(err) {
+		t.Errorf("expected stale update to conflict, got %v", err)
+	}
+
+	if records, err := r.listRecords(ctx, recordLabel); err != nil || len(records) != 1 || records[0].Data[recordState] != stateReady {
+		t.Errorf("expected updated record to be listed, got %v: %v", records, err)
+	}
+	if records, err := r.listRecords(ctx, appLabelKey+"=other"); err != nil || len(records) != 0 {
+		t.Errorf("expected no records to match, got %v: %v", records, err)
+	}
+	if _, err := r.getRecord(ctx, "other"); !apierrors.IsNotFound(err) {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+}
+
+func TestLocalRuntimeLaunch(t *testing.T) {
+	ctx := context.TODO()
+	r, artifacts := newLocalEnv(t, "serve", 1)
+	spec := instanceSpec{Dumps: []string{artifacts.URL + testJobRoot + "artifacts/" + testDumpPath}, Headless: true}
+
+	urls, err := r.launch(ctx, testLogger(), "app", spec)
+	if err != nil {
+		t.Fatalf("failed to launch instance: %v", err)
+	}
+	if err := r.waitForReady(ctx, testLogger(), "app"); err != nil {
+		t.Fatalf("expected instance to be ready: %v", err)
+	}
+	res, err := http.Get(urls.Endpoints[0].APIURL + "/version")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("expected instance API to be served, got %v: %v", res, err)
+	}
+	res.Body.Close()
+	instance := r.instance("app")
+	if _, err := os.Stat(filepath.Join(instance.dumpDir(0), "quay-io-must-gather", "version")); err != nil {
+		t.Errorf("expected top level dir of the dump to be flattened: %v", err)
+	}
+	if status := r.cluster.RQStatus.Get(); status.Used != 1 || status.Hard != 1 {
+		t.Errorf("expected running instance to be accounted in quota, got %+v", status)
+	}
+	if _, err := r.launch(ctx, testLogger(), "other", spec); !errors.Is(err, ErrNoCapacity) {
+		t.Errorf("expected ErrNoCapacity, got %v", err)
+	}
+
+	if _, err := r.remove(ctx, testLogger(), "app", false); err != nil {
+		t.Fatalf("failed to remove instance: %v", err)
+	}
+	if r.exists("app") || r.cluster.RQStatus.Get().Used != 0 {
+		t.Errorf("expected instance to be removed")
+	}
+	if _, err := os.Stat(instance.dir); !os.IsNotExist(err) {
+		t.Errorf("expected instance directory to be removed, got %v", err)
+	}
+}
+
+func TestLocalRuntimeDiagnosesCrash(t *testing.T) {
+	ctx := context.TODO()
+	r, artifacts := newLocalEnv(t, "fail", 1)
+	spec := instanceSpec{Dumps: []string{artifacts.URL + testJobRoot + "artifacts/" + testDumpPath}, Headless: true}
+
+	if _, err := r.launch(ctx, testLogger(), "app", spec); err != nil {
+		t.Fatalf("failed to launch instance: %v", err)
+	}
+	var d *Diagnosis
+	if err := r.waitForReady(ctx, testLogger(), "app"); !errors.As(err, &d) {
+		t.Fatalf("expected instance failure to be diagnosed, got %v", err)
+	}
+	if d.Category != FailureCrashLoop || len(d.Pods) != 1 || len(d.Pods[0].Containers) != 1 {
+		t.Fatalf("expected crashed static-kas, got %+v", d)
+	}
+	kas := d.Pods[0].Containers[0]
+	if kas.ExitCode == nil || *kas.ExitCode != 1 || !strings.Contains(kas.Logs, "failed to load dump") {
+		t.Errorf("expected exit code and log of static-kas, got %+v", kas)
+	}
+}
+
+func TestLocalRuntimeDiagnosesDownloadFailure(t *testing.T) {
+	ctx := context.TODO()
+	r, artifacts := newLocalEnv(t, "serve", 1)
+	spec := instanceSpec{Dumps: []string{artifacts.URL + testJobRoot + "artifacts/missing.tar"}, Headless: true}
+
+	if _, err := r.launch(ctx, testLogger(), "app", spec); err != nil {
+		t.Fatalf("failed to launch instance: %v", err)
+	}
+	var d *Diagnosis
+	if err := r.waitForReady(ctx, testLogger(), "app"); !errors.As(err, &d) || d.Category != FailureDownload {
+		t.Errorf("expected download failure, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package kaas
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logFieldInstance = "instance"
+	logFieldSource   = "source"
+	logFieldConn     = "conn"
+	logFieldTrace    = "trace_id"
+)
+
+// SetupLogger switches the standard logrus logger to JSON output at the requested level
+func SetupLogger(level string) (*logrus.Logger, error) {
+	logger := logrus.StandardLogger()
+	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	if level == "" {
+		return logger, nil
+	}
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	logger.SetLevel(lvl)
+	return logger, nil
+}
+
+// logger returns server-wide log entry, falling back to the standard logrus logger
+func (s *ServerSettings) logger() *logrus.Entry {
+	if s.Log == nil {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return s.Log
+}
+
+// instanceLogger returns a log entry correlated with the connection, instance and source URL
+func (s *ServerSettings) instanceLogger(connID, appLabel, sourceURL string) *logrus.Entry {
+	return s.logger().WithFields(logrus.Fields{
+		logFieldConn:     connID,
+		logFieldInstance: appLabel,
+		logFieldSource:   sourceURL,
+	})
+}
+
+// GinLogger is a gin middleware logging requests via logrus, skipping noisy paths
+func GinLogger(logger *logrus.Entry, skipPaths ...string) gin.HandlerFunc {
+	skip := make(map[string]struct{}, len(skipPaths))
+	for _, path := range skipPaths {
+		skip[path] = struct{}{}
+	}
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+
+		c.Next()
+
+		if _, ok := skip[path]; ok {
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"status":   c.Writer.Status(),
+			"method":   c.Request.Method,
+			"path":     path,
+			"clientIP": c.ClientIP(),
+			"latency":  time.Since(start).String(),
+		}).Info("request served")
+	}
+}
@@ -0,0 +1,101 @@
+package kaas
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// jsonLogger returns a log entry writing JSON lines into the buffer
+func jsonLogger() (*logrus.Entry, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.SetOutput(buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	return logrus.NewEntry(logger), buf
+}
+
+// logLines parses JSON log lines
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	lines := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+func TestSetupLogger(t *testing.T) {
+	std := logrus.StandardLogger()
+	level, formatter := std.GetLevel(), std.Formatter
+	defer func() {
+		std.SetLevel(level)
+		std.SetFormatter(formatter)
+	}()
+
+	if _, err := SetupLogger("verbose"); err == nil {
+		t.Errorf("expected invalid level to be refused")
+	}
+	logger, err := SetupLogger("debug")
+	if err != nil {
+		t.Fatalf("failed to set up logger: %v", err)
+	}
+	if logger.GetLevel() != logrus.DebugLevel {
+		t.Errorf("expected debug level, got %s", logger.GetLevel())
+	}
+	if _, ok := logger.Formatter.(*logrus.JSONFormatter); !ok {
+		t.Errorf("expected JSON output, got %T", logger.Formatter)
+	}
+}
+
+func TestInstanceLoggerCorrelatesFields(t *testing.T) {
+	log, buf := jsonLogger()
+	s := &ServerSettings{Log: log}
+	s.instanceLogger("conn-1", "abcde", "https://example.com/job").Info("creating instance")
+
+	lines := logLines(t, buf)
+	if len(lines) != 1 {
+		t.Fatalf("expected a single log line, got %v", lines)
+	}
+	for field, value := range map[string]string{
+		logFieldConn:     "conn-1",
+		logFieldInstance: "abcde",
+		logFieldSource:   "https://example.com/job",
+	} {
+		if lines[0][field] != value {
+			t.Errorf("expected %s to be %q, got %v", field, value, lines[0][field])
+		}
+	}
+}
+
+func TestGinLoggerSkipsPaths(t *testing.T) {
+	log, buf := jsonLogger()
+	router := gin.New()
+	router.Use(GinLogger(log, "/health"))
+	router.GET("/health", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/api/list", func(c *gin.Context) { c.Status(http.StatusTeapot) })
+
+	for _, path := range []string{"/health", "/api/list"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	lines := logLines(t, buf)
+	if len(lines) != 1 {
+		t.Fatalf("expected only /api/list to be logged, got %v", lines)
+	}
+	if lines[0]["path"] != "/api/list" || lines[0]["status"] != float64(http.StatusTeapot) || lines[0]["method"] != http.MethodGet {
+		t.Errorf("unexpected request log %v", lines[0])
+	}
+}
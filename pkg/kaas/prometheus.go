@@ -0,0 +1,131 @@
+package kaas
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	prometheusPort    = 9090
+	prometheusTarball = "prometheus.tar"
+
+	// companionPrometheus is the name of Prometheus link
+	companionPrometheus = "prometheus"
+)
+
+// prometheusCandidates returns locations where jobs store the metrics snapshot of the test which produced the dump,
+// e.g. ".../artifacts/e2e/gather-extra/artifacts/metrics/prometheus.tar" for ".../artifacts/e2e/gather-must-gather/artifacts/must-gather.tar"
+func prometheusCandidates(dumpURL string) []string {
+	u, err := url.Parse(dumpURL)
+	if err != nil {
+		return nil
+	}
+	idx := strings.LastIndex(u.Path, "/artifacts/")
+	if idx == -1 {
+		return nil
+	}
+	stepDir := u.Path[:idx]
+	testDir := path.Dir(stepDir)
+
+	candidates := []string{}
+	for _, p := range []string{
+		path.Join(testDir, "gather-extra", "artifacts", "metrics", prometheusTarball),
+		path.Join(testDir, "metrics", prometheusTarball),
+		path.Join(stepDir, "artifacts", "metrics", prometheusTarball),
+	} {
+		candidate := *u
+		candidate.Path = p
+		candidate.RawPath = ""
+		candidates = append(candidates, candidate.String())
+	}
+	return candidates
+}
+
+// findPrometheusTarball looks up the metrics snapshot next to the dump, empty if there is none
+func findPrometheusTarball(ctx context.Context, logger *logrus.Entry, dumpURL string) (_ string, err error) {
+	ctx, span := startSpan(ctx, "findPrometheusTarball", attrURL.String(dumpURL))
+	defer func() { endSpan(span, err) }()
+
+	for _, candidate := range prometheusCandidates(dumpURL) {
+		if err := checkDerivedURL(candidate); err != nil {
+			logger.WithError(err).WithField("url", candidate).Debug("skipping metrics snapshot location")
+			continue
+		}
+		res, err := probeURL(ctx, candidate)
+		if err != nil {
+			return "", err
+		}
+		logger.WithFields(logrus.Fields{
+			"url":    candidate,
+			"status": res.StatusCode,
+		}).Debug("checked metrics snapshot location")
+		if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent {
+			// Prometheus fetcher doesn't follow redirects, so it gets the URL checked by httpClient
+			return res.Request.URL.String(), nil
+		}
+	}
+	return "", nil
+}
+
+// prometheusContainers returns init container downloading the metrics snapshot, Prometheus container serving it and their volume
+func prometheusContainers(cfg Config, tarBall string) (corev1.Container, corev1.Container, corev1.Volume) {
+	mount := corev1.VolumeMount{
+		Name:      "prometheus-volume",
+		MountPath: "/prometheus/",
+	}
+	fetcher := corev1.Container{
+		Name:  "prometheus-fetcher",
+		Image: cfg.Images.CIFetcher,
+		Command: []string{
+			"/bin/bash",
+			"-c",
+			// Prometheus is optional, so failed downloads start it with empty storage instead of failing the instance
+			`set -uxo pipefail && \
+			umask 0000 && \
+			` + extractScript("PROMTAR") + ` || \
+			{ find . -mindepth 1 -delete; echo "failed to fetch metrics snapshot"; }`,
+		},
+		WorkingDir: "/prometheus/",
+		Env: []corev1.EnvVar{
+			{
+				Name:  "PROMTAR",
+				Value: tarBall,
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{mount},
+	}
+	prometheus := corev1.Container{
+		Name:  "prometheus",
+		Image: cfg.Images.Prometheus,
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          "prometheus",
+				Protocol:      corev1.ProtocolTCP,
+				ContainerPort: prometheusPort,
+			},
+		},
+		Args: []string{
+			"--config.file=/etc/prometheus/prometheus.yml",
+			"--storage.tsdb.path=/prometheus/",
+			// Snapshot is older than default retention, which would remove it on startup
+			"--storage.tsdb.retention.time=10y",
+			fmt.Sprintf("--web.listen-address=:%d", prometheusPort),
+		},
+		Resources:    cfg.Resources.Prometheus.requirements(),
+		VolumeMounts: []corev1.VolumeMount{mount},
+	}
+	volume := corev1.Volume{
+		Name: "prometheus-volume",
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	}
+	return fetcher, prometheus, volume
+}
@@ -0,0 +1,120 @@
+package kaas
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPrometheusCandidates(t *testing.T) {
+	candidates := prometheusCandidates("https://gcsweb.example.com/gcs/bucket/logs/job/1/artifacts/e2e/gather-must-gather/artifacts/must-gather.tar")
+	expected := []string{
+		"https://gcsweb.example.com/gcs/bucket/logs/job/1/artifacts/e2e/gather-extra/artifacts/metrics/prometheus.tar",
+		"https://gcsweb.example.com/gcs/bucket/logs/job/1/artifacts/e2e/metrics/prometheus.tar",
+		"https://gcsweb.example.com/gcs/bucket/logs/job/1/artifacts/e2e/gather-must-gather/artifacts/metrics/prometheus.tar",
+	}
+	if strings.Join(candidates, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, candidates)
+	}
+	if candidates := prometheusCandidates("https://example.com/must-gather.tar"); len(candidates) != 0 {
+		t.Errorf("expected no candidates outside of artifacts dir, got %v", candidates)
+	}
+}
+
+func TestFindPrometheusTarballMissing(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	tarball, err := findPrometheusTarball(context.TODO(), testLogger(), artifacts.URL+testJobRoot+"artifacts/"+testDumpPath)
+	if err != nil || tarball != "" {
+		t.Errorf("expected no metrics snapshot, got %q: %v", tarball, err)
+	}
+}
+
+func TestNewKASLaunchesPrometheus(t *testing.T) {
+	files := jobArtifacts(testDumpPath)
+	tarballPath := testJobRoot + "artifacts/e2e/gather-extra/artifacts/metrics/" + prometheusTarball
+	files[tarballPath] = []byte("metrics")
+	artifacts := newArtifactServer(t, files)
+	cfg := testConfig()
+	cfg.Prometheus = true
+	env := newTestEnv(t, cfg, true)
+	conn := env.dial(t)
+
+	messages := createInstance(t, conn, artifacts.URL+testJobRoot, nil)
+	if lastMessage(messages).Action != "done" {
+		t.Fatalf("expected instance to be created, got %v", messages)
+	}
+	deployment := instanceDeployment(t, env, messages)
+	containers := map[string]corev1.Container{}
+	for _, c := range append(deployment.Spec.Template.Spec.InitContainers, deployment.Spec.Template.Spec.Containers...) {
+		containers[c.Name] = c
+	}
+	if _, ok := containers["prometheus"]; !ok {
+		t.Fatalf("expected Prometheus container, got %v", containers)
+	}
+	fetcher, ok := containers["prometheus-fetcher"]
+	if !ok || len(fetcher.Env) != 1 || fetcher.Env[0].Value != artifacts.URL+tarballPath {
+		t.Errorf("expected fetcher to download %s, got %+v", tarballPath, fetcher.Env)
+	}
+
+	appLabel := findMessage(messages, "app-label").Message
+	if _, err := env.routes.RouteV1().Routes(testNamespace).Get(context.TODO(), appLabel+"-prometheus", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected Prometheus route: %v", err)
+	}
+}
+
+func TestFindPrometheusTarballDoesNotDownload(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		rejectHead bool
+		expected   []string
+	}{
+		{
+			name:     "HEAD",
+			expected: []string{"HEAD "},
+		},
+		{
+			name:       "ranged GET if HEAD is rejected",
+			rejectHead: true,
+			expected:   []string{"HEAD ", "GET bytes=0-0"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tarballPath := testJobRoot + "artifacts/e2e/gather-extra/artifacts/metrics/" + prometheusTarball
+			artifacts := newArtifactServer(t, map[string][]byte{tarballPath: []byte(strings.Repeat("metrics", 1024))})
+			var lock sync.Mutex
+			requests := []string{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != tarballPath {
+					http.NotFound(w, r)
+					return
+				}
+				lock.Lock()
+				requests = append(requests, r.Method+" "+r.Header.Get("Range"))
+				lock.Unlock()
+				if tc.rejectHead && r.Method == http.MethodHead {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				artifacts.serve(w, r)
+			}))
+			defer server.Close()
+			allowInternalServer(t, server)
+
+			tarball, err := findPrometheusTarball(context.TODO(), testLogger(), server.URL+testJobRoot+"artifacts/"+testDumpPath)
+			if err != nil || tarball != server.URL+tarballPath {
+				t.Errorf("expected metrics snapshot to be found, got %q: %v", tarball, err)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if strings.Join(requests, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("expected requests %v, got %v", tc.expected, requests)
+			}
+		})
+	}
+}
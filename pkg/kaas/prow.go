@@ -0,0 +1,230 @@
+package kaas
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Labels of instance records describing the job which produced the dumps
+const (
+	jobLabel     = "kaas.openshift.io/job"
+	buildIDLabel = "kaas.openshift.io/build-id"
+	repoLabel    = "kaas.openshift.io/repo"
+	pullLabel    = "kaas.openshift.io/pull"
+
+	// recordJob is the key of instance record storing JobInfo
+	recordJob = "job.json"
+
+	// prowMetadataLimit is the maximum size of a job metadata file
+	prowMetadataLimit = 4 << 20
+)
+
+var (
+	invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+	// Env vars of release jobs pointing to the tested release payload
+	releaseImageEnvVars = []string{"RELEASE_IMAGE_LATEST", "RELEASE_IMAGE_INITIAL", "RELEASE_IMAGE"}
+)
+
+// jobRootURL returns the URL of the job run directory containing started.json, the parent of "artifacts" dir
+func jobRootURL(rawURL string) (string, bool) {
+	idx := strings.Index(rawURL, "/artifacts/")
+	if idx == -1 {
+		return "", false
+	}
+	return rawURL[:idx+1], true
+}
+
+// fetchJSON decodes JSON file at url into v, the url must match the allowlist
+func fetchJSON(ctx context.Context, fileURL string, v interface{}) error {
+	if err := checkDerivedURL(fileURL); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, prowMetadataLimit)).Decode(v)
+}
+
+// fetchJobInfo reads started.json, finished.json and prowjob.json of the job run at rootURL.
+// Missing files are skipped, job name and build ID fall back to the run path
+func fetchJobInfo(ctx context.Context, logger *logrus.Entry, rootURL string) (_ *JobInfo, err error) {
+	ctx, span := startSpan(ctx, "fetchJobInfo", attrURL.String(rootURL))
+	defer func() { endSpan(span, err) }()
+
+	logger = logger.WithField("url", rootURL)
+	info := &JobInfo{}
+	found := false
+
+	var started ProwJSON
+	if err := fetchJSON(ctx, rootURL+"started.json", &started); err != nil {
+		logger.WithError(err).Debug("failed to fetch started.json")
+	} else {
+		found = true
+		if started.Timestamp != 0 {
+			t := time.Unix(started.Timestamp, 0).UTC()
+			info.Started = &t
+		}
+	}
+
+	var finished ProwJSON
+	if err := fetchJSON(ctx, rootURL+"finished.json", &finished); err != nil {
+		logger.WithError(err).Debug("failed to fetch finished.json")
+	} else {
+		found = true
+		if finished.Timestamp != 0 {
+			t := time.Unix(finished.Timestamp, 0).UTC()
+			info.Finished = &t
+		}
+		info.Result = finished.Result
+		if info.Result == "" && finished.Passed != nil {
+			info.Result = "FAILURE"
+			if *finished.Passed {
+				info.Result = "SUCCESS"
+			}
+		}
+	}
+
+	var prowJob ProwJob
+	if err := fetchJSON(ctx, rootURL+"prowjob.json", &prowJob); err != nil {
+		logger.WithError(err).Debug("failed to fetch prowjob.json")
+	} else {
+		found = true
+		info.Job = prowJob.Spec.Job
+		info.Type = prowJob.Spec.Type
+		info.Refs = prowJob.Spec.Refs
+		info.BuildID = prowJob.Status.BuildID
+		info.URL = prowJob.Status.URL
+		if info.Result == "" {
+			info.Result = strings.ToUpper(prowJob.Status.State)
+		}
+		if info.Started == nil && prowJob.Status.StartTime != nil {
+			t := prowJob.Status.StartTime.UTC()
+			info.Started = &t
+		}
+		if info.Finished == nil && prowJob.Status.CompletionTime != nil {
+			t := prowJob.Status.CompletionTime.UTC()
+			info.Finished = &t
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no job metadata found at %s", rootURL)
+	}
+
+	// Run path ends with <job>/<build ID>/
+	if parsed, err := url.Parse(rootURL); err == nil {
+		buildDir := path.Clean(parsed.Path)
+		if info.BuildID == "" {
+			info.BuildID = path.Base(buildDir)
+		}
+		if info.Job == "" {
+			info.Job = path.Base(path.Dir(buildDir))
+		}
+	}
+	info.Version = releaseVersion(&started, &finished, &prowJob)
+	return info, nil
+}
+
+// releaseVersion looks up OpenShift version in job metadata, falling back to the tag of the tested release image
+func releaseVersion(started, finished *ProwJSON, prowJob *ProwJob) string {
+	for _, metadata := range []map[string]interface{}{finished.Metadata, started.Metadata} {
+		for _, key := range []string{"version", "job-version"} {
+			if version, ok := metadata[key].(string); ok && version != "" {
+				return version
+			}
+		}
+	}
+	if prowJob.Spec.PodSpec == nil {
+		return ""
+	}
+	for _, name := range releaseImageEnvVars {
+		for _, container := range prowJob.Spec.PodSpec.Containers {
+			for _, env := range container.Env {
+				if env.Name != name || env.Value == "" {
+					continue
+				}
+				if idx := strings.LastIndex(env.Value, ":"); idx != -1 && !strings.Contains(env.Value[idx:], "/") {
+					return env.Value[idx+1:]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// labelValue converts s into a valid label value
+func labelValue(s string) string {
+	value := invalidLabelChars.ReplaceAllString(s, "-")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-_.")
+}
+
+// jobLabels returns labels of instance record making it searchable by job.
+// Values are sanitized and truncated, so the full values are compared against the stored JobInfo
+func jobLabels(job *JobInfo) map[string]string {
+	result := map[string]string{}
+	if job == nil {
+		return result
+	}
+	if job.Job != "" {
+		result[jobLabel] = labelValue(job.Job)
+	}
+	if job.BuildID != "" {
+		result[buildIDLabel] = labelValue(job.BuildID)
+	}
+	if job.Refs != nil {
+		result[repoLabel] = labelValue(fmt.Sprintf("%s.%s", job.Refs.Org, job.Refs.Repo))
+		if len(job.Refs.Pulls) == 1 {
+			result[pullLabel] = strconv.Itoa(job.Refs.Pulls[0].Number)
+		}
+	}
+	return result
+}
+
+// jobSelector returns label selector matching instances of the job filter
+func jobSelector(filter *JobInfo, pull string) labels.Selector {
+	set := jobLabels(filter)
+	if pull != "" {
+		set[pullLabel] = labelValue(pull)
+	}
+	set[recordLabel] = "true"
+	return labels.SelectorFromSet(set)
+}
+
+// matches reports whether job matches non-empty fields of filter
+func (job *JobInfo) matches(filter *JobInfo) bool {
+	if filter.Job != "" && job.Job != filter.Job {
+		return false
+	}
+	if filter.BuildID != "" && job.BuildID != filter.BuildID {
+		return false
+	}
+	if filter.Refs != nil && (job.Refs == nil || job.Refs.Org != filter.Refs.Org || job.Refs.Repo != filter.Refs.Repo) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package kaas
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestJobRootURL(t *testing.T) {
+	root, ok := jobRootURL("https://gcsweb.example.com/gcs/bucket/logs/job/1/artifacts/e2e/must-gather.tar")
+	if !ok || root != "https://gcsweb.example.com/gcs/bucket/logs/job/1/" {
+		t.Errorf("unexpected job root %q", root)
+	}
+	if _, ok := jobRootURL("https://gcsweb.example.com/gcs/bucket/logs/job/1/"); ok {
+		t.Errorf("expected URL without artifacts dir not to have a job root")
+	}
+}
+
+func TestFetchJobInfo(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	info, err := fetchJobInfo(context.TODO(), testLogger(), artifacts.URL+testJobRoot)
+	if err != nil {
+		t.Fatalf("failed to fetch job info: %v", err)
+	}
+	if info.Job != "periodic-e2e" || info.BuildID != "1234" || info.Type != "periodic" || info.Result != "FAILURE" {
+		t.Errorf("unexpected job info %+v", info)
+	}
+	if info.Started == nil || !info.Started.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("expected start time from started.json, got %v", info.Started)
+	}
+	if info.Finished == nil || !info.Finished.Equal(time.Unix(1700003600, 0)) {
+		t.Errorf("expected finish time from finished.json, got %v", info.Finished)
+	}
+}
+
+func TestFetchJobInfoFallsBackToRunPath(t *testing.T) {
+	passed := true
+	finished, _ := json.Marshal(ProwJSON{Timestamp: 1700003600, Passed: &passed})
+	artifacts := newArtifactServer(t, map[string][]byte{testJobRoot + "finished.json": finished})
+
+	info, err := fetchJobInfo(context.TODO(), testLogger(), artifacts.URL+testJobRoot)
+	if err != nil {
+		t.Fatalf("failed to fetch job info: %v", err)
+	}
+	if info.Job != "periodic-e2e" || info.BuildID != "1234" || info.Result != "SUCCESS" {
+		t.Errorf("expected job and build ID from run path, got %+v", info)
+	}
+
+	if _, err := fetchJobInfo(context.TODO(), testLogger(), artifacts.URL+"/gcs/test-bucket/logs/missing/1/"); err == nil {
+		t.Errorf("expected run without metadata to fail")
+	}
+}
+
+func TestReleaseVersion(t *testing.T) {
+	prowJob := &ProwJob{Spec: ProwJobSpec{PodSpec: &corev1.PodSpec{Containers: []corev1.Container{{
+		Env: []corev1.EnvVar{
+			{Name: "RELEASE_IMAGE_INITIAL", Value: "registry.ci.openshift.org/ocp/release:4.13.0-0.nightly"},
+			{Name: "RELEASE_IMAGE_LATEST", Value: "registry.ci.openshift.org/ocp/release:4.14.0-0.nightly"},
+		},
+	}}}}}
+	for _, tc := range []struct {
+		name     string
+		started  ProwJSON
+		finished ProwJSON
+		prowJob  *ProwJob
+		expected string
+	}{
+		{
+			name:     "finished metadata",
+			started:  ProwJSON{Metadata: map[string]interface{}{"job-version": "4.12.0"}},
+			finished: ProwJSON{Metadata: map[string]interface{}{"version": "4.12.1"}},
+			prowJob:  prowJob,
+			expected: "4.12.1",
+		},
+		{
+			name:     "started metadata",
+			started:  ProwJSON{Metadata: map[string]interface{}{"job-version": "4.12.0"}},
+			prowJob:  prowJob,
+			expected: "4.12.0",
+		},
+		{
+			name:     "latest release image",
+			prowJob:  prowJob,
+			expected: "4.14.0-0.nightly",
+		},
+		{
+			name: "image without tag",
+			prowJob: &ProwJob{Spec: ProwJobSpec{PodSpec: &corev1.PodSpec{Containers: []corev1.Container{{
+				Env: []corev1.EnvVar{{Name: "RELEASE_IMAGE", Value: "registry.ci.openshift.org:443/ocp/release"}},
+			}}}}},
+		},
+		{
+			name:    "no pod spec",
+			prowJob: &ProwJob{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if version := releaseVersion(&tc.started, &tc.finished, tc.prowJob); version != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, version)
+			}
+		})
+	}
+}
+
+func TestJobLabels(t *testing.T) {
+	job := &JobInfo{
+		Job:     "pull-ci-openshift-origin-master-e2e-aws-ovn-upgrade-with-a-very-long-name",
+		BuildID: "1234",
+		Refs:    &ProwRefs{Org: "openshift", Repo: "origin", Pulls: []ProwPull{{Number: 42}}},
+	}
+	set := jobLabels(job)
+	for k, v := range set {
+		if len(v) > 63 {
+			t.Errorf("expected label %s to be truncated, got %q", k, v)
+		}
+	}
+	if set[repoLabel] != "openshift.origin" || set[pullLabel] != "42" || set[buildIDLabel] != "1234" {
+		t.Errorf("unexpected labels %v", set)
+	}
+	if len(jobLabels(nil)) != 0 {
+		t.Errorf("expected no labels without job")
+	}
+
+	selector := jobSelector(&JobInfo{Job: job.Job}, "42")
+	if !selector.Matches(labels.Set(map[string]string{jobLabel: set[jobLabel], pullLabel: "42", recordLabel: "true"})) {
+		t.Errorf("expected selector %s to match labels of the job", selector)
+	}
+}
+
+func TestJobInfoMatches(t *testing.T) {
+	job := &JobInfo{Job: "e2e", BuildID: "1", Refs: &ProwRefs{Org: "openshift", Repo: "origin"}}
+	for _, tc := range []struct {
+		filter  JobInfo
+		matches bool
+	}{
+		{filter: JobInfo{}, matches: true},
+		{filter: JobInfo{Job: "e2e", BuildID: "1"}, matches: true},
+		{filter: JobInfo{Job: "e2e-upgrade"}},
+		{filter: JobInfo{BuildID: "2"}},
+		{filter: JobInfo{Refs: &ProwRefs{Org: "openshift", Repo: "origin"}}, matches: true},
+		{filter: JobInfo{Refs: &ProwRefs{Org: "openshift", Repo: "installer"}}},
+	} {
+		if matches := job.matches(&tc.filter); matches != tc.matches {
+			t.Errorf("expected match of %+v to be %v", tc.filter, tc.matches)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package kaas
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const quotaResyncPeriod = 10 * time.Minute
+
+// QuotaState holds the latest ResourceQuota status, safe for concurrent use
+type QuotaState struct {
+	lock   sync.RWMutex
+	status RQuotaStatus
+}
+
+// Get returns a snapshot of current quota status
+func (q *QuotaState) Get() RQuotaStatus {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.status
+}
+
+// Set stores new quota status and reports whether it has changed
+func (q *QuotaState) Set(status RQuotaStatus) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	changed := !reflect.DeepEqual(q.status, status)
+	q.status = status
+	return changed
+}
+
+// quotaStatusFromResourceQuota converts ResourceQuota status to RQuotaStatus
+func quotaStatusFromResourceQuota(rq *corev1.ResourceQuota) RQuotaStatus {
+	return RQuotaStatus{
+		Used: rq.Status.Used.Pods().Value(),
+		Hard: rq.Status.Hard.Pods().Value(),
+		CPU: QuotaUsage{
+			Used: quotaQuantity(rq.Status.Used, corev1.ResourceRequestsCPU, corev1.ResourceCPU).MilliValue(),
+			Hard: quotaQuantity(rq.Status.Hard, corev1.ResourceRequestsCPU, corev1.ResourceCPU).MilliValue(),
+		},
+		Memory: QuotaUsage{
+			Used: quotaQuantity(rq.Status.Used, corev1.ResourceRequestsMemory, corev1.ResourceMemory).Value(),
+			Hard: quotaQuantity(rq.Status.Hard, corev1.ResourceRequestsMemory, corev1.ResourceMemory).Value(),
+		},
+	}
+}
+
+// quotaQuantity returns the first set resource from names
+func quotaQuantity(list corev1.ResourceList, names ...corev1.ResourceName) *resource.Quantity {
+	for _, name := range names {
+		if q, ok := list[name]; ok {
+			return &q
+		}
+	}
+	return &resource.Quantity{}
+}
+
+// quotaStatus sums up quota status of all clusters, status of clusters which are not connected yet is empty
+func (s *ServerSettings) quotaStatus() RQuotaStatus {
+	total := RQuotaStatus{}
+	for _, cluster := range s.Clusters {
+		status := cluster.RQStatus.Get()
+		total.Used += status.Used
+		total.Hard += status.Hard
+		total.CPU.Used += status.CPU.Used
+		total.CPU.Hard += status.CPU.Hard
+		total.Memory.Used += status.Memory.Used
+		total.Memory.Hard += status.Memory.Hard
+	}
+	return total
+}
+
+// updateQuotaStatus stores quota status and passes it to UI if it has changed
+func (c *Cluster) updateQuotaStatus(logger *logrus.Entry, rq *corev1.ResourceQuota) {
+	status := quotaStatusFromResourceQuota(rq)
+	if !c.RQStatus.Set(status) {
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"pods":   fmt.Sprintf("%d/%d", status.Used, status.Hard),
+		"cpu":    fmt.Sprintf("%dm/%dm", status.CPU.Used, status.CPU.Hard),
+		"memory": fmt.Sprintf("%d/%d", status.Memory.Used, status.Memory.Hard),
+	}).Debug("resource quota update")
+	c.server.sendResourceQuotaUpdate()
+}
+
+// GetResourceQuota updates current resource quota setting
+func (c *Cluster) GetResourceQuota() error {
+	rquota, err := c.K8sClient.CoreV1().ResourceQuotas(c.Namespace).Get(context.TODO(), c.RQuotaName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get ResourceQuota: %v", err)
+	}
+	c.updateQuotaStatus(c.logger(), rquota)
+	return nil
+}
+
+// WatchResourceQuota passes RQ updates from k8s to UI until ctx is cancelled
+func (c *Cluster) WatchResourceQuota(ctx context.Context) {
+	logger := c.logger().WithField("resourcequota", c.RQuotaName)
+
+	factory := informers.NewSharedInformerFactoryWithOptions(c.K8sClient, quotaResyncPeriod,
+		informers.WithNamespace(c.Namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", c.RQuotaName).String()
+		}),
+	)
+	informer := factory.Core().V1().ResourceQuotas().Informer()
+
+	onChange := func(obj interface{}) {
+		rq, ok := obj.(*corev1.ResourceQuota)
+		if !ok {
+			return
+		}
+		c.quotaWatchLive.Store(true)
+		c.updateQuotaStatus(logger, rq)
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    onChange,
+		UpdateFunc: func(_, obj interface{}) { onChange(obj) },
+		DeleteFunc: func(_ interface{}) {
+			logger.Warn("resource quota was removed")
+			c.RQStatus.Set(RQuotaStatus{})
+			c.server.sendResourceQuotaUpdate()
+		},
+	})
+	err := informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+		c.quotaWatchLive.Store(false)
+		logger.WithError(err).Warn("resource quota watch failed, retrying")
+	})
+	if err != nil {
+		logger.WithError(err).Error("failed to set watch error handler")
+	}
+
+	// Quota events may arrive before the informer is synced, so the watch is marked down however it stops
+	defer c.quotaWatchLive.Store(false)
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		logger.Error("failed to sync resource quota informer")
+		return
+	}
+	c.quotaWatchLive.Store(true)
+	logger.Debug("resource quota informer synced")
+
+	<-ctx.Done()
+}
@@ -0,0 +1,81 @@
+package kaas
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestQuotaStatusFromResourceQuota(t *testing.T) {
+	rq := &corev1.ResourceQuota{Status: corev1.ResourceQuotaStatus{
+		Hard: corev1.ResourceList{
+			corev1.ResourcePods:           resource.MustParse("10"),
+			corev1.ResourceRequestsCPU:    resource.MustParse("4"),
+			corev1.ResourceCPU:            resource.MustParse("8"),
+			corev1.ResourceRequestsMemory: resource.MustParse("8Gi"),
+		},
+		Used: corev1.ResourceList{
+			corev1.ResourcePods:           resource.MustParse("3"),
+			corev1.ResourceRequestsCPU:    resource.MustParse("1500m"),
+			corev1.ResourceRequestsMemory: resource.MustParse("2Gi"),
+		},
+	}}
+	status := quotaStatusFromResourceQuota(rq)
+	expected := RQuotaStatus{
+		Used:   3,
+		Hard:   10,
+		CPU:    QuotaUsage{Used: 1500, Hard: 4000},
+		Memory: QuotaUsage{Used: 2 << 30, Hard: 8 << 30},
+	}
+	if status != expected {
+		t.Errorf("expected %+v, got %+v", expected, status)
+	}
+}
+
+func TestWatchResourceQuota(t *testing.T) {
+	env := newTestEnv(t, testConfig(), true)
+	env.cluster.quotaWatchLive.Store(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		env.cluster.WatchResourceQuota(ctx)
+		close(stopped)
+	}()
+
+	quotas := env.kube.CoreV1().ResourceQuotas(testNamespace)
+	rq, err := quotas.Get(context.TODO(), testQuotaName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get quota: %v", err)
+	}
+	rq.Status.Used[corev1.ResourcePods] = resource.MustParse("4")
+	if _, err := quotas.UpdateStatus(context.TODO(), rq, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update quota: %v", err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, testReadTimeout, func() (bool, error) {
+		return env.cluster.RQStatus.Get().Used == 4 && env.cluster.quotaWatchLive.Load(), nil
+	})
+	if err != nil {
+		t.Fatalf("expected quota update to be picked up, got %+v", env.cluster.RQStatus.Get())
+	}
+
+	if err := quotas.Delete(context.TODO(), testQuotaName, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete quota: %v", err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, testReadTimeout, func() (bool, error) {
+		return env.cluster.RQStatus.Get() == RQuotaStatus{}, nil
+	})
+	if err != nil {
+		t.Errorf("expected status of removed quota to be reset, got %+v", env.cluster.RQStatus.Get())
+	}
+
+	cancel()
+	<-stopped
+	if env.cluster.quotaWatchLive.Load() {
+		t.Errorf("expected quota watch not to be live once stopped")
+	}
+}
@@ -0,0 +1,102 @@
+package kaas
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// recordLabel marks instance record config maps
+	recordLabel = "kaas.openshift.io/record"
+)
+
+// Keys of instance record config map
+const (
+	recordSource    = "source"
+	recordDump      = "dump"
+	recordDiagnosis = "diagnosis.json"
+	// recordCluster is the name of the target cluster the instance is placed in
+	recordCluster = "cluster"
+)
+
+func recordName(appLabel string) string {
+	return fmt.Sprintf("%s-record", appLabel)
+}
+
+// updateInstanceRecord stores data in the config map describing the instance, creating it if necessary.
+// The record is labelled with instance label, so it's removed along with other instance resources
+func (c *Cluster) updateInstanceRecord(ctx context.Context, appLabel string, data map[string]string) error {
+	cm, err := c.runtime.getRecord(ctx, appLabel)
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: recordName(appLabel),
+				Labels: map[string]string{
+					appLabelKey: appLabel,
+					recordLabel: "true",
+				},
+			},
+			Data: data,
+		}
+		if dumpURL, ok := data[recordDump]; ok {
+			cm.Labels[dumpHashLabel] = dumpHash(dumpURL)
+		}
+		if jobJSON, ok := data[recordJob]; ok {
+			job := &JobInfo{}
+			if err := json.Unmarshal([]byte(jobJSON), job); err == nil {
+				for k, v := range jobLabels(job) {
+					cm.Labels[k] = v
+				}
+			}
+		}
+		if err := c.runtime.createRecord(ctx, cm); err != nil {
+			return fmt.Errorf("failed to create instance record: %v", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get instance record: %v", err)
+	}
+
+	if cm.Data == nil {
+		cm.Data = make(map[string]string, len(data))
+	}
+	for k, v := range data {
+		cm.Data[k] = v
+	}
+	if err := c.runtime.updateRecord(ctx, cm); err != nil {
+		return fmt.Errorf("failed to update instance record: %v", err)
+	}
+	return nil
+}
+
+// cleanupStaleRecords removes records outliving instance lifetime, e.g. those kept after failed creations.
+// Records of running instances are kept, as shared instances live for the lifetime since they were last acquired
+func (c *Cluster) cleanupStaleRecords(logger *logrus.Entry) {
+	ctx := context.TODO()
+	cmList, err := c.K8sClient.CoreV1().ConfigMaps(c.Namespace).List(ctx, metav1.ListOptions{LabelSelector: recordLabel})
+	if err != nil {
+		logger.WithError(err).Warn("failed to list instance records for cleanup")
+		return
+	}
+	now := time.Now()
+	for _, cm := range cmList.Items {
+		createdAt := cm.GetCreationTimestamp()
+		if !now.After(createdAt.Add(c.Config().Lifetime.Duration)) || c.instanceExists(cm.Labels[appLabelKey]) {
+			continue
+		}
+		recordLogger := logger.WithField(logFieldInstance, cm.Labels[appLabelKey])
+		if err := c.K8sClient.CoreV1().ConfigMaps(c.Namespace).Delete(ctx, cm.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			recordLogger.WithError(err).Warn("failed to remove stale instance record")
+			continue
+		}
+		recordLogger.Debug("removed stale instance record")
+	}
+}
@@ -0,0 +1,123 @@
+package kaas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	rollbackTimeout      = 2 * time.Minute
+	rollbackPollInterval = 2 * time.Second
+)
+
+// launchError wraps failures to create instance objects
+type launchError struct {
+	err error
+}
+
+func (e *launchError) Error() string {
+	return fmt.Sprintf("Failed to run a new app: %s", e.err.Error())
+}
+
+func (e *launchError) Unwrap() error {
+	return e.err
+}
+
+// isRetryable reports whether a failed creation may succeed if attempted again
+func isRetryable(err error) bool {
+	var diagnosis *Diagnosis
+	if errors.As(err, &diagnosis) {
+		return diagnosis.Category == FailureImagePull || diagnosis.Category == FailureDownload ||
+			diagnosis.Category == FailureUnschedulable
+	}
+	return apierrors.IsConflict(err) ||
+		apierrors.IsAlreadyExists(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err)
+}
+
+// createInstance launches the instance and waits for it to become ready, retrying transient failures
+// according to retry policy. Resources of failed attempts are removed, except for the instance record
+func (c *Cluster) createInstance(ctx context.Context, logger *logrus.Entry, conn *wsConn, appLabel string, spec instanceSpec) (*instanceURLs, error) {
+	policy := c.Config().Retry
+	for attempt := 1; ; attempt++ {
+		attemptLogger := logger.WithField("attempt", attempt)
+		urls, err := c.launchAndWait(ctx, attemptLogger, conn, appLabel, spec, attempt == 1)
+		if err == nil {
+			return urls, nil
+		}
+
+		attemptLogger.WithError(err).Warn("creation attempt failed, rolling back")
+		if rbErr := c.rollbackInstance(ctx, attemptLogger, appLabel); rbErr != nil {
+			attemptLogger.WithError(rbErr).Error("failed to roll back instance")
+			return nil, err
+		}
+		if attempt >= policy.Attempts || !isRetryable(err) {
+			return nil, err
+		}
+
+		sendWSMessage(conn, "status", fmt.Sprintf("Attempt %d of %d failed, retrying: %s", attempt, policy.Attempts, err.Error()))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(policy.Backoff.Duration):
+		}
+	}
+}
+
+func (c *Cluster) launchAndWait(ctx context.Context, logger *logrus.Entry, conn *wsConn, appLabel string, spec instanceSpec, firstAttempt bool) (*instanceURLs, error) {
+	urls, err := c.runtime.launch(ctx, logger, appLabel, spec)
+	if err != nil {
+		return nil, &launchError{err: err}
+	}
+	record := map[string]string{
+		recordEndpoints:  marshalEndpoints(urls.Endpoints),
+		recordCompanions: marshalCompanions(urls.Companions),
+	}
+	if err := c.updateInstanceRecord(ctx, appLabel, record); err != nil {
+		logger.WithError(err).Warn("failed to store instance URLs")
+	}
+	if firstAttempt {
+		// Routes are recreated with the same hosts, so kubeconfig stays valid between attempts
+		sendWSMessage(conn, "kubeconfig", renderKubeconfig(urls.Endpoints))
+	}
+
+	sendWSMessage(conn, "progress", "Waiting for pods to become ready")
+	if err := c.runtime.waitForReady(ctx, logger, appLabel); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// rollbackInstance removes resources of a failed creation, keeping the instance record
+func (c *Cluster) rollbackInstance(ctx context.Context, logger *logrus.Entry, appLabel string) error {
+	ctx, span := startSpan(ctx, "rollbackInstance", attrInstance.String(appLabel))
+	defer span.End()
+
+	_, err := c.runtime.remove(ctx, logger, appLabel, true)
+	return err
+}
+
+// reportCreationFailure sends the failure to the user and stores the diagnosis in the instance record
+func (c *Cluster) reportCreationFailure(ctx context.Context, logger *logrus.Entry, conn *wsConn, appLabel string, err error) {
+	var diagnosis *Diagnosis
+	if !errors.As(err, &diagnosis) {
+		sendWSMessage(conn, "failure", withTraceID(ctx, err.Error()))
+		return
+	}
+	if diagnosisJSON, err := json.Marshal(diagnosis); err == nil {
+		if err := c.updateInstanceRecord(ctx, appLabel, map[string]string{recordDiagnosis: string(diagnosisJSON)}); err != nil {
+			logger.WithError(err).Warn("failed to store diagnosis")
+		}
+	}
+	sendWSFailureWithDiagnosis(conn, withTraceID(ctx, diagnosis.Summary), diagnosis)
+}
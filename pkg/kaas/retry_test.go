@@ -0,0 +1,96 @@
+package kaas
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// failDeploymentCreates makes the first n deployment creations fail with err
+func failDeploymentCreates(env *testEnv, n int32, err error) *int32 {
+	var calls int32
+	env.kube.PrependReactor("create", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.AddInt32(&calls, 1) <= n {
+			return true, nil, err
+		}
+		return false, nil, nil
+	})
+	return &calls
+}
+
+func TestCreateInstanceRetriesTransientFailures(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	cfg := testConfig()
+	cfg.Retry.Attempts = 3
+	env := newTestEnv(t, cfg, true)
+	calls := failDeploymentCreates(env, 1, apierrors.NewServiceUnavailable("etcd is unavailable"))
+	conn := env.dial(t)
+
+	messages := createInstance(t, conn, artifacts.URL+testJobRoot, nil)
+	if lastMessage(messages).Action != "done" {
+		t.Fatalf("expected instance to be created on retry, got %v", messages)
+	}
+	retried := false
+	for _, m := range messages {
+		retried = retried || strings.HasPrefix(m.Message, "Attempt 1 of 3 failed, retrying")
+	}
+	if !retried || atomic.LoadInt32(calls) != 2 {
+		t.Errorf("expected a single retry, got %d attempts: %v", atomic.LoadInt32(calls), messages)
+	}
+	instanceDeployment(t, env, messages)
+}
+
+func TestCreateInstanceRollsBackPermanentFailures(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	cfg := testConfig()
+	cfg.Retry.Attempts = 3
+	env := newTestEnv(t, cfg, true)
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Group: "apps", Resource: "deployments"}, "app-kas", nil)
+	calls := failDeploymentCreates(env, 3, forbidden)
+	conn := env.dial(t)
+
+	messages := createInstance(t, conn, artifacts.URL+testJobRoot, nil)
+	failure := lastMessage(messages)
+	if failure.Action != "failure" || !strings.Contains(failure.Message, "Failed to run a new app") {
+		t.Fatalf("expected creation to fail, got %v", messages)
+	}
+	if atomic.LoadInt32(calls) != 1 {
+		t.Errorf("expected permanent failure not to be retried, got %d attempts", atomic.LoadInt32(calls))
+	}
+
+	appLabel := findMessage(messages, "app-label").Message
+	services, err := env.kube.CoreV1().Services(testNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil || len(services.Items) != 0 {
+		t.Errorf("expected services of failed instance to be removed, got %v: %v", services, err)
+	}
+	record, err := env.cluster.runtime.getRecord(context.TODO(), appLabel)
+	if err != nil {
+		t.Fatalf("expected record of failed instance to be kept: %v", err)
+	}
+	if record.Data[recordState] != stateFailed {
+		t.Errorf("expected failure to be recorded, got %v", record.Data)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	if !isRetryable(&Diagnosis{Category: FailureDownload}) {
+		t.Errorf("expected download failures to be retried")
+	}
+	if !isRetryable(&Diagnosis{Category: FailureUnschedulable}) {
+		t.Errorf("expected unschedulable instances to be retried")
+	}
+	if isRetryable(&Diagnosis{Category: FailureTimeout}) {
+		t.Errorf("expected timeouts not to be retried")
+	}
+	if isRetryable(errors.New("boom")) {
+		t.Errorf("expected unknown errors not to be retried")
+	}
+}
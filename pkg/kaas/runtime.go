@@ -0,0 +1,123 @@
+package kaas
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Runtimes running instances
+const (
+	RuntimeKubernetes = "kubernetes"
+	RuntimeLocal      = "local"
+)
+
+// Runtime runs instances placed in a cluster and stores their records.
+// Kubernetes runtime runs instances as Deployments, local runtime runs static-kas processes
+type Runtime interface {
+	recordStore
+
+	// launch starts the instance and returns its URLs, it doesn't wait for the instance to become ready
+	launch(ctx context.Context, logger *logrus.Entry, appLabel string, spec instanceSpec) (*instanceURLs, error)
+	// waitForReady blocks until the instance serves requests. Failures are returned as *Diagnosis
+	waitForReady(ctx context.Context, logger *logrus.Entry, appLabel string) error
+	// exists reports whether the instance is running or being started
+	exists(appLabel string) bool
+	// remove removes the instance and returns a log of removed objects. The instance record is preserved
+	// if keepRecord is set, the instance is then recreated with the same label
+	remove(ctx context.Context, logger *logrus.Entry, appLabel string, keepRecord bool) (string, error)
+	// cleanup removes instances which outlived their lifetime along with stale records
+	cleanup()
+}
+
+// recordStore stores instance records, config maps describing instances.
+// Errors are Kubernetes API errors, e.g. NotFound or Conflict
+type recordStore interface {
+	getRecord(ctx context.Context, appLabel string) (*corev1.ConfigMap, error)
+	listRecords(ctx context.Context, selector string) ([]corev1.ConfigMap, error)
+	createRecord(ctx context.Context, cm *corev1.ConfigMap) error
+	updateRecord(ctx context.Context, cm *corev1.ConfigMap) error
+}
+
+// resumableRuntime is implemented by runtimes whose instances outlive the kaas process,
+// so creations interrupted by a restart can be finished by another process
+type resumableRuntime interface {
+	markInterrupted(ctx context.Context, appLabel string) error
+	resumeInterrupted(ctx context.Context)
+}
+
+// kubeRuntime runs instances as Deployments in the cluster namespace and stores records in config maps
+type kubeRuntime struct {
+	*Cluster
+}
+
+func (k kubeRuntime) launch(ctx context.Context, logger *logrus.Entry, appLabel string, spec instanceSpec) (*instanceURLs, error) {
+	return k.launchKASApp(ctx, logger, appLabel, spec)
+}
+
+// waitForReady waits for the deployment rollout and marks dump caches populated by the instance as ready
+func (k kubeRuntime) waitForReady(ctx context.Context, logger *logrus.Entry, appLabel string) error {
+	if err := k.waitForDeploymentReady(ctx, logger, appLabel); err != nil {
+		return err
+	}
+	cm, err := k.getRecord(ctx, appLabel)
+	if err != nil || cm.Data[recordDump] == "" {
+		return nil
+	}
+	for d, dumpURL := range strings.Split(cm.Data[recordDump], "\n") {
+		k.markDumpCached(ctx, logger, appLabel, dumpURL, "ci-fetcher"+endpointSuffix(d))
+	}
+	return nil
+}
+
+func (k kubeRuntime) exists(appLabel string) bool {
+	return k.instanceExists(appLabel)
+}
+
+// remove deletes instance objects. If the record is kept, it waits for instance pods to disappear,
+// so that the instance could be recreated
+func (k kubeRuntime) remove(ctx context.Context, logger *logrus.Entry, appLabel string, keepRecord bool) (string, error) {
+	output, err := k.deletePods(ctx, logger, appLabel, keepRecord)
+	if err != nil || !keepRecord || k.tracker == nil {
+		return output, err
+	}
+	selector := labels.SelectorFromSet(labels.Set{appLabelKey: appLabel})
+	return output, wait.PollImmediate(rollbackPollInterval, rollbackTimeout, func() (bool, error) {
+		pods, err := k.tracker.pods.List(selector)
+		if err != nil {
+			return false, err
+		}
+		return len(pods) == 0, ctx.Err()
+	})
+}
+
+func (k kubeRuntime) cleanup() {
+	k.cleanupOldDeployments()
+}
+
+func (k kubeRuntime) getRecord(ctx context.Context, appLabel string) (*corev1.ConfigMap, error) {
+	return k.K8sClient.CoreV1().ConfigMaps(k.Namespace).Get(ctx, recordName(appLabel), metav1.GetOptions{})
+}
+
+func (k kubeRuntime) listRecords(ctx context.Context, selector string) ([]corev1.ConfigMap, error) {
+	cmList, err := k.K8sClient.CoreV1().ConfigMaps(k.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return cmList.Items, nil
+}
+
+func (k kubeRuntime) createRecord(ctx context.Context, cm *corev1.ConfigMap) error {
+	_, err := k.K8sClient.CoreV1().ConfigMaps(k.Namespace).Create(ctx, cm, metav1.CreateOptions{})
+	return err
+}
+
+func (k kubeRuntime) updateRecord(ctx context.Context, cm *corev1.ConfigMap) error {
+	_, err := k.K8sClient.CoreV1().ConfigMaps(k.Namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
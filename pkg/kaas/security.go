@@ -0,0 +1,188 @@
+package kaas
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// tmpVolumeName is a writable scratch volume mounted at /tmp, as containers have read-only root filesystem
+	tmpVolumeName = "tmp"
+	tmpSizeLimit  = "256Mi"
+
+	// routerPolicyGroupLabel marks namespaces of the OpenShift router
+	routerPolicyGroupLabel = "network.openshift.io/policy-group"
+
+	// dnsNamespace and dnsPodLabel select cluster DNS pods, the only DNS servers instances may query
+	dnsNamespace = "openshift-dns"
+	dnsPodLabel  = "dns.operator.openshift.io/daemonset-dns"
+)
+
+// privateNetworks are excluded from instance egress, so that dump downloads can't reach cluster internal
+// services or cloud metadata endpoints
+var privateNetworks = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "100.64.0.0/10"}
+
+// extractScript returns shell snippet streaming the tarball from urlVar env var into the working dir.
+// Redirects are not followed, urlVar must hold the URL resolved by resolveURL.
+// GNU tar strips leading "/", members containing ".." and symlinks pointing outside
+// of the working dir fail the extraction
+func extractScript(urlVar string) string {
+	return fmt.Sprintf(`curl -sf --proto =http,https "${%s}" | tar xvz -m --no-overwrite-dir --no-same-owner --no-same-permissions --checkpoint=.100 && \
+		find . -type l -print0 | while IFS= read -r -d '' link; do \
+		  target=$(realpath -m -- "${link}"); \
+		  case "${target}" in "${PWD}"|"${PWD}"/*) ;; *) echo "symlink ${link} points outside of the dump"; exit 1;; esac; \
+		done`, urlVar)
+}
+
+func podSecurityContext() *corev1.PodSecurityContext {
+	runAsNonRoot := true
+	return &corev1.PodSecurityContext{
+		RunAsNonRoot: &runAsNonRoot,
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+func containerSecurityContext() *corev1.SecurityContext {
+	allowPrivilegeEscalation := false
+	readOnlyRootFilesystem := true
+	runAsNonRoot := true
+	return &corev1.SecurityContext{
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		RunAsNonRoot:             &runAsNonRoot,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+}
+
+// hardenPodSpec runs all containers as non-root with read-only root filesystem and no capabilities,
+// mounts a writable /tmp into them and disables service account token and host namespaces.
+// It's applied after the instance template, so the template can't undo it
+func hardenPodSpec(spec *corev1.PodSpec) {
+	automountToken := false
+	spec.AutomountServiceAccountToken = &automountToken
+	spec.SecurityContext = podSecurityContext()
+	spec.HostNetwork = false
+	spec.HostPID = false
+	spec.HostIPC = false
+
+	tmpLimit := resource.MustParse(tmpSizeLimit)
+	volumes := []corev1.Volume{}
+	for _, volume := range spec.Volumes {
+		if volume.Name != tmpVolumeName {
+			volumes = append(volumes, volume)
+		}
+	}
+	spec.Volumes = append(volumes, corev1.Volume{
+		Name: tmpVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{SizeLimit: &tmpLimit},
+		},
+	})
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			containers[i].SecurityContext = containerSecurityContext()
+			mounts := []corev1.VolumeMount{}
+			for _, mount := range containers[i].VolumeMounts {
+				if mount.Name != tmpVolumeName && mount.MountPath != "/tmp" {
+					mounts = append(mounts, mount)
+				}
+			}
+			containers[i].VolumeMounts = append(mounts, corev1.VolumeMount{
+				Name:      tmpVolumeName,
+				MountPath: "/tmp",
+			})
+		}
+	}
+}
+
+// instanceNetworkPolicy allows ingress to the instance from the router only and egress to cluster DNS and
+// HTTP(S) servers outside of private networks to download dumps
+func instanceNetworkPolicy(appLabel string) *networkingv1.NetworkPolicy {
+	tcp := corev1.ProtocolTCP
+	udp := corev1.ProtocolUDP
+	port := func(protocol *corev1.Protocol, port int) networkingv1.NetworkPolicyPort {
+		p := intstr.FromInt(port)
+		return networkingv1.NetworkPolicyPort{Protocol: protocol, Port: &p}
+	}
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: appLabel,
+			Labels: map[string]string{
+				"app": appLabel,
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": appLabel,
+				},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					From: []networkingv1.NetworkPolicyPeer{
+						{
+							NamespaceSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{routerPolicyGroupLabel: "ingress"},
+							},
+						},
+					},
+				},
+			},
+			Egress: []networkingv1.NetworkPolicyEgressRule{
+				{
+					To: []networkingv1.NetworkPolicyPeer{
+						{
+							NamespaceSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{"kubernetes.io/metadata.name": dnsNamespace},
+							},
+							PodSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{dnsPodLabel: "default"},
+							},
+						},
+					},
+					Ports: []networkingv1.NetworkPolicyPort{
+						port(&udp, 53), port(&tcp, 53), port(&udp, 5353), port(&tcp, 5353),
+					},
+				},
+				{
+					To: []networkingv1.NetworkPolicyPeer{
+						{
+							IPBlock: &networkingv1.IPBlock{
+								CIDR:   "0.0.0.0/0",
+								Except: privateNetworks,
+							},
+						},
+					},
+					Ports: []networkingv1.NetworkPolicyPort{
+						port(&tcp, 80), port(&tcp, 443),
+					},
+				},
+			},
+		},
+	}
+}
+
+// createNetworkPolicy isolates the instance pod
+func (c *Cluster) createNetworkPolicy(ctx context.Context, logger *logrus.Entry, appLabel string) error {
+	policy := instanceNetworkPolicy(appLabel)
+	spanCtx, span := startSpan(ctx, "create network policy", attrObject.String(policy.Name))
+	_, err := c.K8sClient.NetworkingV1().NetworkPolicies(c.Namespace).Create(spanCtx, policy, metav1.CreateOptions{})
+	endSpan(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to create network policy: %w", err)
+	}
+	logger.WithField("networkpolicy", policy.Name).Debug("created network policy")
+	return nil
+}
@@ -0,0 +1,202 @@
+package kaas
+
+import (
+	"archive/tar"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHardenPodSpec(t *testing.T) {
+	privileged := true
+	spec := &corev1.PodSpec{
+		HostPID: true,
+		HostIPC: true,
+		Volumes: []corev1.Volume{{Name: tmpVolumeName}, {Name: "must-gather-volume"}},
+		InitContainers: []corev1.Container{{
+			Name:         "ci-fetcher",
+			VolumeMounts: []corev1.VolumeMount{{Name: "scratch", MountPath: "/tmp"}, {Name: "must-gather-volume", MountPath: "/must-gather/"}},
+		}},
+		Containers: []corev1.Container{{
+			Name:            "kas",
+			SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+		}},
+	}
+	hardenPodSpec(spec)
+
+	if spec.HostPID || spec.HostIPC || spec.SecurityContext == nil || !*spec.SecurityContext.RunAsNonRoot {
+		t.Errorf("expected pod to be isolated from the host and run as non-root, got %+v", spec)
+	}
+	tmpVolumes := 0
+	for _, volume := range spec.Volumes {
+		if volume.Name == tmpVolumeName {
+			tmpVolumes++
+			if volume.EmptyDir == nil || volume.EmptyDir.SizeLimit == nil || volume.EmptyDir.SizeLimit.String() != tmpSizeLimit {
+				t.Errorf("expected /tmp to be a limited emptyDir, got %+v", volume)
+			}
+		}
+	}
+	if tmpVolumes != 1 || len(spec.Volumes) != 2 {
+		t.Errorf("expected a single /tmp volume, got %+v", spec.Volumes)
+	}
+	for _, container := range append(spec.InitContainers, spec.Containers...) {
+		sc := container.SecurityContext
+		if sc == nil || sc.Privileged != nil || !*sc.ReadOnlyRootFilesystem || *sc.AllowPrivilegeEscalation || len(sc.Capabilities.Drop) != 1 {
+			t.Errorf("expected container %s to be hardened, got %+v", container.Name, sc)
+		}
+		tmpMounts := []string{}
+		for _, mount := range container.VolumeMounts {
+			if mount.MountPath == "/tmp" {
+				tmpMounts = append(tmpMounts, mount.Name)
+			}
+		}
+		if len(tmpMounts) != 1 || tmpMounts[0] != tmpVolumeName {
+			t.Errorf("expected container %s to mount /tmp from %s only, got %v", container.Name, tmpVolumeName, tmpMounts)
+		}
+	}
+}
+
+func TestInstanceNetworkPolicy(t *testing.T) {
+	policy := instanceNetworkPolicy("app")
+	if policy.Spec.PodSelector.MatchLabels["app"] != "app" || len(policy.Spec.PolicyTypes) != 2 {
+		t.Errorf("expected ingress and egress of the instance to be isolated, got %+v", policy.Spec)
+	}
+	if len(policy.Spec.Ingress) != 1 || len(policy.Spec.Ingress[0].From) != 1 ||
+		policy.Spec.Ingress[0].From[0].NamespaceSelector.MatchLabels[routerPolicyGroupLabel] != "ingress" {
+		t.Errorf("expected ingress from router only, got %+v", policy.Spec.Ingress)
+	}
+	download := policy.Spec.Egress[1]
+	if len(download.To) != 1 || download.To[0].IPBlock == nil || strings.Join(download.To[0].IPBlock.Except, ",") != strings.Join(privateNetworks, ",") {
+		t.Errorf("expected downloads not to reach private networks, got %+v", download.To)
+	}
+	ports := []string{}
+	for _, port := range download.Ports {
+		ports = append(ports, port.Port.String())
+	}
+	if strings.Join(ports, ",") != "80,443" {
+		t.Errorf("expected downloads over HTTP(S) only, got %v", ports)
+	}
+}
+
+func TestInstanceNetworkPolicyDNSEgress(t *testing.T) {
+	policy := instanceNetworkPolicy("app")
+	dns := policy.Spec.Egress[0]
+	if len(dns.To) != 1 {
+		t.Fatalf("expected DNS egress to be limited to cluster DNS, got %+v", dns.To)
+	}
+	peer := dns.To[0]
+	if peer.NamespaceSelector == nil || peer.NamespaceSelector.MatchLabels["kubernetes.io/metadata.name"] != dnsNamespace {
+		t.Errorf("expected DNS egress to %s namespace, got %+v", dnsNamespace, peer.NamespaceSelector)
+	}
+	if peer.PodSelector == nil || peer.PodSelector.MatchLabels[dnsPodLabel] != "default" {
+		t.Errorf("expected DNS egress to cluster DNS pods, got %+v", peer.PodSelector)
+	}
+	for _, rule := range policy.Spec.Egress {
+		if len(rule.To) == 0 {
+			t.Errorf("expected every egress rule to have destinations, got %+v", rule)
+		}
+	}
+}
+
+func TestExtractScript(t *testing.T) {
+	for _, tool := range []string{"bash", "curl", "tar", "realpath"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not available: %v", tool, err)
+		}
+	}
+	for _, tc := range []struct {
+		name      string
+		members   []tar.Header
+		extracted []string
+		fails     bool
+	}{
+		{
+			name: "regular dump",
+			members: []tar.Header{
+				{Name: "must-gather/", Typeflag: tar.TypeDir, Mode: 0o755},
+				{Name: "must-gather/version", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "must-gather/latest", Typeflag: tar.TypeSymlink, Linkname: "version"},
+			},
+			extracted: []string{"must-gather/version", "must-gather/latest"},
+		},
+		{
+			name: "absolute path",
+			members: []tar.Header{
+				{Name: "/abs", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			extracted: []string{"abs"},
+		},
+		{
+			name: "parent path",
+			members: []tar.Header{
+				{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			fails: true,
+		},
+		{
+			name: "symlink outside of the dump",
+			members: []tar.Header{
+				{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+			},
+			fails: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			archive := tarball(t, tc.members...).Bytes()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(archive)
+			}))
+			defer server.Close()
+			root := t.TempDir()
+			dir := filepath.Join(root, "dump")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command("bash", "-c", "set -uo pipefail && "+extractScript("DUMPTAR"))
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), "DUMPTAR="+server.URL+"/must-gather.tar")
+			out, err := cmd.CombinedOutput()
+			if tc.fails != (err != nil) {
+				t.Fatalf("expected extraction to fail: %v, got %v: %s", tc.fails, err, out)
+			}
+			for _, name := range tc.extracted {
+				if _, err := os.Lstat(filepath.Join(dir, name)); err != nil {
+					t.Errorf("expected %s to be extracted: %v", name, err)
+				}
+			}
+			if _, err := os.Lstat(filepath.Join(root, "escaped")); err == nil {
+				t.Errorf("expected members outside of the working dir not to be extracted")
+			}
+		})
+	}
+}
+
+func TestNewKASIsolatesInstance(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	env := newTestEnv(t, testConfig(), true)
+	conn := env.dial(t)
+
+	messages := createInstance(t, conn, artifacts.URL+testJobRoot, nil)
+	if lastMessage(messages).Action != "done" {
+		t.Fatalf("expected instance to be created, got %v", messages)
+	}
+	appLabel := findMessage(messages, "app-label").Message
+	if _, err := env.kube.NetworkingV1().NetworkPolicies(testNamespace).Get(context.TODO(), appLabel, metav1.GetOptions{}); err != nil {
+		t.Errorf("expected network policy of the instance: %v", err)
+	}
+	spec := instanceDeployment(t, env, messages).Spec.Template.Spec
+	for _, container := range append(spec.InitContainers, spec.Containers...) {
+		if sc := container.SecurityContext; sc == nil || sc.ReadOnlyRootFilesystem == nil || !*sc.ReadOnlyRootFilesystem {
+			t.Errorf("expected container %s to have read-only root filesystem, got %+v", container.Name, sc)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package kaas
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// dumpHashLabel stores a hash of the dump URL on instance records, so instances can be found by dump
+	dumpHashLabel  = "kaas.openshift.io/dump-hash"
+	dumpHashLength = 32
+)
+
+// Instance states stored in the record
+const (
+	stateStarting = "starting"
+	stateReady    = "ready"
+	stateFailed   = "failed"
+)
+
+// Keys of instance record config map used for sharing
+const (
+	recordState      = "state"
+	recordRefCount   = "refcount"
+	recordAcquiredAt = "acquiredAt"
+	recordEndpoints  = "endpoints.json"
+	recordCompanions = "companions.json"
+	recordHeadless   = "headless"
+)
+
+// sharedInstance describes an instance which can be reused for the same dump
+type sharedInstance struct {
+	AppLabel string
+	Cluster  string
+	State    string
+	RefCount int
+}
+
+func dumpHash(dumpURL string) string {
+	sum := sha256.Sum256([]byte(dumpURL))
+	return hex.EncodeToString(sum[:])[:dumpHashLength]
+}
+
+// findSharedInstance looks up a ready or starting instance serving the same dumps in connected clusters.
+// Headless instances are offered only if console is not requested
+func (s *ServerSettings) findSharedInstance(ctx context.Context, dumpURLs []string, headless bool) (*sharedInstance, error) {
+	for _, cluster := range s.connectedClusters() {
+		shared, err := cluster.findSharedInstance(ctx, dumpURLs, headless)
+		if err != nil || shared != nil {
+			return shared, err
+		}
+	}
+	return nil, nil
+}
+
+// findSharedInstance looks up a shared instance in the cluster
+func (c *Cluster) findSharedInstance(ctx context.Context, dumpURLs []string, headless bool) (*sharedInstance, error) {
+	dumps := dumpsKey(dumpURLs)
+	selector := labels.SelectorFromSet(labels.Set{dumpHashLabel: dumpHash(dumps)}).String()
+	records, err := c.runtime.listRecords(ctx, selector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instance records: %v", err)
+	}
+	for _, cm := range records {
+		// Guard against hash collisions
+		if cm.Data[recordDump] != dumps {
+			continue
+		}
+		if !headless && cm.Data[recordHeadless] == "true" {
+			continue
+		}
+		state := cm.Data[recordState]
+		if state != stateStarting && state != stateReady {
+			continue
+		}
+		// Records of instances lost along with a crashed replica are left behind
+		if !c.runtime.exists(cm.Labels[appLabelKey]) {
+			continue
+		}
+		refCount, _ := strconv.Atoi(cm.Data[recordRefCount])
+		return &sharedInstance{
+			AppLabel: cm.Labels[appLabelKey],
+			Cluster:  c.Name,
+			State:    state,
+			RefCount: refCount,
+		}, nil
+	}
+	return nil, nil
+}
+
+// changeRefCount adds delta to instance reference count and returns the new value
+func (c *Cluster) changeRefCount(ctx context.Context, appLabel string, delta int) (int, error) {
+	refCount := 0
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := c.runtime.getRecord(ctx, appLabel)
+		if err != nil {
+			return err
+		}
+		refCount, _ = strconv.Atoi(cm.Data[recordRefCount])
+		refCount += delta
+		if refCount < 0 {
+			refCount = 0
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[recordRefCount] = strconv.Itoa(refCount)
+		if delta > 0 {
+			cm.Data[recordAcquiredAt] = time.Now().UTC().Format(time.RFC3339)
+		}
+		return c.runtime.updateRecord(ctx, cm)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update reference count: %w", err)
+	}
+	return refCount, nil
+}
+
+// acquireInstance registers another user of the instance
+func (c *Cluster) acquireInstance(ctx context.Context, appLabel string) (int, error) {
+	return c.changeRefCount(ctx, appLabel, 1)
+}
+
+// releaseInstance unregisters a user of the instance and returns the number of remaining users
+func (c *Cluster) releaseInstance(ctx context.Context, appLabel string) (int, error) {
+	return c.changeRefCount(ctx, appLabel, -1)
+}
+
+// instanceExpired reports whether the instance created at createdAt should be removed by cleanup.
+// Instances in use live until MaxLifetime since creation, released ones for Lifetime since they were last acquired
+func (c *Cluster) instanceExpired(ctx context.Context, appLabel string, createdAt, now time.Time) bool {
+	cfg := c.Config()
+	if now.After(createdAt.Add(cfg.MaxLifetime.Duration)) {
+		return true
+	}
+	expiresAt := createdAt.Add(cfg.Lifetime.Duration)
+	cm, err := c.runtime.getRecord(ctx, appLabel)
+	if err != nil {
+		return now.After(expiresAt)
+	}
+	if refCount, _ := strconv.Atoi(cm.Data[recordRefCount]); refCount > 0 {
+		return false
+	}
+	if acquiredAt, err := time.Parse(time.RFC3339, cm.Data[recordAcquiredAt]); err == nil && acquiredAt.Add(cfg.Lifetime.Duration).After(expiresAt) {
+		expiresAt = acquiredAt.Add(cfg.Lifetime.Duration)
+	}
+	return now.After(expiresAt)
+}
+
+// offerSharedInstance tells the user that an instance for the same dump exists
+func offerSharedInstance(conn *wsConn, shared *sharedInstance, rawURL string, dumpURLs []string) {
+	dumps, _ := json.Marshal(dumpURLs)
+	data := map[string]string{
+		"hash":     shared.AppLabel,
+		"cluster":  shared.Cluster,
+		"state":    shared.State,
+		"refcount": strconv.Itoa(shared.RefCount),
+		"url":      rawURL,
+		"dumps":    string(dumps),
+	}
+	sendWSMessageWithData(conn, "existing",
+		fmt.Sprintf("Instance %s for this dump is %s and used by %d user(s)", shared.AppLabel, shared.State, shared.RefCount), data)
+}
+
+// shareKAS attaches the user to an existing instance
+func (s *ServerSettings) shareKAS(connID string, conn *wsConn, appLabel string) {
+	ctx, span := startSpan(context.Background(), "shareKAS", attrInstance.String(appLabel))
+	defer span.End()
+
+	logger := s.instanceLogger(connID, appLabel, "").WithField(logFieldTrace, traceID(ctx))
+	if err := s.Ready(); err != nil {
+		sendWSMessage(conn, "failure", err.Error())
+		return
+	}
+
+	cluster, err := s.findInstanceCluster(ctx, appLabel)
+	if err == nil && cluster == nil {
+		err = fmt.Errorf("instance not found")
+	}
+	if err != nil {
+		logger.WithError(err).Warn("failed to find shared instance")
+		sendWSMessage(conn, "failure", withTraceID(ctx, fmt.Sprintf("Failed to reuse instance %s: %v", appLabel, err)))
+		return
+	}
+	logger = logger.WithField(logFieldCluster, cluster.Name)
+
+	refCount, err := cluster.acquireInstance(ctx, appLabel)
+	if err != nil {
+		logger.WithError(err).Warn("failed to acquire shared instance")
+		sendWSMessage(conn, "failure", withTraceID(ctx, fmt.Sprintf("Failed to reuse instance %s: %v", appLabel, err)))
+		return
+	}
+	logger.WithField(recordRefCount, refCount).Info("sharing instance")
+	sendWSMessage(conn, "app-label", appLabel)
+
+	sendWSMessage(conn, "progress", "Waiting for pods to become ready")
+	if err := cluster.waitForDeploymentReady(ctx, logger, appLabel); err != nil {
+		if _, relErr := cluster.releaseInstance(ctx, appLabel); relErr != nil {
+			logger.WithError(relErr).Warn("failed to release shared instance")
+		}
+		cluster.reportCreationFailure(ctx, logger, conn, appLabel, err)
+		return
+	}
+	cluster.sendInstanceReady(ctx, logger, conn, appLabel)
+}
+
+// sendInstanceReady sends kubeconfig and links of a ready instance stored in its record
+func (c *Cluster) sendInstanceReady(ctx context.Context, logger *logrus.Entry, conn *wsConn, appLabel string) {
+	cm, err := c.runtime.getRecord(ctx, appLabel)
+	if err != nil {
+		sendWSMessage(conn, "failure", withTraceID(ctx, fmt.Sprintf("Failed to read instance record: %v", err)))
+		return
+	}
+	endpoints, err := unmarshalEndpoints(cm.Data[recordEndpoints])
+	if err != nil || len(endpoints) == 0 {
+		sendWSMessage(conn, "failure", withTraceID(ctx, fmt.Sprintf("Instance %s has no endpoints recorded", appLabel)))
+		return
+	}
+	if jobJSON, ok := cm.Data[recordJob]; ok {
+		sendWSMessage(conn, "job", jobJSON)
+	}
+	urls := &instanceURLs{Endpoints: endpoints}
+	if companions, ok := cm.Data[recordCompanions]; ok {
+		if err := json.Unmarshal([]byte(companions), &urls.Companions); err != nil {
+			logger.WithError(err).Warn("failed to parse instance companions")
+		}
+	}
+	sendWSMessage(conn, "kubeconfig", renderKubeconfig(endpoints))
+	sendInstanceLinks(logger, conn, appLabel, urls)
+}
+
+// sendInstanceLinks sends console links and marks the instance ready in the UI.
+// Instances serving several dumps get a single message listing all consoles
+func sendInstanceLinks(logger *logrus.Entry, conn *wsConn, appLabel string, urls *instanceURLs) {
+	endpoints := urls.Endpoints
+	switch consoles := consoleLinks(endpoints); {
+	case len(consoles) == 0:
+		sendWSMessage(conn, "status", "Console is disabled, use kubeconfig to access the instance")
+	case len(endpoints) == 1:
+		sendWSMessage(conn, "link", endpoints[0].ConsoleURL)
+	default:
+		sendWSMessageWithData(conn, "links", "Consoles", consoles)
+	}
+	if len(urls.Companions) != 0 {
+		sendWSMessageWithData(conn, "links", "Metrics", urls.Companions)
+	}
+
+	data := map[string]string{
+		"hash": appLabel,
+		"url":  endpoints[0].APIURL,
+	}
+	logger.Info("instance is ready")
+	sendWSMessageWithData(conn, "done", "Pod is ready", data)
+}
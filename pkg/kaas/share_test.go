@@ -0,0 +1,45 @@
+package kaas
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestFindSharedInstanceSkipsOrphanedRecords(t *testing.T) {
+	dumpURL := "https://example.com/must-gather.tar"
+	now := time.Now()
+	running := testInstance("running", now, now)
+	orphaned := testInstance("orphaned", now, now)
+	for _, record := range []*corev1.ConfigMap{running[2].(*corev1.ConfigMap), orphaned[2].(*corev1.ConfigMap)} {
+		record.Data[recordDump] = dumpURL
+		record.Labels[dumpHashLabel] = dumpHash(dumpURL)
+	}
+	// The orphaned instance has a record only, e.g. its replica crashed while creating it
+	env := newTestEnv(t, testConfig(), true, append(running, orphaned[2])...)
+
+	shared, err := env.cluster.findSharedInstance(context.TODO(), []string{dumpURL}, true)
+	if err != nil {
+		t.Fatalf("failed to find shared instance: %v", err)
+	}
+	if shared == nil || shared.AppLabel != "running" {
+		t.Errorf("expected running instance to be offered, got %+v", shared)
+	}
+
+	if err := env.kube.AppsV1().Deployments(testNamespace).Delete(context.TODO(), "running-kas", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, testReadTimeout, func() (bool, error) {
+		return !env.cluster.instanceExists("running"), nil
+	})
+	if err != nil {
+		t.Fatalf("expected tracker to observe removed deployment")
+	}
+	if shared, err := env.cluster.findSharedInstance(context.TODO(), []string{dumpURL}, true); err != nil || shared != nil {
+		t.Errorf("expected no instance to be offered, got %+v: %v", shared, err)
+	}
+}
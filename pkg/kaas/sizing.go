@@ -0,0 +1,191 @@
+package kaas
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// gcsAPIURL is the JSON API of Google Cloud Storage, used to read object size when gcsweb doesn't report it
+const gcsAPIURL = "https://storage.googleapis.com/storage/v1"
+
+// validate checks that tiers are ordered by dump size and their quantities parse
+func (c DumpSizing) validate() error {
+	if c.MaxDumpSize != "" {
+		if _, err := resource.ParseQuantity(c.MaxDumpSize); err != nil {
+			return fmt.Errorf("invalid sizing.maxDumpSize %q: %v", c.MaxDumpSize, err)
+		}
+	}
+	var previous *resource.Quantity
+	for i, tier := range c.Tiers {
+		dumpSize, err := resource.ParseQuantity(tier.DumpSize)
+		if err != nil {
+			return fmt.Errorf("invalid sizing.tiers[%d].dumpSize %q: %v", i, tier.DumpSize, err)
+		}
+		if previous != nil && dumpSize.Cmp(*previous) <= 0 {
+			return fmt.Errorf("sizing.tiers must be ordered by increasing dumpSize")
+		}
+		previous = &dumpSize
+
+		memory, err := resource.ParseQuantity(tier.Memory)
+		if err != nil {
+			return fmt.Errorf("invalid sizing.tiers[%d].memory %q: %v", i, tier.Memory, err)
+		}
+		if tier.MemoryLimit != "" {
+			limit, err := resource.ParseQuantity(tier.MemoryLimit)
+			if err != nil {
+				return fmt.Errorf("invalid sizing.tiers[%d].memoryLimit %q: %v", i, tier.MemoryLimit, err)
+			}
+			if limit.Cmp(memory) < 0 {
+				return fmt.Errorf("sizing.tiers[%d].memoryLimit must not be lower than memory", i)
+			}
+		}
+		if tier.EphemeralStorage != "" {
+			if _, err := resource.ParseQuantity(tier.EphemeralStorage); err != nil {
+				return fmt.Errorf("invalid sizing.tiers[%d].ephemeralStorage %q: %v", i, tier.EphemeralStorage, err)
+			}
+		}
+	}
+	return nil
+}
+
+// tierFor returns the tier of a dump archive of the given size, nil if size is unknown or no tiers are configured
+func (c DumpSizing) tierFor(size int64) *SizeTier {
+	if size < 0 || len(c.Tiers) == 0 {
+		return nil
+	}
+	for i, tier := range c.Tiers {
+		dumpSize := resource.MustParse(tier.DumpSize)
+		if size <= dumpSize.Value() {
+			return &c.Tiers[i]
+		}
+	}
+	return &c.Tiers[len(c.Tiers)-1]
+}
+
+// kasResources returns resources of static-kas serving a dump of the tier, configured resources are used if tier is nil.
+// Ephemeral storage is requested by the container serving the dump from emptyDir only
+func kasResources(cfg Config, tier *SizeTier, ephemeral bool) corev1.ResourceRequirements {
+	if tier == nil {
+		return cfg.Resources.KAS.requirements()
+	}
+	resources := ContainerResources{
+		CPU:         cfg.Resources.KAS.CPU,
+		Memory:      tier.Memory,
+		MemoryLimit: tier.MemoryLimit,
+	}.requirements()
+	if ephemeral && tier.EphemeralStorage != "" {
+		if resources.Limits == nil {
+			resources.Limits = corev1.ResourceList{}
+		}
+		resources.Requests[corev1.ResourceEphemeralStorage] = resource.MustParse(tier.EphemeralStorage)
+		resources.Limits[corev1.ResourceEphemeralStorage] = resource.MustParse(tier.EphemeralStorage)
+	}
+	return resources
+}
+
+// gcsObjectURL returns GCS JSON API URL of the object behind a gcsweb link, e.g.
+// ".../gcs/origin-ci-test/logs/job/1/artifacts/must-gather.tar"
+func gcsObjectURL(dumpURL string) (string, bool) {
+	u, err := url.Parse(dumpURL)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 3)
+	if len(parts) != 3 || parts[0] != "gcs" || parts[1] == "" || parts[2] == "" {
+		return "", false
+	}
+	return fmt.Sprintf("%s/b/%s/o/%s", gcsAPIURL, url.PathEscape(parts[1]), url.PathEscape(parts[2])), true
+}
+
+// fetchDumpSize returns the size of the dump archive, -1 if it's unknown.
+// Content-Length of HEAD response is used, falling back to GCS object metadata
+func fetchDumpSize(ctx context.Context, logger *logrus.Entry, dumpURL string) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "fetchDumpSize", attrURL.String(dumpURL))
+	defer func() { endSpan(span, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, dumpURL, nil)
+	if err != nil {
+		return -1, err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return -1, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return -1, fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
+	}
+	if res.ContentLength > 0 {
+		return res.ContentLength, nil
+	}
+
+	objectURL, ok := gcsObjectURL(dumpURL)
+	if !ok {
+		return -1, nil
+	}
+	var object struct {
+		Size string `json:"size"`
+	}
+	if err := fetchJSON(ctx, objectURL, &object); err != nil {
+		logger.WithError(err).WithField("url", objectURL).Debug("failed to fetch GCS object metadata")
+		return -1, nil
+	}
+	size, err := strconv.ParseInt(object.Size, 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("invalid GCS object size %q: %v", object.Size, err)
+	}
+	return size, nil
+}
+
+// formatSize returns a human readable size
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// dumpSizes looks up sizes of dump archives, negative if unknown.
+// It fails if any of the dumps is larger than the configured maximum
+func (s *ServerSettings) dumpSizes(ctx context.Context, logger *logrus.Entry, conn *wsConn, dumpURLs []string) ([]int64, error) {
+	sizing := s.Config().Sizing
+	var maxSize int64 = -1
+	if sizing.MaxDumpSize != "" {
+		maxQuantity := resource.MustParse(sizing.MaxDumpSize)
+		maxSize = maxQuantity.Value()
+	}
+
+	sizes := make([]int64, 0, len(dumpURLs))
+	for _, dumpURL := range dumpURLs {
+		dumpLogger := logger.WithField("dump", dumpURL)
+		size, err := fetchDumpSize(ctx, dumpLogger, dumpURL)
+		if err != nil {
+			dumpLogger.WithError(err).Warn("failed to get dump size")
+		}
+		switch {
+		case size < 0:
+			sendWSMessage(conn, "status", fmt.Sprintf("Size of %s is unknown, using default resources", dumpURL))
+		case maxSize >= 0 && size > maxSize:
+			return nil, fmt.Errorf("Dump %s is %s, larger than the maximum of %s", dumpURL, formatSize(size), formatSize(maxSize))
+		default:
+			dumpLogger.WithField("size", size).Debug("found dump size")
+			sendWSMessage(conn, "status", fmt.Sprintf("Dump %s is %s", dumpURL, formatSize(size)))
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
@@ -0,0 +1,157 @@
+package kaas
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestTierFor(t *testing.T) {
+	sizing := DefaultConfig().Sizing
+	for _, tc := range []struct {
+		size     int64
+		expected string
+	}{
+		{size: 10 << 20, expected: "100Mi"},
+		{size: 100 << 20, expected: "100Mi"},
+		{size: 100<<20 + 1, expected: "500Mi"},
+		{size: 10 << 30, expected: "2Gi"},
+	} {
+		if tier := sizing.tierFor(tc.size); tier == nil || tier.DumpSize != tc.expected {
+			t.Errorf("expected tier %s for %d, got %+v", tc.expected, tc.size, tier)
+		}
+	}
+	if tier := sizing.tierFor(-1); tier != nil {
+		t.Errorf("expected no tier for unknown size, got %+v", tier)
+	}
+	if tier := (DumpSizing{}).tierFor(1); tier != nil {
+		t.Errorf("expected no tier without configured tiers, got %+v", tier)
+	}
+}
+
+func TestDumpSizingValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		sizing  DumpSizing
+		message string
+	}{
+		{name: "defaults", sizing: DefaultConfig().Sizing},
+		{
+			name:    "invalid max size",
+			sizing:  DumpSizing{MaxDumpSize: "lots"},
+			message: "invalid sizing.maxDumpSize",
+		},
+		{
+			name: "unordered tiers",
+			sizing: DumpSizing{Tiers: []SizeTier{
+				{DumpSize: "1Gi", Memory: "1Gi"},
+				{DumpSize: "100Mi", Memory: "500Mi"},
+			}},
+			message: "ordered by increasing dumpSize",
+		},
+		{
+			name:    "limit below request",
+			sizing:  DumpSizing{Tiers: []SizeTier{{DumpSize: "1Gi", Memory: "1Gi", MemoryLimit: "500Mi"}}},
+			message: "memoryLimit must not be lower than memory",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.sizing.validate()
+			if tc.message == "" && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if tc.message != "" && (err == nil || !strings.Contains(err.Error(), tc.message)) {
+				t.Errorf("expected error containing %q, got %v", tc.message, err)
+			}
+		})
+	}
+}
+
+func TestKASResources(t *testing.T) {
+	cfg := testConfig()
+	configured := cfg.Resources.KAS.requirements()
+	if resources := kasResources(cfg, nil, true); resources.Requests.Memory().Cmp(*configured.Requests.Memory()) != 0 {
+		t.Errorf("expected configured resources without tier, got %v", resources)
+	}
+	tier := &cfg.Sizing.Tiers[1]
+	resources := kasResources(cfg, tier, true)
+	if resources.Requests.Memory().String() != "1Gi" || resources.Limits.Memory().String() != "2Gi" {
+		t.Errorf("expected memory of the tier, got %v", resources)
+	}
+	if storage := resources.Limits[corev1.ResourceEphemeralStorage]; storage.String() != "8Gi" {
+		t.Errorf("expected ephemeral storage of the tier, got %v", resources)
+	}
+	if _, ok := kasResources(cfg, tier, false).Requests[corev1.ResourceEphemeralStorage]; ok {
+		t.Errorf("expected no ephemeral storage for dumps served from volumes")
+	}
+}
+
+func TestGCSObjectURL(t *testing.T) {
+	objectURL, ok := gcsObjectURL("https://gcsweb-ci.example.com/gcs/origin-ci-test/logs/job/1/artifacts/must-gather.tar")
+	if !ok || objectURL != gcsAPIURL+"/b/origin-ci-test/o/logs%2Fjob%2F1%2Fartifacts%2Fmust-gather.tar" {
+		t.Errorf("unexpected object URL %q", objectURL)
+	}
+	if _, ok := gcsObjectURL("https://example.com/logs/must-gather.tar"); ok {
+		t.Errorf("expected no object URL outside of gcsweb")
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for size, expected := range map[int64]string{
+		512:       "512 B",
+		1536:      "1.5 KiB",
+		200 << 20: "200.0 MiB",
+		3 << 30:   "3.0 GiB",
+	} {
+		if formatted := formatSize(size); formatted != expected {
+			t.Errorf("expected %q for %d, got %q", expected, size, formatted)
+		}
+	}
+}
+
+func TestFetchDumpSize(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	size, err := fetchDumpSize(context.TODO(), testLogger(), artifacts.URL+testJobRoot+"artifacts/"+testDumpPath)
+	if err != nil || size != int64(len("dump archive")) {
+		t.Errorf("expected size from Content-Length, got %d: %v", size, err)
+	}
+	if _, err := fetchDumpSize(context.TODO(), testLogger(), artifacts.URL+testJobRoot+"artifacts/missing.tar"); err == nil {
+		t.Errorf("expected missing dump to fail")
+	}
+}
+
+func TestNewKASSizesInstance(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	env := newTestEnv(t, testConfig(), true)
+	conn := env.dial(t)
+
+	messages := createInstance(t, conn, artifacts.URL+testJobRoot, nil)
+	if lastMessage(messages).Action != "done" {
+		t.Fatalf("expected instance to be created, got %v", messages)
+	}
+	for _, container := range instanceDeployment(t, env, messages).Spec.Template.Spec.Containers {
+		if container.Name != "kas" {
+			continue
+		}
+		if memory := container.Resources.Requests.Memory().String(); memory != "500Mi" {
+			t.Errorf("expected static-kas to use the smallest tier, got %s", memory)
+		}
+		return
+	}
+	t.Errorf("expected static-kas container")
+}
+
+func TestNewKASRefusesLargeDumps(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	cfg := testConfig()
+	cfg.Sizing.MaxDumpSize = "8"
+	env := newTestEnv(t, cfg, true)
+	conn := env.dial(t)
+
+	failure := lastMessage(createInstance(t, conn, artifacts.URL+testJobRoot, nil))
+	if failure.Action != "failure" || !strings.Contains(failure.Message, "is 12 B, larger than the maximum of 8 B") {
+		t.Errorf("expected large dump to be refused, got %v", failure)
+	}
+}
@@ -0,0 +1,147 @@
+package kaas
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"text/template"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+)
+
+// InstanceTemplate customizes instance deployments. The template is a Go-templated YAML
+// rendered with TemplateVars and applied to the generated deployment as a strategic merge patch,
+// so containers are merged by name and lists like tolerations can be extended
+type InstanceTemplate struct {
+	tmpl *template.Template
+}
+
+// TemplateVars are variables available in the instance template
+type TemplateVars struct {
+	AppLabel string
+	// Cluster and Region describe the target cluster the instance is placed in
+	Cluster   string
+	Region    string
+	Namespace string
+	// DumpURL and APIURL are the first dump and its API URL, DumpURLs and APIURLs list all of them
+	DumpURL  string
+	DumpURLs []string
+	APIURL   string
+	APIURLs  []string
+	// Job is the Prow job which produced dumps, nil if unknown
+	Job *JobInfo
+}
+
+// templateFuncs are available in the instance template. Variables like DumpURL come from users,
+// so they must be rendered with quote or toJson rather than put into YAML as is
+var templateFuncs = template.FuncMap{
+	"quote":  toJSON,
+	"toJson": toJSON,
+}
+
+// toJSON renders the value as JSON, which is valid YAML flow scalar or collection
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// LoadInstanceTemplate reads the instance template and checks it renders into a valid patch
+func LoadInstanceTemplate(path string) (*InstanceTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instance template: %v", err)
+	}
+	tmpl, err := template.New(filepath.Base(path)).Option("missingkey=error").Funcs(templateFuncs).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse instance template: %v", err)
+	}
+	t := &InstanceTemplate{tmpl: tmpl}
+
+	sample := TemplateVars{
+		AppLabel:  "example",
+		Namespace: "kaas",
+		DumpURL:   "https://example.com/artifacts/e2e/gather-must-gather/artifacts/must-gather.tar",
+		APIURL:    "https://example-api.apps.example.com",
+		Job:       &JobInfo{Job: "example-job", BuildID: "1"},
+	}
+	sample.DumpURLs = []string{sample.DumpURL}
+	sample.APIURLs = []string{sample.APIURL}
+	if _, err := t.apply(sampleDeployment(sample.AppLabel), sample); err != nil {
+		return nil, fmt.Errorf("invalid instance template %s: %v", path, err)
+	}
+	return t, nil
+}
+
+// sampleDeployment returns a minimal instance deployment used to validate the template
+func sampleDeployment(appLabel string) *appsv1.Deployment {
+	labels := map[string]string{appLabelKey: appLabel}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   fmt.Sprintf("%s-kas", appLabel),
+			Labels: labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "kas"},
+						{Name: "console"},
+					},
+				},
+			},
+		},
+	}
+}
+
+// apply renders the template and patches the deployment with it.
+// Names and labels kaas uses to track instances can't be changed
+func (t *InstanceTemplate) apply(deployment *appsv1.Deployment, vars TemplateVars) (*appsv1.Deployment, error) {
+	var rendered bytes.Buffer
+	if err := t.tmpl.Execute(&rendered, vars); err != nil {
+		return nil, fmt.Errorf("failed to render template: %v", err)
+	}
+	if len(bytes.TrimSpace(rendered.Bytes())) == 0 {
+		return deployment, nil
+	}
+	patch, err := yaml.YAMLToJSON(rendered.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("template didn't render into valid YAML: %v", err)
+	}
+	original, err := json.Marshal(deployment)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := strategicpatch.StrategicMergePatch(original, patch, appsv1.Deployment{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply template: %v", err)
+	}
+
+	result := &appsv1.Deployment{}
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(result); err != nil {
+		return nil, fmt.Errorf("template produced invalid deployment: %v", err)
+	}
+
+	if result.Name != deployment.Name || result.Namespace != deployment.Namespace {
+		return nil, fmt.Errorf("template must not change deployment name or namespace")
+	}
+	appLabel := deployment.Labels[appLabelKey]
+	if result.Labels[appLabelKey] != appLabel || result.Spec.Template.Labels[appLabelKey] != appLabel ||
+		!reflect.DeepEqual(result.Spec.Selector, deployment.Spec.Selector) {
+		return nil, fmt.Errorf("template must not change %q label or selector", appLabelKey)
+	}
+	return result, nil
+}
@@ -0,0 +1,73 @@
+package kaas
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadTestTemplate writes the instance template into a file and loads it
+func loadTestTemplate(t *testing.T, content string) *InstanceTemplate {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "template.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := LoadInstanceTemplate(path)
+	if err != nil {
+		t.Fatalf("failed to load instance template: %v", err)
+	}
+	return tmpl
+}
+
+func TestTemplateQuotesVariables(t *testing.T) {
+	tmpl := loadTestTemplate(t, `metadata:
+  annotations:
+    example.com/dump: {{ quote .DumpURL }}
+    example.com/dumps: {{ toJson .DumpURLs | quote }}
+`)
+	dumpURL := "https://example.com/must-gather.tar\"\n  labels: {app: other}\n#"
+	vars := TemplateVars{AppLabel: "example", DumpURL: dumpURL, DumpURLs: []string{dumpURL}}
+	deployment, err := tmpl.apply(sampleDeployment("example"), vars)
+	if err != nil {
+		t.Fatalf("failed to apply template: %v", err)
+	}
+	if got := deployment.Annotations["example.com/dump"]; got != dumpURL {
+		t.Errorf("expected dump URL to be rendered as is, got %q", got)
+	}
+	if got := deployment.Annotations["example.com/dumps"]; got != `["https://example.com/must-gather.tar\"\n  labels: {app: other}\n#"]` {
+		t.Errorf("expected dump URLs to be rendered as JSON, got %q", got)
+	}
+}
+
+func TestTemplateCantUndoHardening(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	env := newTestEnv(t, testConfig(), true)
+	env.server.Template = loadTestTemplate(t, `spec:
+  template:
+    spec:
+      hostNetwork: true
+      automountServiceAccountToken: true
+      containers:
+      - name: kas
+        securityContext:
+          privileged: true
+          runAsNonRoot: false
+`)
+	conn := env.dial(t)
+
+	messages := createInstance(t, conn, artifacts.URL+testJobRoot, nil)
+	if lastMessage(messages).Action != "done" {
+		t.Fatalf("expected instance to be created, got %v", messages)
+	}
+	spec := instanceDeployment(t, env, messages).Spec.Template.Spec
+	if spec.HostNetwork || spec.AutomountServiceAccountToken == nil || *spec.AutomountServiceAccountToken {
+		t.Errorf("expected host network and service account token to be disabled")
+	}
+	for _, container := range spec.Containers {
+		sc := container.SecurityContext
+		if sc == nil || sc.Privileged != nil || sc.RunAsNonRoot == nil || !*sc.RunAsNonRoot {
+			t.Errorf("expected container %s to be hardened, got %+v", container.Name, sc)
+		}
+	}
+}
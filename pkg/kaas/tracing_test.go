@@ -0,0 +1,104 @@
+package kaas
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider recording spans until the test ends
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestSetupTracingWithoutEndpoint(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	previous := otel.GetTracerProvider()
+
+	shutdown, err := SetupTracing(context.TODO())
+	if err != nil {
+		t.Fatalf("failed to set up tracing: %v", err)
+	}
+	if err := shutdown(context.TODO()); err != nil {
+		t.Errorf("expected noop shutdown, got %v", err)
+	}
+	if otel.GetTracerProvider() != previous {
+		t.Errorf("expected tracer provider not to be replaced without exporter endpoint")
+	}
+}
+
+func TestEndSpanRecordsError(t *testing.T) {
+	recorder := recordSpans(t)
+	_, span := startSpan(context.TODO(), "failing", attrInstance.String("app"))
+	endSpan(span, errors.New("boom"))
+	_, span = startSpan(context.TODO(), "succeeding")
+	endSpan(span, nil)
+
+	ended := recorder.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(ended))
+	}
+	if status := ended[0].Status(); status.Code != codes.Error || status.Description != "boom" {
+		t.Errorf("expected failing span to have error status, got %+v", status)
+	}
+	if len(ended[0].Events()) != 1 {
+		t.Errorf("expected error to be recorded as span event, got %v", ended[0].Events())
+	}
+	if status := ended[1].Status(); status.Code == codes.Error {
+		t.Errorf("expected succeeding span not to have error status, got %+v", status)
+	}
+}
+
+func TestWithTraceID(t *testing.T) {
+	if message := withTraceID(context.TODO(), "failed"); message != "failed" {
+		t.Errorf("expected message without span to be unchanged, got %q", message)
+	}
+	recordSpans(t)
+	ctx, span := startSpan(context.TODO(), "newKAS")
+	defer span.End()
+	id := span.SpanContext().TraceID().String()
+	if message := withTraceID(ctx, "failed"); !strings.HasSuffix(message, "(trace ID: "+id+")") {
+		t.Errorf("expected trace ID %s in message, got %q", id, message)
+	}
+}
+
+func TestNewKASIsTraced(t *testing.T) {
+	recorder := recordSpans(t)
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	env := newTestEnv(t, testConfig(), true)
+	conn := env.dial(t)
+
+	messages := createInstance(t, conn, artifacts.URL+testJobRoot, nil)
+	if lastMessage(messages).Action != "done" {
+		t.Fatalf("expected instance to be created, got %v", messages)
+	}
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	launch, ok := spans["launchKASApp"]
+	if !ok {
+		t.Fatalf("expected launch to be traced, got %v", spans)
+	}
+	for _, name := range []string{"fetchJobInfo", "create deployment", "create route", "waitForDeploymentReady"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("expected %s span", name)
+			continue
+		}
+		if span.SpanContext().TraceID() != launch.SpanContext().TraceID() {
+			t.Errorf("expected %s to be traced along with launch", name)
+		}
+	}
+}
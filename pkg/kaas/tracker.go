@@ -0,0 +1,273 @@
+package kaas
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	trackerResyncPeriod = 30 * time.Second
+	appLabelKey         = "app"
+
+	// unschedulableGracePeriod is how long instance pods may stay unschedulable, e.g. while dump cache
+	// claims are being bound or cluster autoscaler adds nodes
+	unschedulableGracePeriod = 3 * time.Minute
+	// readinessRecheckInterval makes waiting for instances notice failures which don't come with pod updates
+	readinessRecheckInterval = 15 * time.Second
+)
+
+var (
+	// Container waiting reasons which won't resolve by themselves
+	terminalWaitingReasons = map[string]bool{
+		"ImagePullBackOff":           true,
+		"InvalidImageName":           true,
+		"CrashLoopBackOff":           true,
+		"CreateContainerConfigError": true,
+		"CreateContainerError":       true,
+	}
+)
+
+// InstanceFailure describes an instance pod which won't become ready
+type InstanceFailure struct {
+	Pod       string
+	Container string
+	Reason    string
+	Message   string
+}
+
+func (f *InstanceFailure) Error() string {
+	if f.Container == "" {
+		return fmt.Sprintf("pod %s failed: %s: %s", f.Pod, f.Reason, f.Message)
+	}
+	return fmt.Sprintf("container %s in pod %s failed: %s: %s", f.Container, f.Pod, f.Reason, f.Message)
+}
+
+// InstanceTracker watches deployments and pods of all instances and notifies creations waiting for them
+type InstanceTracker struct {
+	deployments appslisters.DeploymentNamespaceLister
+	pods        corelisters.PodNamespaceLister
+
+	lock        sync.Mutex
+	subscribers map[string]map[chan struct{}]struct{}
+	stopped     bool
+}
+
+// StartInstanceTracker starts deployment and pod informers and blocks until they're synced
+func (c *Cluster) StartInstanceTracker(ctx context.Context) error {
+	logger := c.logger()
+	factory := informers.NewSharedInformerFactoryWithOptions(c.K8sClient, trackerResyncPeriod,
+		informers.WithNamespace(c.Namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = appLabelKey
+		}),
+	)
+	depInformer := factory.Apps().V1().Deployments()
+	podInformer := factory.Core().V1().Pods()
+
+	tracker := &InstanceTracker{
+		deployments: depInformer.Lister().Deployments(c.Namespace),
+		pods:        podInformer.Lister().Pods(c.Namespace),
+		subscribers: make(map[string]map[chan struct{}]struct{}),
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    tracker.notify,
+		UpdateFunc: func(_, obj interface{}) { tracker.notify(obj) },
+		DeleteFunc: tracker.notify,
+	}
+	depInformer.Informer().AddEventHandler(handler)
+	podInformer.Informer().AddEventHandler(handler)
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), depInformer.Informer().HasSynced, podInformer.Informer().HasSynced) {
+		return fmt.Errorf("failed to sync deployment and pod informers")
+	}
+	logger.Debug("instance tracker synced")
+	c.tracker = tracker
+
+	go func() {
+		<-ctx.Done()
+		tracker.stop()
+	}()
+	return nil
+}
+
+// notify wakes up creations waiting for the instance obj belongs to
+func (t *InstanceTracker) notify(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	meta, ok := obj.(metav1.Object)
+	if !ok {
+		return
+	}
+	appLabel := meta.GetLabels()[appLabelKey]
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for ch := range t.subscribers[appLabel] {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// Subscriber has a pending notification already
+		}
+	}
+}
+
+// subscribe returns a channel receiving a value whenever instance objects change.
+// The channel is closed when tracker stops
+func (t *InstanceTracker) subscribe(appLabel string) chan struct{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ch := make(chan struct{}, 1)
+	if t.stopped {
+		close(ch)
+		return ch
+	}
+	if t.subscribers[appLabel] == nil {
+		t.subscribers[appLabel] = make(map[chan struct{}]struct{})
+	}
+	t.subscribers[appLabel][ch] = struct{}{}
+	return ch
+}
+
+func (t *InstanceTracker) unsubscribe(appLabel string, ch chan struct{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.subscribers[appLabel][ch]; !ok {
+		return
+	}
+	delete(t.subscribers[appLabel], ch)
+	if len(t.subscribers[appLabel]) == 0 {
+		delete(t.subscribers, appLabel)
+	}
+	close(ch)
+}
+
+func (t *InstanceTracker) stop() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.stopped = true
+	for appLabel, chans := range t.subscribers {
+		for ch := range chans {
+			close(ch)
+		}
+		delete(t.subscribers, appLabel)
+	}
+}
+
+// instanceReady reports whether instance deployment is available.
+// It returns InstanceFailure if instance pod is not going to become ready
+func (t *InstanceTracker) instanceReady(logger *logrus.Entry, appLabel string) (bool, error) {
+	pods, err := t.pods.List(labels.SelectorFromSet(labels.Set{appLabelKey: appLabel}))
+	if err != nil {
+		return false, err
+	}
+	for _, pod := range pods {
+		if err := podTerminalFailure(pod, time.Now()); err != nil {
+			return false, err
+		}
+	}
+
+	deployment, err := t.deployments.Get(fmt.Sprintf("%s-kas", appLabel))
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	logger.WithFields(logrus.Fields{
+		"available": deployment.Status.AvailableReplicas,
+		"updated":   deployment.Status.UpdatedReplicas,
+		"pods":      len(pods),
+	}).Trace("instance status")
+	return deploymentAvailable(deployment), nil
+}
+
+// deploymentAvailable checks that deployment rolled out all requested replicas
+func deploymentAvailable(deployment *appsv1.Deployment) bool {
+	if deployment.Status.ObservedGeneration < deployment.Generation {
+		return false
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	return deployment.Status.UpdatedReplicas >= replicas && deployment.Status.AvailableReplicas >= replicas
+}
+
+// podTerminalFailure returns InstanceFailure if the pod is stuck in a state it won't recover from.
+// Pods are considered unschedulable once they stay so for unschedulableGracePeriod
+func podTerminalFailure(pod *corev1.Pod, now time.Time) error {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type != corev1.PodScheduled || cond.Status != corev1.ConditionFalse || cond.Reason != corev1.PodReasonUnschedulable {
+			continue
+		}
+		since := cond.LastTransitionTime.Time
+		if since.IsZero() {
+			since = pod.CreationTimestamp.Time
+		}
+		if now.Sub(since) >= unschedulableGracePeriod {
+			return &InstanceFailure{Pod: pod.Name, Reason: cond.Reason, Message: cond.Message}
+		}
+	}
+	if pod.Status.Phase == corev1.PodFailed {
+		return &InstanceFailure{Pod: pod.Name, Reason: pod.Status.Reason, Message: pod.Status.Message}
+	}
+
+	for _, status := range pod.Status.InitContainerStatuses {
+		if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+			return &InstanceFailure{
+				Pod:       pod.Name,
+				Container: status.Name,
+				Reason:    terminated.Reason,
+				Message:   fmt.Sprintf("exited with code %d", terminated.ExitCode),
+			}
+		}
+		if terminated := status.LastTerminationState.Terminated; terminated != nil && terminated.ExitCode != 0 {
+			return &InstanceFailure{
+				Pod:       pod.Name,
+				Container: status.Name,
+				Reason:    terminated.Reason,
+				Message:   fmt.Sprintf("exited with code %d", terminated.ExitCode),
+			}
+		}
+		if err := containerWaitingFailure(pod, status); err != nil {
+			return err
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if err := containerWaitingFailure(pod, status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containerWaitingFailure(pod *corev1.Pod, status corev1.ContainerStatus) error {
+	waiting := status.State.Waiting
+	if waiting == nil || !terminalWaitingReasons[waiting.Reason] {
+		return nil
+	}
+	return &InstanceFailure{
+		Pod:       pod.Name,
+		Container: status.Name,
+		Reason:    waiting.Reason,
+		Message:   waiting.Message,
+	}
+}
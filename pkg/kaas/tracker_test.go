@@ -0,0 +1,145 @@
+package kaas
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodTerminalFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		status    corev1.PodStatus
+		container string
+		reason    string
+	}{
+		{
+			name:   "running",
+			status: corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+		{
+			name: "unschedulable",
+			status: corev1.PodStatus{Conditions: []corev1.PodCondition{{
+				Type:               corev1.PodScheduled,
+				Status:             corev1.ConditionFalse,
+				Reason:             corev1.PodReasonUnschedulable,
+				LastTransitionTime: metav1.NewTime(time.Now().Add(-unschedulableGracePeriod)),
+			}}},
+			reason: corev1.PodReasonUnschedulable,
+		},
+		{
+			// e.g. waiting for a dump cache claim to be bound or for a new node
+			name: "recently unschedulable",
+			status: corev1.PodStatus{Conditions: []corev1.PodCondition{{
+				Type:               corev1.PodScheduled,
+				Status:             corev1.ConditionFalse,
+				Reason:             corev1.PodReasonUnschedulable,
+				LastTransitionTime: metav1.NewTime(time.Now().Add(-time.Minute)),
+			}}},
+		},
+		{
+			name:   "failed",
+			status: corev1.PodStatus{Phase: corev1.PodFailed, Reason: "Evicted"},
+			reason: "Evicted",
+		},
+		{
+			name: "fetcher failed",
+			status: corev1.PodStatus{InitContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "ci-fetcher",
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"}},
+			}}},
+			container: "ci-fetcher",
+			reason:    "Error",
+		},
+		{
+			name: "fetcher succeeded",
+			status: corev1.PodStatus{InitContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "ci-fetcher",
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0, Reason: "Completed"}},
+			}}},
+		},
+		{
+			name: "image pull",
+			status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "kas",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+			}}},
+			container: "kas",
+			reason:    "ImagePullBackOff",
+		},
+		{
+			name: "creating",
+			status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "kas",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}},
+			}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{Status: tc.status}
+			pod.Name = "app-kas-1"
+			err := podTerminalFailure(pod, time.Now())
+			if tc.reason == "" {
+				if err != nil {
+					t.Errorf("expected no failure, got %v", err)
+				}
+				return
+			}
+			var failure *InstanceFailure
+			if !errors.As(err, &failure) {
+				t.Fatalf("expected InstanceFailure, got %v", err)
+			}
+			if failure.Pod != pod.Name || failure.Container != tc.container || failure.Reason != tc.reason {
+				t.Errorf("unexpected failure %+v", failure)
+			}
+		})
+	}
+}
+
+func TestDeploymentAvailable(t *testing.T) {
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: &replicas}}
+	if deploymentAvailable(deployment) {
+		t.Errorf("expected new deployment not to be available")
+	}
+	deployment.Status.UpdatedReplicas = 1
+	deployment.Status.AvailableReplicas = 1
+	if !deploymentAvailable(deployment) {
+		t.Errorf("expected rolled out deployment to be available")
+	}
+	deployment.Generation = 2
+	deployment.Status.ObservedGeneration = 1
+	if deploymentAvailable(deployment) {
+		t.Errorf("expected deployment with unobserved generation not to be available")
+	}
+}
+
+func TestTrackerNotifiesSubscribers(t *testing.T) {
+	tracker := &InstanceTracker{subscribers: make(map[string]map[chan struct{}]struct{})}
+	updates := tracker.subscribe("app")
+	other := tracker.subscribe("other")
+
+	pod := &corev1.Pod{}
+	pod.Labels = map[string]string{appLabelKey: "app"}
+	tracker.notify(pod)
+	tracker.notify(pod)
+	if len(updates) != 1 {
+		t.Errorf("expected a single pending notification, got %d", len(updates))
+	}
+	if len(other) != 0 {
+		t.Errorf("expected other instances not to be notified")
+	}
+
+	tracker.unsubscribe("app", updates)
+	tracker.stop()
+	if _, ok := <-other; ok {
+		t.Errorf("expected subscription to be closed when tracker stops")
+	}
+	if _, ok := <-tracker.subscribe("app"); ok {
+		t.Errorf("expected subscription of stopped tracker to be closed")
+	}
+}
@@ -1,34 +1,121 @@
 package kaas
 
 import (
-	"github.com/gorilla/websocket"
-	routeClient "github.com/openshift/client-go/route/clientset/versioned/typed/route/v1"
-	k8s "k8s.io/client-go/kubernetes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// RQuotaStatus stores ResourceQuota info
+// RQuotaStatus stores ResourceQuota info.
+// Used and Hard count pods, CPU is measured in millicores and Memory in bytes
 type RQuotaStatus struct {
+	Used   int64      `json:"used"`
+	Hard   int64      `json:"hard"`
+	CPU    QuotaUsage `json:"cpu"`
+	Memory QuotaUsage `json:"memory"`
+}
+
+// QuotaUsage stores used and hard limit of a quota resource
+type QuotaUsage struct {
 	Used int64 `json:"used"`
 	Hard int64 `json:"hard"`
 }
 
 // ServerSettings stores info about the server
 type ServerSettings struct {
-	K8sClient   *k8s.Clientset
-	RouteClient *routeClient.RouteV1Client
-	Namespace   string
-	RQuotaName  string
-	RQStatus    *RQuotaStatus
-	Conns       map[string]*websocket.Conn
-	Datasources map[string]int
+	// Clusters host instances, the first one is the home cluster
+	Clusters []*Cluster
+	Log      *logrus.Entry
+	// Template customizes instance deployments, nil if not configured
+	Template *InstanceTemplate
+
+	// conns are websocket connections of this replica, receiving quota updates
+	conns     map[string]*wsConn
+	connsLock sync.RWMutex
+
+	configLock sync.RWMutex
+	config     *Config
+
+	leader   atomic.Bool
+	resuming sync.Map
+
+	draining     atomic.Bool
+	inflightLock sync.Mutex
+	// inflight maps instances being created to clusters they're placed in
+	inflight   map[string]*Cluster
+	inflightWG sync.WaitGroup
 }
 
-// ProwJSON stores test start / finished timestamp
+// ProwJSON stores contents of started.json and finished.json
 type ProwJSON struct {
-	Timestamp int `json:"timestamp"`
+	Timestamp int64                  `json:"timestamp"`
+	Passed    *bool                  `json:"passed,omitempty"`
+	Result    string                 `json:"result,omitempty"`
+	Revision  string                 `json:"revision,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// ProwJob stores fields of prowjob.json used by kaas
+type ProwJob struct {
+	Metadata metav1.ObjectMeta `json:"metadata"`
+	Spec     ProwJobSpec       `json:"spec"`
+	Status   ProwJobStatus     `json:"status"`
+}
+
+// ProwJobSpec stores the job definition
+type ProwJobSpec struct {
+	Type    string          `json:"type"`
+	Job     string          `json:"job"`
+	Refs    *ProwRefs       `json:"refs,omitempty"`
+	PodSpec *corev1.PodSpec `json:"pod_spec,omitempty"`
+}
+
+// ProwJobStatus stores the job run state
+type ProwJobStatus struct {
+	State          string       `json:"state"`
+	BuildID        string       `json:"build_id"`
+	URL            string       `json:"url"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// ProwRefs describes the repo and pull requests tested by the job
+type ProwRefs struct {
+	Org     string     `json:"org"`
+	Repo    string     `json:"repo"`
+	BaseRef string     `json:"base_ref,omitempty"`
+	BaseSHA string     `json:"base_sha,omitempty"`
+	Pulls   []ProwPull `json:"pulls,omitempty"`
+}
+
+// ProwPull describes a tested pull request
+type ProwPull struct {
+	Number int    `json:"number"`
+	Author string `json:"author"`
+	SHA    string `json:"sha"`
+	Link   string `json:"link,omitempty"`
+}
+
+// JobInfo describes the Prow job which produced the dumps
+type JobInfo struct {
+	Job      string     `json:"job"`
+	BuildID  string     `json:"buildID"`
+	Type     string     `json:"type,omitempty"`
+	Result   string     `json:"result,omitempty"`
+	URL      string     `json:"url,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Refs     *ProwRefs  `json:"refs,omitempty"`
+	Version  string     `json:"version,omitempty"`
 }
 
 // ProwInfo stores all links and data collected via scanning for must gather
 type ProwInfo struct {
 	ClusterDumpURLs []string
+	// Job is set when metadata of the job could be fetched
+	Job *JobInfo
 }
@@ -0,0 +1,242 @@
+package kaas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// maxRedirects is the number of redirects followed when fetching artifacts
+const maxRedirects = 5
+
+var (
+	// ErrURLNotAllowed is returned for URLs kaas must not fetch
+	ErrURLNotAllowed = errors.New("URL is not allowed")
+
+	// allowedURLs holds the allowlist of current config, it's checked on every redirect
+	allowedURLs atomic.Value
+
+	// carrierGradeNAT is the shared address space, not covered by net.IP.IsPrivate
+	carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+	// httpClient fetches artifacts. It refuses to connect to internal addresses, which are checked
+	// after DNS resolution, and follows redirects to allowed URLs only
+	httpClient = &http.Client{
+		// Proxies are not used, as the address check would apply to the proxy instead of the target
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+				Control:   checkDialAddress,
+			}).DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		CheckRedirect: checkRedirect,
+	}
+
+	// lookupIPAddr resolves hosts of user supplied URLs
+	lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+	// allowedInternalAddresses holds "ip:port" addresses exempt from the internal address check.
+	// It's populated by tests only, whose artifact servers listen on loopback
+	allowedInternalAddresses sync.Map
+)
+
+// setAllowedURLs updates the allowlist checked on redirects
+func setAllowedURLs(allowed []string) {
+	allowedURLs.Store(allowed)
+}
+
+func currentAllowedURLs() []string {
+	allowed, _ := allowedURLs.Load().([]string)
+	return allowed
+}
+
+// internalIP reports whether ip is loopback, private, link-local or otherwise not publicly routable
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || carrierGradeNAT.Contains(ip)
+}
+
+// refusedAddress reports whether kaas must not connect to port at ip
+func refusedAddress(ip net.IP, port string) bool {
+	if _, ok := allowedInternalAddresses.Load(net.JoinHostPort(ip.String(), port)); ok {
+		return false
+	}
+	return internalIP(ip)
+}
+
+// checkDialAddress refuses connections to internal addresses. It runs after DNS resolution,
+// so hostnames resolving to internal addresses are rejected too
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || refusedAddress(ip, port) {
+		return fmt.Errorf("%w: %s is an internal address", ErrURLNotAllowed, host)
+	}
+	return nil
+}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if err := matchAllowedURL(req.URL, currentAllowedURLs()); err != nil {
+		return fmt.Errorf("redirect to %s: %w", req.URL.Redacted(), err)
+	}
+	return nil
+}
+
+// matchAllowedURL checks that u is an HTTP(S) URL matching the allowlist. Entries are either URL prefixes,
+// hosts or "*.domain" wildcards matching subdomains. Empty allowlist allows any host
+func matchAllowedURL(u *url.URL, allowed []string) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: only http and https URLs are supported", ErrURLNotAllowed)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: URLs with credentials are not supported", ErrURLNotAllowed)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("%w: host is missing", ErrURLNotAllowed)
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, entry := range allowed {
+		switch {
+		case strings.Contains(entry, "://"):
+			prefix, err := url.Parse(entry)
+			if err != nil {
+				continue
+			}
+			if u.Scheme == prefix.Scheme && strings.EqualFold(u.Host, prefix.Host) && matchPathPrefix(u.Path, prefix.Path) {
+				return nil
+			}
+		case strings.HasPrefix(entry, "*."):
+			if strings.HasSuffix(host, strings.ToLower(entry[1:])) {
+				return nil
+			}
+		case host == strings.ToLower(entry):
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not in the list of allowed sources", ErrURLNotAllowed, host)
+}
+
+// matchPathPrefix reports whether p is the prefix path or lies under it, matching whole path segments only
+func matchPathPrefix(p, prefix string) bool {
+	p = path.Clean("/" + p)
+	prefix = strings.TrimSuffix(prefix, "/")
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// checkDerivedURL checks URLs kaas derives from user supplied ones, like job metadata or metrics snapshot
+// next to the dump, against the current allowlist
+func checkDerivedURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %v", rawURL, err)
+	}
+	return matchAllowedURL(u, currentAllowedURLs())
+}
+
+// probeURL checks that rawURL can be downloaded without fetching its content. It sends HEAD request,
+// falling back to GET of the first byte for servers rejecting HEAD. The response body is closed
+func probeURL(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed && res.StatusCode != http.StatusNotImplemented {
+		return res, nil
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	if res, err = httpClient.Do(req); err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res, nil
+}
+
+// resolveURL returns the URL rawURL redirects to. Redirects are checked by httpClient, so the resolved URL
+// can be handed to instance containers, which download it without following redirects
+func resolveURL(ctx context.Context, rawURL string) (string, error) {
+	res, err := probeURL(ctx, rawURL)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return "", fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
+	}
+	return res.Request.URL.String(), nil
+}
+
+// validateAllowedURL checks allowlist entry
+func validateAllowedURL(entry string) error {
+	if !strings.Contains(entry, "://") {
+		if strings.TrimPrefix(entry, "*.") == "" || strings.ContainsAny(entry, "/:") {
+			return fmt.Errorf("invalid allowedURLs entry %q: must be a URL prefix, a host or a *.domain wildcard", entry)
+		}
+		return nil
+	}
+	u, err := url.Parse(entry)
+	if err != nil {
+		return fmt.Errorf("invalid allowedURLs entry %q: %v", entry, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid allowedURLs entry %q: URL prefix must have http or https scheme and host", entry)
+	}
+	return nil
+}
+
+// validateURL checks that the user supplied URL is allowed and doesn't resolve to internal addresses
+func (s *ServerSettings) validateURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %v", rawURL, err)
+	}
+	if err := matchAllowedURL(u, s.Config().AllowedURLs); err != nil {
+		return err
+	}
+	addrs, err := lookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", u.Hostname(), err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	for _, addr := range addrs {
+		if refusedAddress(addr.IP, port) {
+			return fmt.Errorf("%w: %s resolves to internal address %s", ErrURLNotAllowed, u.Hostname(), addr.IP)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package kaas
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	configv1 "github.com/openshift/api/config/v1"
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// clusterVersionArtifact is the ClusterVersion of the cluster stored by gather-extra step
+	clusterVersionArtifact = "clusterversion.json"
+	// dumpClusterVersion is the ClusterVersion of the cluster in must-gather dumps
+	dumpClusterVersion = "cluster-scoped-resources/config.openshift.io/clusterversions/version.yaml"
+)
+
+var minorVersion = regexp.MustCompile(`^v?(\d+\.\d+)(\.|$)`)
+
+// clusterVersionCandidates returns locations where jobs store ClusterVersion of the cluster which produced the dump
+func clusterVersionCandidates(dumpURL string) []string {
+	u, err := url.Parse(dumpURL)
+	if err != nil {
+		return nil
+	}
+	idx := strings.LastIndex(u.Path, "/artifacts/")
+	if idx == -1 {
+		return nil
+	}
+	testDir := path.Dir(u.Path[:idx])
+
+	candidate := *u
+	candidate.Path = path.Join(testDir, "gather-extra", "artifacts", clusterVersionArtifact)
+	candidate.RawPath = ""
+	return []string{candidate.String()}
+}
+
+// fetchClusterVersion reads cluster version from the ClusterVersion artifact next to the dump
+func fetchClusterVersion(ctx context.Context, logger *logrus.Entry, dumpURL string) string {
+	for _, candidate := range clusterVersionCandidates(dumpURL) {
+		var list configv1.ClusterVersionList
+		if err := fetchJSON(ctx, candidate, &list); err != nil {
+			logger.WithError(err).WithField("url", candidate).Debug("failed to fetch cluster version")
+			continue
+		}
+		for _, cv := range list.Items {
+			if version := clusterVersionOf(&cv); version != "" {
+				return version
+			}
+		}
+	}
+	return ""
+}
+
+// fetchDumpClusterVersion reads cluster version from the ClusterVersion in the dump. The archive is streamed
+// until the resource is found or the scan limits are reached, ClusterVersions of hosted clusters in hypershift dumps are skipped
+func fetchDumpClusterVersion(ctx context.Context, dumpURL string) (version string, err error) {
+	ctx, span := startSpan(ctx, "fetchDumpClusterVersion", attrURL.String(dumpURL))
+	defer func() { endSpan(span, err) }()
+
+	err = walkDump(ctx, dumpURL, dumpScanLimit, dumpScanTimeout, func(name string, member io.Reader) (bool, error) {
+		found := name == dumpClusterVersion || strings.HasSuffix(name, "/"+dumpClusterVersion)
+		if !found || strings.HasPrefix(name, hostedClusterPrefix) {
+			return true, nil
+		}
+		data, err := io.ReadAll(member)
+		if err != nil {
+			return false, fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		var cv configv1.ClusterVersion
+		if err := yaml.Unmarshal(data, &cv); err != nil {
+			return false, fmt.Errorf("failed to parse %s: %v", name, err)
+		}
+		version = clusterVersionOf(&cv)
+		return false, nil
+	})
+	return version, err
+}
+
+// clusterVersionOf returns the version cluster was updating to or running last
+func clusterVersionOf(cv *configv1.ClusterVersion) string {
+	if cv.Status.Desired.Version != "" {
+		return cv.Status.Desired.Version
+	}
+	if len(cv.Status.History) != 0 {
+		return cv.Status.History[0].Version
+	}
+	return ""
+}
+
+// versionMinor returns "major.minor" part of the version, e.g. "4.14" for "4.14.0-0.nightly-2023-06-01-000000"
+func versionMinor(version string) string {
+	match := minorVersion.FindStringSubmatch(version)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// consoleImages picks console images matching cluster versions of the dumps. Version is read from
+// ClusterVersion artifact and from job metadata, the dump is scanned only if neither is available.
+// Configured console image is used if there is no match
+func (s *ServerSettings) consoleImages(ctx context.Context, logger *logrus.Entry, conn *wsConn, dumpURLs []string, job *JobInfo) []string {
+	cfg := s.Config()
+	images := make([]string, 0, len(dumpURLs))
+	for _, dumpURL := range dumpURLs {
+		dumpLogger := logger.WithField("dump", dumpURL)
+		version := fetchClusterVersion(ctx, dumpLogger, dumpURL)
+		if version == "" && job != nil {
+			version = job.Version
+		}
+		if version == "" {
+			sendWSMessage(conn, "status", fmt.Sprintf("Looking for cluster version in %s", dumpURL))
+			var err error
+			if version, err = fetchDumpClusterVersion(ctx, dumpURL); err != nil {
+				dumpLogger.WithError(err).Debug("failed to read cluster version from the dump")
+			}
+		}
+		image := cfg.Images.Console
+		switch mapped, ok := cfg.ConsoleImages[versionMinor(version)]; {
+		case version == "":
+			dumpLogger.Warn("cluster version is unknown, using default console image")
+			sendWSMessage(conn, "status", fmt.Sprintf("Cluster version is unknown, using console %s", image))
+		case !ok:
+			dumpLogger.WithField("version", version).Warn("no console image for cluster version, using default console image")
+			sendWSMessage(conn, "status", fmt.Sprintf("No console image configured for %s, using console %s", version, image))
+		default:
+			image = mapped
+			dumpLogger.WithFields(logrus.Fields{
+				"version": version,
+				"image":   image,
+			}).Debug("picked console image")
+			sendWSMessage(conn, "status", fmt.Sprintf("Found cluster version %s, using console %s", version, image))
+		}
+		images = append(images, image)
+	}
+	return images
+}
@@ -0,0 +1,68 @@
+package kaas
+
+import (
+	"context"
+	"testing"
+
+	configv1 "github.com/openshift/api/config/v1"
+)
+
+func TestVersionMinor(t *testing.T) {
+	for version, expected := range map[string]string{
+		"4.14.0-0.nightly-2023-06-01-000000": "4.14",
+		"v4.13.2":                            "4.13",
+		"4.15":                               "4.15",
+		"4":                                  "",
+		"4.1x":                               "",
+		"":                                   "",
+	} {
+		if minor := versionMinor(version); minor != expected {
+			t.Errorf("expected %q for %q, got %q", expected, version, minor)
+		}
+	}
+}
+
+func TestClusterVersionOf(t *testing.T) {
+	cv := &configv1.ClusterVersion{Status: configv1.ClusterVersionStatus{
+		History: []configv1.UpdateHistory{{Version: "4.13.1"}, {Version: "4.12.0"}},
+	}}
+	if version := clusterVersionOf(cv); version != "4.13.1" {
+		t.Errorf("expected last version from history, got %q", version)
+	}
+	cv.Status.Desired.Version = "4.14.0"
+	if version := clusterVersionOf(cv); version != "4.14.0" {
+		t.Errorf("expected desired version, got %q", version)
+	}
+	if version := clusterVersionOf(&configv1.ClusterVersion{}); version != "" {
+		t.Errorf("expected no version, got %q", version)
+	}
+}
+
+func TestFetchClusterVersion(t *testing.T) {
+	files := jobArtifacts(testDumpPath)
+	files[testJobRoot+"artifacts/e2e/gather-extra/artifacts/"+clusterVersionArtifact] = []byte(`{"items": [{"status": {"history": [{"version": "4.13.0"}]}}]}`)
+	artifacts := newArtifactServer(t, files)
+
+	dumpURL := artifacts.URL + testJobRoot + "artifacts/" + testDumpPath
+	if version := fetchClusterVersion(context.TODO(), testLogger(), dumpURL); version != "4.13.0" {
+		t.Errorf("expected version from gather-extra artifact, got %q", version)
+	}
+	otherDump := artifacts.URL + testJobRoot + "artifacts/upgrade/gather-must-gather/artifacts/must-gather.tar"
+	if version := fetchClusterVersion(context.TODO(), testLogger(), otherDump); version != "" {
+		t.Errorf("expected no version without artifact, got %q", version)
+	}
+}
+
+func TestFetchDumpClusterVersionSkipsHostedClusters(t *testing.T) {
+	files := jobArtifacts()
+	files[testJobRoot+"artifacts/"+testDumpPath] = dumpArchive(t, map[string]string{
+		hostedClusterPrefix + "guest/" + dumpClusterVersion:             "kind: ClusterVersion\nstatus:\n  desired:\n    version: 4.12.0\n",
+		"must-gather.local.1/quay-io-must-gather/" + dumpClusterVersion: "kind: ClusterVersion\nstatus:\n  desired:\n    version: 4.14.3\n",
+	})
+	artifacts := newArtifactServer(t, files)
+
+	version, err := fetchDumpClusterVersion(context.TODO(), artifacts.URL+testJobRoot+"artifacts/"+testDumpPath)
+	if err != nil || version != "4.14.3" {
+		t.Errorf("expected version of the management cluster, got %q: %v", version, err)
+	}
+}
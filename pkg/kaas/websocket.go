@@ -4,17 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
 // WSMessage represents websocket message format
 type WSMessage struct {
-	Message string            `json:"message"`
-	Action  string            `json:"action"`
-	Data    map[string]string `json:"data,omitempty"`
+	Message   string            `json:"message"`
+	Action    string            `json:"action"`
+	Data      map[string]string `json:"data,omitempty"`
+	Diagnosis *Diagnosis        `json:"diagnosis,omitempty"`
 }
 
 var wsupgrader = websocket.Upgrader{
@@ -40,108 +45,280 @@ users:
   user:
     token: dummy`
 
-func sendWSMessage(conn *websocket.Conn, action string, message string) {
-	response := WSMessage{
-		Action:  action,
-		Message: message,
-	}
+// wsConn is a websocket connection safe for concurrent writers. Websocket connections support
+// a single concurrent writer only, while instance creations and broadcasts write from own goroutines
+type wsConn struct {
+	*websocket.Conn
+	writeLock sync.Mutex
+}
+
+func newWSConn(conn *websocket.Conn) *wsConn {
+	return &wsConn{Conn: conn}
+}
+
+func writeWSMessage(conn *wsConn, response WSMessage) {
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
-		fmt.Println("Can't serialize", response)
+		logrus.WithError(err).WithField("action", response.Action).Error("can't serialize websocket message")
 	}
-	if conn != nil {
-		conn.WriteMessage(websocket.TextMessage, responseJSON)
+	if conn == nil {
+		return
 	}
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	conn.WriteMessage(websocket.TextMessage, responseJSON)
 }
 
-func sendWSMessageWithData(conn *websocket.Conn, action string, message string, data map[string]string) {
-	response := WSMessage{
+func sendWSMessage(conn *wsConn, action string, message string) {
+	writeWSMessage(conn, WSMessage{
+		Action:  action,
+		Message: message,
+	})
+}
+
+func sendWSMessageWithData(conn *wsConn, action string, message string, data map[string]string) {
+	writeWSMessage(conn, WSMessage{
 		Action:  action,
 		Message: message,
 		Data:    data,
-	}
-	responseJSON, err := json.Marshal(response)
-	if err != nil {
-		fmt.Println("Can't serialize", response)
-	}
-	if conn != nil {
-		conn.WriteMessage(websocket.TextMessage, responseJSON)
-	}
+	})
+}
+
+func sendWSFailureWithDiagnosis(conn *wsConn, message string, diagnosis *Diagnosis) {
+	writeWSMessage(conn, WSMessage{
+		Action:    "failure",
+		Message:   message,
+		Diagnosis: diagnosis,
+	})
 }
 
 // HandleStatusViaWS reads websocket events and runs actions
 func (s *ServerSettings) HandleStatusViaWS(c *gin.Context) {
-	conn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
+	connID := generateConnID()
+	logger := s.logger().WithField(logFieldConn, connID)
+
+	upgraded, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
 
 	if err != nil {
-		log.Printf("Failed to upgrade ws: %+v", err)
+		logger.WithError(err).Error("failed to upgrade ws")
 		return
 	}
+	conn := newWSConn(upgraded)
+	logger = logger.WithField("remote", conn.RemoteAddr().String())
+	logger.Debug("websocket connected")
 
 	for {
 		t, msg, err := conn.ReadMessage()
-		log.Printf("Got ws message: %s", msg)
 		if err != nil {
 			if !websocket.IsCloseError(err, 1001, 1006) {
-				delete(s.Conns, conn.RemoteAddr().String())
-				log.Printf("Error reading message: %+v", err)
+				s.removeConn(conn)
+				logger.WithError(err).Warn("error reading message")
 			}
 			break
 		}
 		if t != websocket.TextMessage {
-			log.Printf("Not a text message: %d", t)
+			logger.WithField("type", t).Debug("not a text message")
 			continue
 		}
 		var m WSMessage
 		err = json.Unmarshal(msg, &m)
 		if err != nil {
-			log.Printf("Failed to unmarshal message '%+v': %+v", string(msg), err)
+			logger.WithError(err).Warn("failed to unmarshal message")
 			continue
 		}
-		log.Printf("WS message: %+v", m)
+		logger.WithFields(logrus.Fields{
+			"action":  m.Action,
+			"message": m.Message,
+		}).Debug("got ws message")
 		switch m.Action {
 		case "connect":
-			s.Conns[conn.RemoteAddr().String()] = conn
+			s.addConn(conn)
+			if regions := s.Regions(); len(regions) > 0 {
+				regionsJSON, _ := json.Marshal(regions)
+				sendWSMessage(conn, "regions", string(regionsJSON))
+			}
 			go s.sendResourceQuotaUpdate()
 		case "new":
-			go s.newKAS(conn, m.Message)
+			opts, err := parseNewKASOptions(m.Data)
+			if err != nil {
+				sendWSMessage(conn, "failure", err.Error())
+				continue
+			}
+			go s.newKAS(connID, conn, m.Message, opts)
+		case "share":
+			go s.shareKAS(connID, conn, m.Message)
 		case "delete":
-			go s.removeKAS(conn, m.Message)
+			go s.removeKAS(connID, conn, m.Message)
 		}
 	}
 }
 
 func (s *ServerSettings) sendResourceQuotaUpdate() {
-	rqsJSON, err := json.Marshal(s.RQStatus)
+	rqsJSON, err := json.Marshal(s.quotaStatus())
 	if err != nil {
-		log.Fatalf("Can't serialize %s", err)
+		s.logger().WithError(err).Fatal("can't serialize resource quota status")
 	}
-	for _, conn := range s.Conns {
-		sendWSMessage(conn, "rquota", string(rqsJSON))
+	s.broadcast("rquota", string(rqsJSON))
+}
+
+func (s *ServerSettings) addConn(conn *wsConn) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[string]*wsConn)
 	}
+	s.conns[conn.RemoteAddr().String()] = conn
 }
 
-func (s *ServerSettings) removeKAS(conn *websocket.Conn, appName string) {
+func (s *ServerSettings) removeConn(conn *wsConn) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	delete(s.conns, conn.RemoteAddr().String())
+}
+
+// broadcast sends the message to all clients connected to this replica
+func (s *ServerSettings) broadcast(action, message string) {
+	s.connsLock.RLock()
+	defer s.connsLock.RUnlock()
+	for _, conn := range s.conns {
+		sendWSMessage(conn, action, message)
+	}
+}
+
+func (s *ServerSettings) removeKAS(connID string, conn *wsConn, appName string) {
+	ctx, span := startSpan(context.Background(), "removeKAS", attrInstance.String(appName))
+	defer span.End()
+
+	logger := s.instanceLogger(connID, appName, "").WithField(logFieldTrace, traceID(ctx))
+	if len(s.connectedClusters()) == 0 {
+		sendWSMessage(conn, "failure", ErrNotReady.Error())
+		return
+	}
+	cluster, err := s.findInstanceCluster(ctx, appName)
+	if err != nil {
+		logger.WithError(err).Warn("failed to find instance")
+		sendWSMessage(conn, "failure", withTraceID(ctx, err.Error()))
+		return
+	}
+	if cluster == nil {
+		sendWSMessage(conn, "failure", fmt.Sprintf("Instance %s was not found", appName))
+		return
+	}
+	logger = logger.WithField(logFieldCluster, cluster.Name)
+
+	remaining, err := cluster.releaseInstance(ctx, appName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		logger.WithError(err).Warn("failed to release instance, removing it")
+	}
+	if remaining > 0 {
+		logger.WithField(recordRefCount, remaining).Info("released shared instance")
+		sendWSMessage(conn, "done", fmt.Sprintf("Released KAS instance, %d other user(s) still use it", remaining))
+		return
+	}
+
+	logger.Info("removing instance")
 	sendWSMessage(conn, "status", fmt.Sprintf("Removing app %s", appName))
-	if output, err := s.deletePods(appName); err != nil {
-		sendWSMessage(conn, "failure", fmt.Sprintf("%s\n%s", output, err.Error()))
+	if output, err := cluster.runtime.remove(ctx, logger, appName, false); err != nil {
+		logger.WithError(err).Error("failed to remove instance")
+		sendWSMessage(conn, "failure", withTraceID(ctx, fmt.Sprintf("%s\n%s", output, err.Error())))
 		return
 	}
-	delete(s.Datasources, appName)
 	sendWSMessage(conn, "done", "KAS instance removed")
 }
 
-func (s *ServerSettings) newKAS(conn *websocket.Conn, rawURL string) {
-	ctx := context.Background()
+// newKASOptions stores settings of a new instance passed in "new" message data
+type newKASOptions struct {
+	// Force skips reusing a running instance for the same dumps
+	Force bool
+	// All loads all found dumps
+	All bool
+	// Dumps is a subset of found dumps to load
+	Dumps []string
+	// Console overrides server default of running console, nil if not set
+	Console *bool
+	// Region restricts placement to target clusters in the region, any cluster is picked if empty
+	Region string
+}
+
+func parseNewKASOptions(data map[string]string) (newKASOptions, error) {
+	opts := newKASOptions{
+		Force:  data["force"] == "true",
+		All:    data["all"] == "true",
+		Region: data["region"],
+	}
+	if console, ok := data["console"]; ok {
+		enabled, err := strconv.ParseBool(console)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid console option %q", console)
+		}
+		opts.Console = &enabled
+	}
+	if dumps, ok := data["dumps"]; ok {
+		if err := json.Unmarshal([]byte(dumps), &opts.Dumps); err != nil {
+			return opts, fmt.Errorf("Failed to parse selected dumps: %v", err)
+		}
+	}
+	return opts, nil
+}
+
+// selectDumps picks dumps to load into the instance. It returns nil if user has to choose
+func (opts newKASOptions) selectDumps(found []string) ([]string, error) {
+	if len(found) == 1 || opts.All {
+		return found, nil
+	}
+	if len(opts.Dumps) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]bool, len(found))
+	for _, dumpURL := range found {
+		known[dumpURL] = true
+	}
+	for _, dumpURL := range opts.Dumps {
+		if !known[dumpURL] {
+			return nil, fmt.Errorf("Dump %s was not found in the job artifacts", dumpURL)
+		}
+	}
+	return opts.Dumps, nil
+}
 
+func (s *ServerSettings) newKAS(connID string, conn *wsConn, rawURL string, opts newKASOptions) {
 	// Generate a unique app label
 	appLabel := generateAppLabel()
+
+	ctx, span := startSpan(context.Background(), "newKAS", attrInstance.String(appLabel), attrURL.String(rawURL))
+	defer span.End()
+
+	logger := s.instanceLogger(connID, appLabel, rawURL).WithField(logFieldTrace, traceID(ctx))
+	if err := s.validateURL(ctx, rawURL); err != nil {
+		logger.WithError(err).Warn("refusing to fetch URL")
+		sendWSMessage(conn, "failure", err.Error())
+		return
+	}
+	cluster, err := s.placeInstance(opts.Region)
+	if err != nil {
+		logger.WithError(err).Warn("failed to place new instance")
+		sendWSMessage(conn, "failure", err.Error())
+		return
+	}
+	logger = logger.WithField(logFieldCluster, cluster.Name)
+	if err := s.beginCreation(appLabel, cluster); err != nil {
+		logger.WithError(err).Warn("refusing to create new instance")
+		sendWSMessage(conn, "failure", err.Error())
+		return
+	}
+	defer s.endCreation(appLabel)
+
+	logger.Info("creating new instance")
 	sendWSMessage(conn, "app-label", appLabel)
+	if len(s.Clusters) > 1 {
+		sendWSMessage(conn, "status", fmt.Sprintf("Placing the instance in cluster %s", cluster.Name))
+	}
 
 	// Fetch must-gather.tar path if prow URL specified
-	prowInfo, err := getTarPaths(conn, rawURL)
+	prowInfo, err := getTarPaths(ctx, logger, conn, rawURL)
 	if err != nil {
-		sendWSMessage(conn, "failure", fmt.Sprintf("Failed to find must-gather archive: %s", err.Error()))
+		logger.WithError(err).Warn("failed to find must-gather archive")
+		sendWSMessage(conn, "failure", withTraceID(ctx, fmt.Sprintf("Failed to find must-gather archive: %s", err.Error())))
 		return
 	}
 
@@ -150,7 +327,12 @@ func (s *ServerSettings) newKAS(conn *websocket.Conn, rawURL string) {
 		return
 	}
 
-	if len(prowInfo.ClusterDumpURLs) > 1 {
+	dumpURLs, err := opts.selectDumps(prowInfo.ClusterDumpURLs)
+	if err != nil {
+		sendWSMessage(conn, "failure", err.Error())
+		return
+	}
+	if dumpURLs == nil {
 		data, err := json.Marshal(prowInfo.ClusterDumpURLs)
 		if err != nil {
 			sendWSMessage(conn, "failure", fmt.Sprintf("Failed to marshal dump configs: +%v", err))
@@ -158,31 +340,112 @@ func (s *ServerSettings) newKAS(conn *websocket.Conn, rawURL string) {
 		sendWSMessage(conn, "choose", string(data))
 		return
 	}
+	if maxDumps := s.Config().MaxDumps; len(dumpURLs) > maxDumps {
+		sendWSMessage(conn, "failure", fmt.Sprintf("%d dumps selected, one instance can serve at most %d", len(dumpURLs), maxDumps))
+		return
+	}
+	logger = logger.WithField("dump", dumpURLs)
+	dumpSources := make([]string, len(dumpURLs))
+	for i, dumpURL := range dumpURLs {
+		if err := s.validateURL(ctx, dumpURL); err != nil {
+			logger.WithError(err).Warn("refusing to fetch dump")
+			sendWSMessage(conn, "failure", fmt.Sprintf("Dump %s can't be loaded: %v", dumpURL, err))
+			return
+		}
+		if dumpSources[i], err = resolveURL(ctx, dumpURL); err != nil {
+			logger.WithError(err).Warn("failed to resolve dump URL")
+			sendWSMessage(conn, "failure", fmt.Sprintf("Dump %s can't be loaded: %v", dumpURL, err))
+			return
+		}
+	}
+	dumpSizes, err := s.dumpSizes(ctx, logger, conn, dumpURLs)
+	if err != nil {
+		logger.WithError(err).Warn("refusing to create instance")
+		sendWSMessage(conn, "failure", err.Error())
+		return
+	}
+	hostedClusters, err := s.hostedClusters(ctx, logger, conn, dumpURLs)
+	if err != nil {
+		logger.WithError(err).Warn("refusing to create instance")
+		sendWSMessage(conn, "failure", err.Error())
+		return
+	}
+	headless := !s.Config().Console
+	if opts.Console != nil {
+		headless = !*opts.Console
+	}
+	if cluster.isLocal() {
+		headless = true
+	}
 
-	dumpURL := prowInfo.ClusterDumpURLs[0]
+	if !opts.Force {
+		shared, err := s.findSharedInstance(ctx, dumpURLs, headless)
+		if err != nil {
+			logger.WithError(err).Warn("failed to look up instances for the same dump")
+		}
+		if shared != nil {
+			logger.WithField("shared", shared.AppLabel).Info("offering existing instance")
+			offerSharedInstance(conn, shared, rawURL, dumpURLs)
+			return
+		}
+	}
+
+	record := map[string]string{
+		recordSource:     rawURL,
+		recordDump:       dumpsKey(dumpURLs),
+		recordState:      stateStarting,
+		recordRefCount:   "1",
+		recordAcquiredAt: time.Now().UTC().Format(time.RFC3339),
+		recordHeadless:   strconv.FormatBool(headless),
+		recordCluster:    cluster.Name,
+	}
+	if prowInfo.Job != nil {
+		jobJSON, err := json.Marshal(prowInfo.Job)
+		if err == nil {
+			record[recordJob] = string(jobJSON)
+			sendWSMessage(conn, "job", string(jobJSON))
+		}
+	}
+	if err := cluster.updateInstanceRecord(ctx, appLabel, record); err != nil {
+		logger.WithError(err).Warn("failed to store instance record")
+	}
 
 	// Create a new app in the namespace and return route
 	sendWSMessage(conn, "status", "Deploying a new KAS instance")
 
-	var kasRoute string
-	var consoleRoute string
-	if kasRoute, consoleRoute, err = s.launchKASApp(appLabel, dumpURL); err != nil {
-		sendWSMessage(conn, "failure", fmt.Sprintf("Failed to run a new app: %s", err.Error()))
-		return
+	spec := instanceSpec{
+		Dumps:          dumpURLs,
+		DumpSources:    dumpSources,
+		Headless:       headless,
+		Job:            prowInfo.Job,
+		DumpSizes:      dumpSizes,
+		HostedClusters: hostedClusters,
+	}
+	if !headless {
+		spec.ConsoleImages = s.consoleImages(ctx, logger, conn, dumpURLs, prowInfo.Job)
+	}
+	if s.Config().Prometheus {
+		spec.PrometheusTarball, err = findPrometheusTarball(ctx, logger, dumpURLs[0])
+		if err != nil {
+			logger.WithError(err).Warn("failed to find metrics snapshot")
+		}
+		if spec.PrometheusTarball != "" {
+			sendWSMessage(conn, "status", fmt.Sprintf("Found metrics snapshot at %s", spec.PrometheusTarball))
+			spec.Grafana = s.Config().Grafana
+		}
 	}
-	kubeconfig := fmt.Sprintf(kubeConfigTemplate, kasRoute)
-	sendWSMessage(conn, "kubeconfig", kubeconfig)
 
-	sendWSMessage(conn, "progress", "Waiting for pods to become ready")
-	if err := s.waitForDeploymentReady(ctx, appLabel); err != nil {
-		sendWSMessage(conn, "failure", err.Error())
+	urls, err := cluster.createInstance(ctx, logger, conn, appLabel, spec)
+	if err != nil {
+		logger.WithError(err).Error("failed to create instance")
+		if err := cluster.updateInstanceRecord(ctx, appLabel, map[string]string{recordState: stateFailed}); err != nil {
+			logger.WithError(err).Warn("failed to update instance state")
+		}
+		cluster.reportCreationFailure(ctx, logger, conn, appLabel, err)
 		return
 	}
-	sendWSMessage(conn, "link", consoleRoute)
-
-	data := map[string]string{
-		"hash": appLabel,
-		"url":  kasRoute,
+	if err := cluster.updateInstanceRecord(ctx, appLabel, map[string]string{recordState: stateReady}); err != nil {
+		logger.WithError(err).Warn("failed to update instance state")
 	}
-	sendWSMessageWithData(conn, "done", "Pod is ready", data)
+	sendInstanceLinks(logger, conn, appLabel, urls)
 }
@@ -0,0 +1,506 @@
+package kaas
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testDumpPath = "e2e/gather-must-gather/artifacts/must-gather.tar"
+
+// createInstance requests a new instance and waits for it to be created or fail
+func createInstance(t *testing.T, conn *websocket.Conn, rawURL string, data map[string]string) []WSMessage {
+	t.Helper()
+	send(t, conn, WSMessage{Action: "new", Message: rawURL, Data: data})
+	return readUntil(t, conn, "done", "failure", "choose", "existing")
+}
+
+// instanceDeployment returns the deployment of the instance created by the messages
+func instanceDeployment(t *testing.T, env *testEnv, messages []WSMessage) *appsv1.Deployment {
+	t.Helper()
+	appLabel := findMessage(messages, "app-label")
+	if appLabel == nil {
+		t.Fatalf("no app-label message in %v", messages)
+	}
+	deployment, err := env.kube.AppsV1().Deployments(testNamespace).Get(context.TODO(), appLabel.Message+"-kas", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get instance deployment: %v", err)
+	}
+	return deployment
+}
+
+func TestNewKASFromProwJob(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	env := newTestEnv(t, testConfig(), true)
+	conn := env.dial(t)
+
+	messages := createInstance(t, conn, artifacts.URL+"/view/gs/test-bucket/logs/periodic-e2e/1234", nil)
+	done := lastMessage(messages)
+	if done.Action != "done" {
+		t.Fatalf("expected instance to be created, got %v", messages)
+	}
+	appLabel := done.Data["hash"]
+	apiURL := "https://" + appLabel + "-api." + testRouteDomain
+	if done.Data["url"] != apiURL {
+		t.Errorf("expected API URL %s, got %s", apiURL, done.Data["url"])
+	}
+	if kubeconfig := findMessage(messages, "kubeconfig"); kubeconfig == nil || !strings.Contains(kubeconfig.Message, apiURL) {
+		t.Errorf("expected kubeconfig pointing to %s, got %v", apiURL, kubeconfig)
+	}
+	job := findMessage(messages, "job")
+	if job == nil {
+		t.Fatalf("expected job metadata to be sent, got %v", messages)
+	}
+	var info JobInfo
+	if err := json.Unmarshal([]byte(job.Message), &info); err != nil {
+		t.Fatalf("failed to parse job metadata: %v", err)
+	}
+	if info.Job != "periodic-e2e" || info.BuildID != "1234" || info.Result != "FAILURE" {
+		t.Errorf("unexpected job metadata %+v", info)
+	}
+
+	deployment := instanceDeployment(t, env, messages)
+	fetchers := deployment.Spec.Template.Spec.InitContainers
+	dumpURL := artifacts.URL + testJobRoot + "artifacts/" + testDumpPath
+	if len(fetchers) != 1 || fetchers[0].Env[0].Value != dumpURL {
+		t.Errorf("expected a single fetcher of %s, got %+v", dumpURL, fetchers)
+	}
+
+	record, err := env.cluster.runtime.getRecord(context.TODO(), appLabel)
+	if err != nil {
+		t.Fatalf("failed to get instance record: %v", err)
+	}
+	if record.Data[recordState] != stateReady || record.Data[recordDump] != dumpURL || record.Data[recordCluster] != "test" {
+		t.Errorf("unexpected instance record %v", record.Data)
+	}
+	if record.Labels[jobLabel] != "periodic-e2e" {
+		t.Errorf("expected record to be labelled with the job, got %v", record.Labels)
+	}
+}
+
+func TestNewKASFromTarball(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	env := newTestEnv(t, testConfig(), true)
+	conn := env.dial(t)
+
+	dumpURL := artifacts.URL + testJobRoot + "artifacts/" + testDumpPath
+	messages := createInstance(t, conn, dumpURL, nil)
+	if lastMessage(messages).Action != "done" {
+		t.Fatalf("expected instance to be created, got %v", messages)
+	}
+	if status := findMessage(messages, "status"); status == nil || status.Message != "Found tardump at "+dumpURL {
+		t.Errorf("expected the tarball to be used directly, got %v", status)
+	}
+}
+
+func TestNewKASChooseDumps(t *testing.T) {
+	dumps := []string{
+		"e2e/gather-must-gather/artifacts/must-gather.tar",
+		"e2e/dump-management-cluster/artifacts/hypershift-dump.tar",
+	}
+	files := jobArtifacts(dumps...)
+	files[testJobRoot+"artifacts/"+dumps[1]] = tarball(t,
+		tar.Header{Name: "./namespaces/hostedcluster-nested/pods.yaml", Typeflag: tar.TypeReg},
+		tar.Header{Name: "./hostedcluster-b/", Typeflag: tar.TypeDir},
+		tar.Header{Name: "./hostedcluster-b/namespaces/default/pods.yaml", Typeflag: tar.TypeReg},
+		tar.Header{Name: "hostedcluster-a/namespaces/default/pods.yaml", Typeflag: tar.TypeReg},
+	).Bytes()
+	artifacts := newArtifactServer(t, files)
+	env := newTestEnv(t, testConfig(), true)
+	conn := env.dial(t)
+	jobURL := artifacts.URL + testJobRoot
+
+	messages := createInstance(t, conn, jobURL, nil)
+	choose := lastMessage(messages)
+	if choose.Action != "choose" {
+		t.Fatalf("expected user to choose dumps, got %v", messages)
+	}
+	var found []string
+	if err := json.Unmarshal([]byte(choose.Message), &found); err != nil {
+		t.Fatalf("failed to parse found dumps: %v", err)
+	}
+	if len(found) != len(dumps) {
+		t.Fatalf("expected %d dumps to choose from, got %v", len(dumps), found)
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		selected, _ := json.Marshal([]string{artifacts.URL + "/elsewhere/must-gather.tar"})
+		messages := createInstance(t, conn, jobURL, map[string]string{"dumps": string(selected)})
+		if failure := lastMessage(messages); failure.Action != "failure" || !strings.Contains(failure.Message, "was not found") {
+			t.Errorf("expected unknown dump to be refused, got %v", messages)
+		}
+	})
+
+	t.Run("selected", func(t *testing.T) {
+		selected, _ := json.Marshal(found[1:])
+		messages := createInstance(t, conn, jobURL, map[string]string{"dumps": string(selected)})
+		if lastMessage(messages).Action != "done" {
+			t.Fatalf("expected instance to be created, got %v", messages)
+		}
+		deployment := instanceDeployment(t, env, messages)
+		if fetchers := deployment.Spec.Template.Spec.InitContainers; len(fetchers) != 1 || fetchers[0].Env[0].Value != found[1] {
+			t.Errorf("expected a single fetcher of %s, got %+v", found[1], fetchers)
+		}
+	})
+
+	t.Run("all", func(t *testing.T) {
+		messages := createInstance(t, conn, jobURL, map[string]string{"all": "true", "force": "true"})
+		if lastMessage(messages).Action != "done" {
+			t.Fatalf("expected instance to be created, got %v", messages)
+		}
+		deployment := instanceDeployment(t, env, messages)
+		if fetchers := deployment.Spec.Template.Spec.InitContainers; len(fetchers) != len(dumps) {
+			t.Errorf("expected %d fetchers, got %d", len(dumps), len(fetchers))
+		}
+		// Hypershift dump is served as management and every hosted cluster
+		baseDirs := []string{}
+		for _, container := range deployment.Spec.Template.Spec.Containers {
+			baseDirs = append(baseDirs, container.Args[1])
+		}
+		sort.Strings(baseDirs)
+		expected := []string{"/must-gather/", "/must-gather/", "/must-gather/hostedcluster-a/", "/must-gather/hostedcluster-b/"}
+		if !reflect.DeepEqual(baseDirs, expected) {
+			t.Errorf("expected static-kas containers serving %v, got %v", expected, baseDirs)
+		}
+		kubeconfig := findMessage(messages, "kubeconfig")
+		for _, context := range []string{"static-kas-dump-management-cluster-hosted-a", "static-kas-dump-management-cluster-hosted-b"} {
+			if kubeconfig == nil || !strings.Contains(kubeconfig.Message, "name: "+context+"\n") {
+				t.Errorf("expected kubeconfig context %s, got %v", context, kubeconfig)
+			}
+		}
+	})
+}
+
+// dumpArchive returns gzipped tarball with the files
+func dumpArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to write tarball: %v", err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestNewKASConsoleImage(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		artifact bool
+		expected string
+	}{
+		{
+			name:     "artifact is preferred to the dump",
+			artifact: true,
+			expected: "console:4.13",
+		},
+		{
+			name:     "dump is scanned without artifact",
+			expected: "console:4.14",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := jobArtifacts(testDumpPath)
+			files[testJobRoot+"artifacts/"+testDumpPath] = dumpArchive(t, map[string]string{
+				"must-gather.local.1/quay-io-must-gather/" + dumpClusterVersion: "kind: ClusterVersion\nstatus:\n  desired:\n    version: 4.14.3\n",
+			})
+			if tc.artifact {
+				files[testJobRoot+"artifacts/e2e/gather-extra/artifacts/"+clusterVersionArtifact] = []byte(`{"items": [{"status": {"desired": {"version": "4.13.0"}}}]}`)
+			}
+			artifacts := newArtifactServer(t, files)
+			cfg := testConfig()
+			cfg.Console = true
+			cfg.ConsoleImages = map[string]string{"4.13": "console:4.13", "4.14": "console:4.14"}
+			env := newTestEnv(t, cfg, true)
+			conn := env.dial(t)
+
+			messages := createInstance(t, conn, artifacts.URL+testJobRoot, nil)
+			if lastMessage(messages).Action != "done" {
+				t.Fatalf("expected instance to be created, got %v", messages)
+			}
+			deployment := instanceDeployment(t, env, messages)
+			images := map[string]string{}
+			for _, container := range deployment.Spec.Template.Spec.Containers {
+				images[container.Name] = container.Image
+				// Egress of the instance to its route is blocked
+				if container.Name == "console" && !strings.Contains(strings.Join(container.Args, " "), "--k8s-mode-off-cluster-endpoint=http://localhost:8080") {
+					t.Errorf("expected console to reach static-kas over localhost, got %v", container.Args)
+				}
+			}
+			if images["console"] != tc.expected {
+				t.Errorf("expected console image %s, got %v", tc.expected, images)
+			}
+		})
+	}
+}
+
+func TestNewKASConsoleOption(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		console  bool
+		data     map[string]string
+		expected bool
+	}{
+		{name: "server default without console"},
+		{name: "server default with console", console: true, expected: true},
+		{name: "console requested", data: map[string]string{"console": "true"}, expected: true},
+		{name: "console declined", console: true, data: map[string]string{"console": "false"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+			cfg := testConfig()
+			cfg.Console = tc.console
+			env := newTestEnv(t, cfg, true)
+			conn := env.dial(t)
+
+			messages := createInstance(t, conn, artifacts.URL+testJobRoot, tc.data)
+			if lastMessage(messages).Action != "done" {
+				t.Fatalf("expected instance to be created, got %v", messages)
+			}
+			hasConsole := false
+			for _, container := range instanceDeployment(t, env, messages).Spec.Template.Spec.Containers {
+				hasConsole = hasConsole || container.Name == "console"
+			}
+			appLabel := findMessage(messages, "app-label").Message
+			_, err := env.routes.RouteV1().Routes(testNamespace).Get(context.TODO(), appLabel+"-console", metav1.GetOptions{})
+			if hasConsole != tc.expected || (err == nil) != tc.expected {
+				t.Errorf("expected console to be launched: %v, got container: %v, route error: %v", tc.expected, hasConsole, err)
+			}
+		})
+	}
+}
+
+func TestNewKASInvalidConsoleOption(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	env := newTestEnv(t, testConfig(), true)
+	conn := env.dial(t)
+
+	failure := lastMessage(createInstance(t, conn, artifacts.URL+testJobRoot, map[string]string{"console": "maybe"}))
+	if failure.Action != "failure" || !strings.Contains(failure.Message, `Invalid console option "maybe"`) {
+		t.Errorf("expected invalid option to be refused, got %v", failure)
+	}
+}
+
+func TestNewKASDoesNotOfferHeadlessInstanceForConsole(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	env := newTestEnv(t, testConfig(), true)
+	conn := env.dial(t)
+	jobURL := artifacts.URL + testJobRoot
+
+	headless := lastMessage(createInstance(t, conn, jobURL, nil))
+	if headless.Action != "done" {
+		t.Fatalf("expected instance to be created, got %v", headless)
+	}
+	withConsole := lastMessage(createInstance(t, conn, jobURL, map[string]string{"console": "true"}))
+	if withConsole.Action != "done" || withConsole.Data["hash"] == headless.Data["hash"] {
+		t.Fatalf("expected a new instance with console, got %v", withConsole)
+	}
+	// Instances with console serve API-only requests too
+	existing := lastMessage(createInstance(t, conn, jobURL, map[string]string{"console": "false"}))
+	if existing.Action != "existing" {
+		t.Errorf("expected an instance to be offered, got %v", existing)
+	}
+}
+
+func TestNewKASOffersSharedInstance(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	env := newTestEnv(t, testConfig(), true)
+	conn := env.dial(t)
+	jobURL := artifacts.URL + testJobRoot
+
+	created := lastMessage(createInstance(t, conn, jobURL, nil))
+	if created.Action != "done" {
+		t.Fatalf("expected instance to be created, got %v", created)
+	}
+	existing := lastMessage(createInstance(t, conn, jobURL, nil))
+	if existing.Action != "existing" || existing.Data["hash"] != created.Data["hash"] {
+		t.Errorf("expected instance %s to be offered, got %v", created.Data["hash"], existing)
+	}
+	forced := lastMessage(createInstance(t, conn, jobURL, map[string]string{"force": "true"}))
+	if forced.Action != "done" || forced.Data["hash"] == created.Data["hash"] {
+		t.Errorf("expected a new instance to be forced, got %v", forced)
+	}
+}
+
+func TestNewKASFailures(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts())
+	dumps := newArtifactServer(t, jobArtifacts(testDumpPath, "upgrade/gather-must-gather/artifacts/must-gather.tar"))
+	for _, tc := range []struct {
+		name    string
+		cfg     func(*Config)
+		url     string
+		data    map[string]string
+		message string
+	}{
+		{
+			name:    "no dumps",
+			url:     artifacts.URL + testJobRoot,
+			message: "No dump tarballs found",
+		},
+		{
+			name:    "no artifacts",
+			url:     artifacts.URL + "/gcs/test-bucket/logs/missing/1/",
+			message: "Failed to find must-gather archive",
+		},
+		{
+			name:    "not allowed",
+			cfg:     func(cfg *Config) { cfg.AllowedURLs = []string{"gcsweb.example.com"} },
+			url:     artifacts.URL + testJobRoot,
+			message: ErrURLNotAllowed.Error(),
+		},
+		{
+			name:    "too many dumps",
+			cfg:     func(cfg *Config) { cfg.MaxDumps = 1 },
+			url:     dumps.URL + testJobRoot,
+			data:    map[string]string{"all": "true"},
+			message: "2 dumps selected, one instance can serve at most 1",
+		},
+		{
+			name:    "not http",
+			url:     "file:///etc/passwd.tar",
+			message: ErrURLNotAllowed.Error(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			if tc.cfg != nil {
+				tc.cfg(&cfg)
+			}
+			env := newTestEnv(t, cfg, true)
+			messages := createInstance(t, env.dial(t), tc.url, tc.data)
+			if failure := lastMessage(messages); failure.Action != "failure" || !strings.Contains(failure.Message, tc.message) {
+				t.Errorf("expected failure %q, got %v", tc.message, messages)
+			}
+		})
+	}
+}
+
+func TestNewKASRolloutTimeout(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	cfg := testConfig()
+	cfg.RolloutTimeout = metav1.Duration{Duration: 100 * time.Millisecond}
+	// Timeouts are not retried
+	cfg.Retry.Attempts = 3
+	env := newTestEnv(t, cfg, false)
+	conn := env.dial(t)
+
+	messages := createInstance(t, conn, artifacts.URL+testJobRoot, nil)
+	failure := lastMessage(messages)
+	if failure.Action != "failure" || failure.Diagnosis == nil {
+		t.Fatalf("expected failure with diagnosis, got %v", messages)
+	}
+	if failure.Diagnosis.Category != FailureTimeout {
+		t.Errorf("expected timeout, got %s", failure.Diagnosis.Category)
+	}
+	for _, m := range messages {
+		if strings.HasPrefix(m.Message, "Attempt 1 of 3 failed") {
+			t.Errorf("expected timeout not to be retried")
+		}
+	}
+
+	appLabel := findMessage(messages, "app-label").Message
+	if env.cluster.instanceExists(appLabel) {
+		t.Errorf("expected deployment of failed instance to be removed")
+	}
+	routes, err := env.routes.RouteV1().Routes(testNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil || len(routes.Items) != 0 {
+		t.Errorf("expected routes of failed instance to be removed, got %v: %v", routes, err)
+	}
+	record, err := env.cluster.runtime.getRecord(context.TODO(), appLabel)
+	if err != nil {
+		t.Fatalf("expected record of failed instance to be kept: %v", err)
+	}
+	if record.Data[recordState] != stateFailed || record.Data[recordDiagnosis] == "" {
+		t.Errorf("expected failure to be recorded, got %v", record.Data)
+	}
+}
+
+func TestRemoveKAS(t *testing.T) {
+	artifacts := newArtifactServer(t, jobArtifacts(testDumpPath))
+	env := newTestEnv(t, testConfig(), true)
+	conn := env.dial(t)
+
+	created := lastMessage(createInstance(t, conn, artifacts.URL+testJobRoot, nil))
+	if created.Action != "done" {
+		t.Fatalf("expected instance to be created, got %v", created)
+	}
+	appLabel := created.Data["hash"]
+
+	send(t, conn, WSMessage{Action: "delete", Message: appLabel})
+	if removed := lastMessage(readUntil(t, conn, "done", "failure")); removed.Action != "done" {
+		t.Fatalf("expected instance to be removed, got %v", removed)
+	}
+	if _, err := env.cluster.runtime.getRecord(context.TODO(), appLabel); err == nil {
+		t.Errorf("expected instance record to be removed")
+	}
+	services, err := env.kube.CoreV1().Services(testNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil || len(services.Items) != 0 {
+		t.Errorf("expected instance services to be removed, got %v: %v", services, err)
+	}
+
+	send(t, conn, WSMessage{Action: "delete", Message: appLabel})
+	if missing := lastMessage(readUntil(t, conn, "done", "failure")); missing.Action != "failure" {
+		t.Errorf("expected removed instance not to be found, got %v", missing)
+	}
+}
+
+func TestParseNewKASOptions(t *testing.T) {
+	opts, err := parseNewKASOptions(map[string]string{"force": "true", "console": "false", "dumps": `["a", "b"]`, "region": "eu"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !opts.Force || opts.All || opts.Console == nil || *opts.Console || len(opts.Dumps) != 2 || opts.Region != "eu" {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	if _, err := parseNewKASOptions(map[string]string{"console": "maybe"}); err == nil {
+		t.Errorf("expected invalid console option to fail")
+	}
+	if _, err := parseNewKASOptions(map[string]string{"dumps": "a"}); err == nil {
+		t.Errorf("expected invalid dumps to fail")
+	}
+}
+
+func TestSelectDumps(t *testing.T) {
+	found := []string{"a", "b"}
+	for _, tc := range []struct {
+		name     string
+		opts     newKASOptions
+		found    []string
+		expected []string
+		err      bool
+	}{
+		{name: "single", found: []string{"a"}, expected: []string{"a"}},
+		{name: "choose", found: found},
+		{name: "all", opts: newKASOptions{All: true}, found: found, expected: found},
+		{name: "selected", opts: newKASOptions{Dumps: []string{"b"}}, found: found, expected: []string{"b"}},
+		{name: "unknown", opts: newKASOptions{Dumps: []string{"c"}}, found: found, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			selected, err := tc.opts.selectDumps(tc.found)
+			if (err != nil) != tc.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Join(selected, ",") != strings.Join(tc.expected, ",") || (selected == nil) != (tc.expected == nil) {
+				t.Errorf("expected %v, got %v", tc.expected, selected)
+			}
+		})
+	}
+}